@@ -0,0 +1,942 @@
+package sluice
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/runningwild/clock"
+	"github.com/runningwild/network"
+	"github.com/runningwild/sluice/core"
+)
+
+const (
+	// joinRetryInterval is how long a client waits for a welcome before asking to join again.
+	joinRetryInterval = 100 * time.Millisecond
+
+	// joinTimeout is how long a client tries to join before giving up.
+	joinTimeout = 5 * time.Second
+
+	// leaveTimeout is how long Close waits for the host to get everything we've sent on reliable
+	// streams before leaving anyway.
+	leaveTimeout = time.Second
+)
+
+// Client is a node connected to a sluice Host.
+type Client struct {
+	config *core.Config
+	conn   *net.UDPConn
+
+	// host is the host's address.  conn isn't connected to it since clients also talk to each other
+	// directly.  Everything sent to the host goes through toHost.
+	host   *net.UDPAddr
+	toHost *activityWriter
+
+	// framer frames every datagram the client sends and receives.  If the host has an Identity it
+	// has our session with the host.
+	framer *core.Framer
+
+	// hostKey is the public key of the host's Identity, or nil if it doesn't have one.
+	hostKey []byte
+
+	// connection is the ConnectionId the host gave us.  Everything we send to the host is on it, and
+	// anything from the host that isn't is ignored.
+	connection core.ConnectionId
+
+	// session is the token the host gave us, which lets us resume our session if the host stops
+	// hearing from us at our old address.
+	session core.SessionToken
+
+	// lastHeard is the last time anything arrived from the host.  hostLeft is set once the host has
+	// shut down, timed out, or kicked us, and hostReason says which.  hostMessage is what the host
+	// said when it kicked us.
+	hostMu      sync.Mutex
+	lastHeard   time.Time
+	hostLeft    bool
+	hostReason  core.LeaveReason
+	hostMessage string
+
+	// flushed is closed once the host has everything we've sent on reliable streams, after the client
+	// is closed.
+	flushed chan struct{}
+
+	// writers maps from StreamId to the channel feeding that stream's WriterRoutine.
+	writers map[core.StreamId]chan<- []byte
+	recv    chan core.Packet
+	events  chan Event
+
+	// peers holds the address of every client we have a direct route to.  Changes to peers are also
+	// sent on routes so that fanOut knows who to send to.
+	peersMu sync.RWMutex
+	peers   map[core.NodeId]*net.UDPAddr
+	routes  chan peerRoute
+
+	// stats keeps track of what we see of the host and our peers, and is reported to the host every
+	// config.Stats.
+	stats *core.StatsCollector
+
+	mu        sync.RWMutex
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// MakeClient joins the sluice hosted at hostAddr and returns a Client that is ready to send and
+// receive packets.  The host decides config.Node, config.Starts, and everything in
+// config.GlobalConfig but the Clock and the Key, and config can be nil if the client doesn't need
+// any of the rest.  If config has Streams the host refuses the client unless its streams and
+// MaxChunkDataSize match the host's, and the error is a *ConfigMismatchError that says how.  If the
+// host doesn't speak any of the same protocol versions the error is a *core.VersionError.  If the
+// host won't let the client join for any other reason the error is a *RefusedError with the host's
+// reason.
+func MakeClient(hostAddr string, config *core.Config) (*Client, error) {
+	if config == nil {
+		config = &core.Config{}
+	}
+	if err := config.ValidateJoin(); err != nil {
+		return nil, err
+	}
+	copied := *config
+	config = &copied
+	if config.Clock == nil {
+		config.Clock = &clock.RealClock{}
+	}
+
+	addr, err := net.ResolveUDPAddr("udp", hostAddr)
+	if err != nil {
+		return nil, err
+	}
+	framer, err := core.MakeFramer(config.Key)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, err
+	}
+	j, err := join(conn, addr, framer, config)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	global := *j.globalConfig
+	global.Clock = config.Clock
+	global.Key = config.Key
+	config.GlobalConfig = global
+	if err := config.Validate(); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("the host sent an invalid config: %v", err)
+	}
+	config.Node = j.welcome.Node
+	config.Starts = j.welcome.Starts
+
+	c := &Client{
+		config:  config,
+		conn:    conn,
+		host:    addr,
+		toHost:  &activityWriter{w: addrWriter{conn, addr}, clock: config.Clock},
+		framer:  framer,
+		session: j.welcome.Session,
+		hostKey: j.hostKey,
+		writers: make(map[core.StreamId]chan<- []byte),
+		recv:    make(chan core.Packet),
+		events:  make(chan Event),
+		peers:   make(map[core.NodeId]*net.UDPAddr),
+		routes:  make(chan peerRoute),
+		stats:   core.MakeStatsCollector(config),
+		flushed: make(chan struct{}),
+		done:    make(chan struct{}),
+
+		connection: j.connection,
+		lastHeard:  config.Clock.Now(),
+	}
+
+	// The writers have to be set up before anything that might close the client is started, since
+	// Close closes all of them.
+	fromCore := make(chan core.Chunk)
+	var writers sync.WaitGroup
+	for id, stream := range config.Streams {
+		packets := make(chan []byte)
+		c.writers[id] = packets
+		var target core.NodeId
+		if !stream.Broadcast {
+			target = core.HostNodeId
+		}
+		writers.Add(1)
+		go func(stream core.StreamConfig) {
+			core.WriterRoutine(stream, target, config.MaxChunkDataSize, packets, fromCore)
+			writers.Done()
+		}(stream)
+	}
+	go func() {
+		writers.Wait()
+		close(fromCore)
+	}()
+
+	fromHost := make(chan core.Chunk)
+	toHost := make(chan core.Chunk)
+	reserved := make(chan core.Chunk)
+	packets := make(chan core.Packet)
+	var handlers sync.WaitGroup
+	handlers.Add(2)
+	go func() {
+		core.ClientRecvChunksHandler(config, fromHost, packets, toHost, reserved)
+		handlers.Done()
+	}()
+	go func() {
+		core.ClientSendChunksHandler(config, fromCore, reserved, toHost)
+		close(c.flushed)
+		handlers.Done()
+	}()
+	go func() {
+		handlers.Wait()
+		close(toHost)
+		close(packets)
+	}()
+	go c.demux(packets)
+	hostChunks := make(chan core.Chunk)
+	go c.fanOut(toHost, hostChunks)
+	go framer.BatchAndSend(hostChunks, j.connection, c.toHost, config.Clock, batchCutoffBytes, batchCutoffMs)
+	incoming := make(chan core.Chunk)
+	go c.route(incoming, fromHost)
+	go c.report()
+	go func() {
+		for _, chunk := range j.early {
+			incoming <- chunk
+		}
+		framer.ReceiveAndSplit(udpReader{conn}, incoming, maxDatagramSize)
+	}()
+
+	return c, nil
+}
+
+// RefusedError is returned by MakeClient when the host won't let the client join.
+type RefusedError struct {
+	// Reason is why the host refused.
+	Reason string
+}
+
+func (e *RefusedError) Error() string {
+	return fmt.Sprintf("the host refused to let us join: %s", e.Reason)
+}
+
+// ConfigMismatchError is returned by MakeClient when the host refuses to let the client join
+// because the client was configured with Streams and the streams or MaxChunkDataSize don't match
+// the host's.
+type ConfigMismatchError struct {
+	// Differences describes each way that the client's config differs from the host's.  It is empty
+	// if the host's config didn't all arrive.
+	Differences []string
+}
+
+func (e *ConfigMismatchError) Error() string {
+	if len(e.Differences) == 0 {
+		return "the host refused to let us join: our config doesn't match the host's"
+	}
+	return fmt.Sprintf("the host refused to let us join: our config doesn't match the host's: %s", strings.Join(e.Differences, "; "))
+}
+
+// joined is what a client learns from the host while joining.
+type joined struct {
+	welcome      *core.Welcome
+	globalConfig *core.GlobalConfig
+	connection   core.ConnectionId
+
+	// hostKey is the public key of the host's Identity, or nil if it doesn't have one.
+	hostKey []byte
+
+	// early holds any other chunks that arrived from the host with the welcome.
+	early []core.Chunk
+}
+
+// join asks the host at host to let us join, and waits until it welcomes us and sends us its
+// GlobalConfig.  The host answers our first request with a cookie, which we send back with our next
+// request to show that we're really at this address.  If the host has an Identity it answers that
+// request with a handshake, and the welcome and everything after it on our connection are sealed
+// with the keys of our session, which are added to framer once we know what our connection is.
+// Once we have a session, a welcome or GlobalConfig that isn't sealed with it is ignored.  The
+// connection the welcome arrived on is ours, and it uses the protocol version the host chose from
+// the ones we said we speak.  Any other chunks that arrive from the host with the welcome are
+// returned so that they can be handled once the client is running.  If the host refuses to let us
+// join the error is a *RefusedError or a *ConfigMismatchError, and if it doesn't speak any of the
+// same protocol versions as us it is a *core.VersionError, once we've given up on being welcomed.
+func join(conn *net.UDPConn, host *net.UDPAddr, framer *core.Framer, config *core.Config) (*joined, error) {
+	defer conn.SetReadDeadline(time.Time{})
+	kx, err := core.MakeKeyExchange()
+	if err != nil {
+		return nil, err
+	}
+	j := &joined{welcome: &core.Welcome{Starts: make(map[core.Streamlet]core.SequenceId)}}
+	var fingerprint []byte
+	if len(config.Streams) > 0 {
+		fingerprint = config.GlobalConfig.Fingerprint()
+	}
+	var session *core.Framer
+	var cookie []byte
+	asked := core.SupportedVersions.Min
+	// rejected is the last version rejection we got, which is why we failed to join if we never get
+	// welcomed.
+	var rejected *core.VersionError
+	welcomed := false
+	total := 0
+	// global is the GlobalConfig sent with our welcome, and refused is the one the host sends if it
+	// refuses us because ours doesn't match.
+	var global, refused globalConfigParts
+	buf := make([]byte, maxDatagramSize)
+	deadline := config.Clock.Now().Add(joinTimeout)
+	for config.Clock.Now().Before(deadline) {
+		request := core.Chunk{
+			Stream: core.StreamJoin,
+			Data: core.MakeJoinChunkData(&core.JoinRequest{
+				Versions:    core.SupportedVersions,
+				Cookie:      cookie,
+				Ephemeral:   kx.Public(),
+				Fingerprint: fingerprint,
+				AppVersion:  config.AppVersion,
+				Data:        config.JoinData,
+			}),
+		}
+		framer.WriteChunks([]core.Chunk{request}, core.NoConnection, addrWriter{conn, host})
+		// Read deadlines are on the real clock no matter what config.Clock is.
+		conn.SetReadDeadline(time.Now().Add(joinRetryInterval))
+		for {
+			n, from, err := conn.ReadFromUDP(buf)
+			if err == nil && !isAddr(from, host) {
+				continue
+			}
+			if err != nil {
+				if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+					// Nothing is listening yet, so don't try again right away.
+					<-config.Clock.After(joinRetryInterval)
+				}
+				break
+			}
+			if theirs, ok := core.ParseVersionRejection(buf[0:n]); ok {
+				// The host can't read the version we asked in, so we ask again in the highest one we
+				// both speak, if there is one.  Anyone could have sent the rejection, so we keep
+				// asking until we're welcomed or give up either way.
+				rejected = &core.VersionError{Ours: core.SupportedVersions, Theirs: theirs}
+				if version, ok := core.SupportedVersions.Negotiate(theirs); ok && version != asked {
+					asked = version
+					framer.SetVersion(core.NoConnection, version)
+					break
+				}
+				continue
+			}
+			// We don't know our connection yet, so anything sealed for our session has to be opened
+			// with it directly.
+			sealed := false
+			var chunks []core.Chunk
+			if session != nil {
+				chunks, err = session.ParseChunks(buf[0:n])
+				sealed = err == nil
+			}
+			if !sealed {
+				chunks, err = framer.ParseChunks(buf[0:n])
+			}
+			if err != nil {
+				config.Printf("Error parsing chunks while joining: %v\n", err)
+				continue
+			}
+			gotCookie := false
+			for _, chunk := range chunks {
+				switch chunk.Stream {
+				case core.StreamCookie:
+					cookie = chunk.Data
+					gotCookie = true
+				case core.StreamRefuse:
+					reason, err := core.ParseRefuseChunkData(chunk.Data)
+					if err != nil {
+						config.Printf("error parsing refuse chunk data: %v\n", err)
+						continue
+					}
+					if reason == RefusedConfigMismatch && fingerprint != nil {
+						err := &ConfigMismatchError{}
+						if refused.done() {
+							err.Differences = config.GlobalConfig.Differences(refused.config)
+						}
+						return nil, err
+					}
+					return nil, &RefusedError{Reason: reason}
+				case core.StreamHandshake:
+					if session != nil {
+						continue
+					}
+					h, err := core.ParseHandshakeChunkData(chunk.Data)
+					if err != nil {
+						config.Printf("error parsing handshake chunk data: %v\n", err)
+						continue
+					}
+					if config.HostKey != nil && !bytes.Equal(h.HostKey, config.HostKey) {
+						return nil, fmt.Errorf("the host's key is %x, expected %x", h.HostKey, config.HostKey)
+					}
+					if session, err = kx.Finish(h, config.Key); err != nil {
+						return nil, err
+					}
+					j.hostKey = h.HostKey
+				case core.StreamWelcome:
+					if session != nil && !sealed {
+						// Only the host can seal anything for our session, so this came from someone
+						// else.
+						config.Printf("Ignoring a welcome that isn't sealed for our session.\n")
+						continue
+					}
+					if config.HostKey != nil && !sealed {
+						return nil, fmt.Errorf("the host didn't prove that it has the key %x", config.HostKey)
+					}
+					w, count, err := core.ParseWelcomeChunkData(chunk.Data)
+					if err != nil {
+						config.Printf("error parsing welcome chunk data: %v\n", err)
+						continue
+					}
+					welcomed = true
+					j.connection = chunk.Connection
+					j.welcome.Node = w.Node
+					j.welcome.Session = w.Session
+					j.welcome.Version = w.Version
+					total = count
+					for sl, sequence := range w.Starts {
+						j.welcome.Starts[sl] = sequence
+					}
+				case core.StreamGlobalConfig:
+					parts := &global
+					if chunk.Connection == core.NoConnection {
+						parts = &refused
+					} else if session != nil && !sealed {
+						config.Printf("Ignoring a GlobalConfig that isn't sealed for our session.\n")
+						continue
+					} else if config.HostKey != nil && !sealed {
+						return nil, fmt.Errorf("the host didn't prove that it has the key %x", config.HostKey)
+					}
+					if err := parts.add(chunk.Data); err != nil {
+						config.Printf("error parsing global config chunk data: %v\n", err)
+					}
+				default:
+					j.early = append(j.early, chunk)
+				}
+			}
+			if welcomed && len(j.welcome.Starts) == total && global.done() {
+				if !core.SupportedVersions.Contains(j.welcome.Version) {
+					theirs := core.VersionRange{Min: j.welcome.Version, Max: j.welcome.Version}
+					return nil, &core.VersionError{Ours: core.SupportedVersions, Theirs: theirs}
+				}
+				j.globalConfig = global.config
+				if session != nil {
+					framer.AddSession(j.connection, session)
+				}
+				framer.SetVersion(j.connection, j.welcome.Version)
+				return j, nil
+			}
+			if gotCookie && !welcomed {
+				// Ask again right away, now that we have a cookie.
+				break
+			}
+		}
+	}
+	if rejected != nil {
+		return nil, rejected
+	}
+	return nil, fmt.Errorf("timed out waiting for the host to accept our join")
+}
+
+// globalConfigParts collects the GlobalConfig chunks the host sends us, which can arrive in any
+// order.
+type globalConfigParts struct {
+	config *core.GlobalConfig
+	total  int
+}
+
+func (p *globalConfigParts) add(data []byte) error {
+	g, total, err := core.ParseGlobalConfigChunkData(data)
+	if err != nil {
+		return err
+	}
+	if p.config != nil {
+		for id, stream := range p.config.Streams {
+			g.Streams[id] = stream
+		}
+	}
+	p.config = g
+	p.total = total
+	return nil
+}
+
+// done returns true once every chunk has arrived.
+func (p *globalConfigParts) done() bool {
+	return p.config != nil && len(p.config.Streams) == p.total
+}
+
+// expectedDang is a Dang the host told us to expect, from addr with sequence.
+type expectedDang struct {
+	addr     *net.UDPAddr
+	sequence core.SequenceId
+}
+
+// route sends chunks from the host in incoming to fromHost, and handles the chunks that other
+// clients send us directly.  Ding and Dang chunks, and pings from other clients, are answered
+// immediately, rather than waiting to be batched, since they are used to measure latency.  A Dang is
+// only answered if the host told us to expect it, so nobody else can make us report latencies to
+// the host.  Pongs and the chunks we get from everyone else are noted in c.stats.
+func (c *Client) route(incoming <-chan core.Chunk, fromHost chan<- core.Chunk) {
+	defer close(fromHost)
+	// dangs holds the Dang the host last told us to expect from each client.
+	dangs := make(map[core.NodeId]expectedDang)
+	for chunk := range incoming {
+		fromTheHost := (chunk.SourceAddr == nil || isAddr(chunk.SourceAddr, c.host)) && chunk.Connection == c.connection
+		if fromTheHost {
+			c.hostMu.Lock()
+			c.lastHeard = c.config.Clock.Now()
+			c.hostMu.Unlock()
+		}
+		switch {
+		case chunk.Stream == core.StreamDing && fromTheHost:
+			node, addr, err := core.ParseDingChunkData(chunk.Data)
+			if err != nil {
+				c.config.Printf("error parsing ding chunk data: %v\n", err)
+				break
+			}
+			udpAddr, err := net.ResolveUDPAddr("udp", addr)
+			if err != nil {
+				c.config.Printf("Got a ding for node %d at unusable address %q: %v\n", node, addr, err)
+				break
+			}
+			dang := core.Chunk{
+				Stream:   core.StreamDang,
+				Source:   c.config.Node,
+				Target:   node,
+				Sequence: chunk.Sequence,
+			}
+			c.framer.WriteChunks([]core.Chunk{dang}, core.NoConnection, addrWriter{c.conn, udpAddr})
+
+		case chunk.Stream == core.StreamDang && fromTheHost:
+			node, addr, err := core.ParseDingChunkData(chunk.Data)
+			if err != nil {
+				c.config.Printf("error parsing dang chunk data: %v\n", err)
+				break
+			}
+			udpAddr, err := net.ResolveUDPAddr("udp", addr)
+			if err != nil {
+				c.config.Printf("Told to expect a dang from node %d at unusable address %q: %v\n", node, addr, err)
+				break
+			}
+			dangs[node] = expectedDang{addr: udpAddr, sequence: chunk.Sequence}
+
+		case chunk.Stream == core.StreamDang:
+			expected, ok := dangs[chunk.Source]
+			if chunk.Target != c.config.Node || !ok || chunk.Sequence != expected.sequence ||
+				chunk.SourceAddr == nil || !isAddr(chunk.SourceAddr, expected.addr) {
+				break
+			}
+			delete(dangs, chunk.Source)
+			dong := core.Chunk{
+				Stream:   core.StreamDong,
+				Source:   c.config.Node,
+				Sequence: chunk.Sequence,
+				Data:     core.MakeAnnouncementChunkData(chunk.Source),
+			}
+			c.framer.WriteChunks([]core.Chunk{dong}, c.connection, c.toHost)
+
+		case chunk.Stream == core.StreamLeave && fromTheHost && c.hostShutdown(chunk):
+			c.Close()
+
+		case chunk.Stream == core.StreamPong && fromTheHost:
+			c.stats.HandlePong(core.HostNodeId, chunk)
+
+		case (chunk.Stream == core.StreamWelcome || chunk.Stream == core.StreamGlobalConfig) && fromTheHost:
+			// The host welcomes us again when we resume our session, which we already know about.
+
+		case fromTheHost:
+			c.stats.Received(chunk)
+			fromHost <- chunk
+
+		case c.isPeer(chunk.Source, chunk.SourceAddr):
+			switch chunk.Stream {
+			case core.StreamPunch:
+				// These are only sent to get through NATs.
+				continue
+			case core.StreamPing:
+				pong := core.Chunk{
+					Stream:   core.StreamPong,
+					Source:   c.config.Node,
+					Target:   chunk.Source,
+					Sequence: chunk.Sequence,
+				}
+				c.framer.WriteChunks([]core.Chunk{pong}, core.NoConnection, addrWriter{c.conn, c.peer(chunk.Source)})
+				continue
+			case core.StreamPong:
+				c.stats.HandlePong(chunk.Source, chunk)
+				continue
+			}
+			if stream := c.config.GetStreamConfigById(chunk.Stream); stream == nil || !stream.Broadcast {
+				c.config.Printf("Dropping a chunk on stream %d from node %d, which is not a broadcast stream.\n", chunk.Stream, chunk.Source)
+				break
+			}
+			c.stats.Received(chunk)
+			fromHost <- chunk
+
+		default:
+			c.config.Printf("Dropping a chunk on stream %d from %v, which is not the host.\n", chunk.Stream, chunk.SourceAddr)
+		}
+	}
+}
+
+// hostShutdown returns true if chunk is the Leave chunk the host sends about itself when it shuts
+// down or kicks us, and remembers that the host is gone.
+func (c *Client) hostShutdown(chunk core.Chunk) bool {
+	node, reason, err := core.ParseLeaveChunkData(chunk.Data)
+	if err != nil || node != core.HostNodeId {
+		return false
+	}
+	c.hostMu.Lock()
+	defer c.hostMu.Unlock()
+	if !c.hostLeft {
+		c.hostLeft = true
+		c.hostReason = reason
+		c.hostMessage = core.ParseLeaveMessage(chunk.Data)
+	}
+	return true
+}
+
+// peerRoute tells fanOut to start sending to node at addr, or to stop if addr is nil.
+type peerRoute struct {
+	node core.NodeId
+	addr *net.UDPAddr
+}
+
+// isPeer returns true if we have a direct route to node, and addr is its address.
+func (c *Client) isPeer(node core.NodeId, addr network.Addr) bool {
+	peer := c.peer(node)
+	return peer != nil && addr != nil && isAddr(addr, peer)
+}
+
+// peer returns the address of node if we have a direct route to it, and nil otherwise.
+func (c *Client) peer(node core.NodeId) *net.UDPAddr {
+	c.peersMu.RLock()
+	defer c.peersMu.RUnlock()
+	return c.peers[node]
+}
+
+// setPeer starts or stops a direct route to another client.
+func (c *Client) setPeer(p *core.Punch) {
+	route := peerRoute{node: p.Node}
+	if p.Start {
+		addr, err := net.ResolveUDPAddr("udp", p.Addr)
+		if err != nil {
+			c.config.Printf("Got a punch for node %d at unusable address %q: %v\n", p.Node, p.Addr, err)
+			return
+		}
+		route.addr = addr
+	}
+	c.peersMu.Lock()
+	if route.addr != nil {
+		c.peers[p.Node] = route.addr
+	} else {
+		delete(c.peers, p.Node)
+	}
+	c.peersMu.Unlock()
+	select {
+	case c.routes <- route:
+	case <-c.done:
+	}
+}
+
+// fanOut sends every chunk from toHost to hostChunks, except pongs, which are sent to the host right
+// away.  It also sends our chunks on broadcast streams directly to every client we have a direct
+// route to.  Each of those clients gets its own
+// BatchAndSend, which is stopped when the route is.
+func (c *Client) fanOut(toHost <-chan core.Chunk, hostChunks chan<- core.Chunk) {
+	peers := make(map[core.NodeId]chan core.Chunk)
+	defer func() {
+		close(hostChunks)
+		for _, chunks := range peers {
+			close(chunks)
+		}
+	}()
+	for {
+		select {
+		case chunk, ok := <-toHost:
+			if !ok {
+				return
+			}
+			if chunk.Stream == core.StreamPong {
+				// The host uses pongs to measure our RTT, so they can't wait to be batched.
+				c.framer.WriteChunks([]core.Chunk{chunk}, c.connection, c.toHost)
+				break
+			}
+			hostChunks <- chunk
+			stream := c.config.GetStreamConfigById(chunk.Stream)
+			if stream == nil || !stream.Broadcast {
+				break
+			}
+			for _, chunks := range peers {
+				chunks <- chunk
+			}
+
+		case route := <-c.routes:
+			if chunks, ok := peers[route.node]; ok {
+				close(chunks)
+				delete(peers, route.node)
+			}
+			if route.addr == nil {
+				break
+			}
+			chunks := make(chan core.Chunk)
+			peers[route.node] = chunks
+			go c.framer.BatchAndSend(chunks, core.NoConnection, addrWriter{c.conn, route.addr}, c.config.Clock, batchCutoffBytes, batchCutoffMs)
+
+			// Sending something to the other client right away lets its chunks through any NAT in
+			// front of us.
+			punch := core.Chunk{Stream: core.StreamPunch, Source: c.config.Node, Target: route.node}
+			c.framer.WriteChunks([]core.Chunk{punch}, core.NoConnection, addrWriter{c.conn, route.addr})
+		}
+	}
+}
+
+// report pings the host and every client we have a direct route to every config.Ping, and sends
+// our stats to the host every config.Stats.  The host is also pinged if we haven't sent it anything
+// for config.Keepalive.  If we haven't heard from the host for a while we ask it to resume our
+// session, and if we haven't heard from it for config.Timeout the client is closed.
+// report returns once the client is closed.
+func (c *Client) report() {
+	var pings, stats, keepalives, timeouts <-chan time.Time
+	if c.config.Ping > 0 {
+		ticker := core.MakeTicker(c.config.Ping, c.config.Clock)
+		defer ticker.Stop()
+		pings = ticker.C
+	}
+	if c.config.Stats > 0 {
+		ticker := core.MakeTicker(c.config.Stats, c.config.Clock)
+		defer ticker.Stop()
+		stats = ticker.C
+	}
+	if c.config.Keepalive > 0 {
+		ticker := core.MakeTicker(c.config.Keepalive, c.config.Clock)
+		defer ticker.Stop()
+		keepalives = ticker.C
+	}
+	if c.config.Timeout > 0 {
+		ticker := core.MakeTicker(c.config.Timeout/4, c.config.Clock)
+		defer ticker.Stop()
+		timeouts = ticker.C
+	}
+	for {
+		select {
+		case <-pings:
+			c.framer.WriteChunks([]core.Chunk{c.stats.Ping(core.HostNodeId)}, c.connection, c.toHost)
+			c.peersMu.RLock()
+			peers := make(map[core.NodeId]*net.UDPAddr)
+			for node, addr := range c.peers {
+				peers[node] = addr
+			}
+			c.peersMu.RUnlock()
+			for node, addr := range peers {
+				c.framer.WriteChunks([]core.Chunk{c.stats.Ping(node)}, core.NoConnection, addrWriter{c.conn, addr})
+			}
+
+		case <-stats:
+			var chunks []core.Chunk
+			for _, data := range core.MakeStatsChunkDatas(c.config, c.stats.Report()) {
+				chunks = append(chunks, core.Chunk{Stream: core.StreamStats, Source: c.config.Node, Data: data})
+			}
+			c.framer.WriteChunks(chunks, c.connection, c.toHost)
+
+		case <-keepalives:
+			if c.config.Clock.Now().Sub(c.toHost.Last()) >= c.config.Keepalive {
+				c.framer.WriteChunks([]core.Chunk{c.stats.Ping(core.HostNodeId)}, c.connection, c.toHost)
+			}
+
+		case <-timeouts:
+			c.hostMu.Lock()
+			silence := c.config.Clock.Now().Sub(c.lastHeard)
+			lost := silence > c.config.Timeout
+			if lost && !c.hostLeft {
+				c.hostLeft = true
+				c.hostReason = core.LeaveTimeout
+			}
+			c.hostMu.Unlock()
+			if lost {
+				c.config.Printf("The host timed out.\n")
+				c.Close()
+				return
+			}
+			if silence > c.config.Timeout/4 {
+				// Our address might have changed, in which case the host is dropping everything we send
+				// and sending everything for us somewhere else.
+				resume := core.Chunk{
+					Stream: core.StreamJoin,
+					Source: c.config.Node,
+					Data:   core.MakeResumeChunkData(&core.Resume{Node: c.config.Node, Session: c.session}),
+				}
+				c.framer.WriteChunks([]core.Chunk{resume}, c.connection, c.toHost)
+			}
+
+		case <-c.done:
+			return
+		}
+	}
+}
+
+// demux sends join and leave packets from packets to the events channel, uses punch packets to
+// start and stop direct routes, and sends everything else to recv.  If the host shut down, timed
+// out, or kicked us, a leave event for the host is the last event.
+func (c *Client) demux(packets <-chan core.Packet) {
+	events := make(chan Event)
+	go eventQueue(events, c.events)
+	defer close(events)
+	defer close(c.recv)
+	for packet := range packets {
+		var event Event
+		switch packet.Stream {
+		case core.StreamJoin:
+			event.Type = EventJoin
+		case core.StreamLeave:
+			event.Type = EventLeave
+		case core.StreamPunch:
+			p, err := core.ParsePunchChunkData(packet.Data)
+			if err != nil {
+				c.config.Printf("error parsing punch: %v\n", err)
+				continue
+			}
+			c.setPeer(p)
+			continue
+		default:
+			c.recv <- packet
+			continue
+		}
+		var node core.NodeId
+		var err error
+		if event.Type == EventLeave {
+			node, event.Reason, err = core.ParseLeaveChunkData(packet.Data)
+		} else {
+			node, err = core.ParseAnnouncementChunkData(packet.Data)
+		}
+		if err != nil {
+			c.config.Printf("error parsing announcement: %v\n", err)
+			continue
+		}
+		event.Node = node
+		if event.Type == EventLeave {
+			c.setPeer(&core.Punch{Start: false, Node: node})
+			c.stats.Remove(node)
+		}
+		events <- event
+	}
+	c.hostMu.Lock()
+	left, reason, message := c.hostLeft, c.hostReason, c.hostMessage
+	c.hostMu.Unlock()
+	if left {
+		events <- Event{Type: EventLeave, Node: core.HostNodeId, Reason: reason, Message: message}
+	}
+}
+
+// Send sends data on the stream named stream.  Broadcast streams are delivered to every node,
+// other streams are delivered only to the host.
+func (c *Client) Send(stream string, data []byte) error {
+	id := c.config.GetIdFromName(stream)
+	if id == 0 {
+		return fmt.Errorf("unknown stream %q", stream)
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	select {
+	case <-c.done:
+		return fmt.Errorf("client is closed")
+	default:
+	}
+	select {
+	case c.writers[id] <- data:
+		return nil
+	case <-c.done:
+		return fmt.Errorf("client is closed")
+	}
+}
+
+// Recv returns the channel that all packets sent to this client are delivered on.  The channel is
+// closed after the client is closed.
+func (c *Client) Recv() <-chan core.Packet {
+	return c.recv
+}
+
+// Events returns the channel that other clients joining and leaving are reported on.  If the host
+// shuts down, times out, or kicks this client, a leave event with the host's NodeId is reported and
+// the client is closed.  The channel is closed after the client is closed.
+func (c *Client) Events() <-chan Event {
+	return c.events
+}
+
+// Peers returns the NodeIds of the clients that this client is sending broadcast packets to
+// directly, rather than through the host.
+func (c *Client) Peers() []core.NodeId {
+	c.peersMu.RLock()
+	defer c.peersMu.RUnlock()
+	var nodes []core.NodeId
+	for node := range c.peers {
+		nodes = append(nodes, node)
+	}
+	sort.Sort(nodeIds(nodes))
+	return nodes
+}
+
+type nodeIds []core.NodeId
+
+func (n nodeIds) Len() int           { return len(n) }
+func (n nodeIds) Less(i, j int) bool { return n[i] < n[j] }
+func (n nodeIds) Swap(i, j int)      { n[i], n[j] = n[j], n[i] }
+
+// RTT returns the current estimate of the round trip time to the host, and false if there isn't one
+// yet.  The client pings the host every config.Ping to keep this estimate up to date.
+func (c *Client) RTT() (core.RTT, bool) {
+	return c.stats.RTT(core.HostNodeId)
+}
+
+// NodeId returns the NodeId the host assigned to this client.
+func (c *Client) NodeId() core.NodeId {
+	return c.config.Node
+}
+
+// Counters returns how much the client has dropped because someone sent it something they
+// shouldn't have.
+func (c *Client) Counters() Counters {
+	return Counters{Replayed: c.framer.Replayed()}
+}
+
+// HostKey returns the public key of the host's Identity, or nil if the host doesn't have one.  A
+// client that wasn't given a HostKey to expect can keep this one to expect next time.
+func (c *Client) HostKey() []byte {
+	return c.hostKey
+}
+
+// Close tells the host that the client is leaving and disconnects from it.  Anything already sent
+// on a reliable stream gets to the host first, unless that takes longer than leaveTimeout.
+func (c *Client) Close() error {
+	var err error
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.mu.Lock()
+		for _, packets := range c.writers {
+			close(packets)
+		}
+		c.mu.Unlock()
+		c.hostMu.Lock()
+		hostLeft := c.hostLeft
+		c.hostMu.Unlock()
+		if !hostLeft {
+			select {
+			case <-c.flushed:
+			case <-c.config.Clock.After(leaveTimeout):
+				c.config.Printf("Leaving before the host got everything we sent.\n")
+			}
+			leave := core.Chunk{
+				Stream: core.StreamLeave,
+				Source: c.config.Node,
+				Data:   core.MakeLeaveChunkData(c.config.Node, core.LeaveClosed),
+			}
+			c.framer.WriteChunks([]core.Chunk{leave}, c.connection, c.toHost)
+		}
+		err = c.conn.Close()
+	})
+	return err
+}
@@ -0,0 +1,123 @@
+package sluice
+
+import (
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/runningwild/clock"
+	"github.com/runningwild/network"
+	"github.com/runningwild/sluice/core"
+)
+
+const (
+	// maxDatagramSize is the size of the buffer used to read incoming datagrams.
+	maxDatagramSize = 65536
+
+	// batchCutoffBytes and batchCutoffMs control how BatchAndSend groups chunks into datagrams.
+	batchCutoffBytes = 1200
+	batchCutoffMs    = 5
+)
+
+// udpReader adapts a *net.UDPConn so that it can be used as a core.ReadFromer.
+type udpReader struct {
+	conn *net.UDPConn
+}
+
+func (r udpReader) ReadFrom(buf []byte) (int, network.Addr, error) {
+	n, addr, err := r.conn.ReadFrom(buf)
+	return n, addr, err
+}
+
+// versionChecker is a core.ReadFromer like udpReader, but it answers every datagram that is framed
+// with a protocol version we don't speak with a version rejection, rather than passing it on, so
+// that the peer can tell why it isn't getting anywhere.
+type versionChecker struct {
+	conn   *net.UDPConn
+	config *core.Config
+}
+
+func (r versionChecker) ReadFrom(buf []byte) (int, network.Addr, error) {
+	for {
+		n, addr, err := r.conn.ReadFrom(buf)
+		if err != nil {
+			return n, addr, err
+		}
+		versionErr, ok := core.CheckPreamble(buf[0:n]).(*core.VersionError)
+		if !ok {
+			return n, addr, nil
+		}
+		r.config.Printf("Rejecting a datagram from %v: %v\n", addr, versionErr)
+		rejection := core.MakeVersionRejection()
+		if n >= len(rejection) {
+			r.conn.WriteTo(rejection, addr)
+		}
+	}
+}
+
+// isAddr returns true if addr is the same UDP address as udpAddr.
+func isAddr(addr network.Addr, udpAddr *net.UDPAddr) bool {
+	other, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return addr.String() == udpAddr.String()
+	}
+	return other.Port == udpAddr.Port && other.IP.Equal(udpAddr.IP)
+}
+
+// addrWriter is an io.Writer that sends everything written to it to a single addr on conn.
+type addrWriter struct {
+	conn *net.UDPConn
+	addr net.Addr
+}
+
+func (w addrWriter) Write(buf []byte) (int, error) {
+	return w.conn.WriteTo(buf, w.addr)
+}
+
+// clientWriter is an io.Writer that sends everything written to it to a client's current address on
+// conn.  The address can change if the client resumes its session from somewhere else.
+type clientWriter struct {
+	conn *net.UDPConn
+
+	mu   sync.RWMutex
+	addr net.Addr
+}
+
+func (w *clientWriter) Write(buf []byte) (int, error) {
+	w.mu.RLock()
+	addr := w.addr
+	w.mu.RUnlock()
+	return w.conn.WriteTo(buf, addr)
+}
+
+// SetAddr changes the address that everything is sent to.
+func (w *clientWriter) SetAddr(addr net.Addr) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.addr = addr
+}
+
+// activityWriter is an io.Writer that remembers the last time anything was written to it.
+type activityWriter struct {
+	w     io.Writer
+	clock clock.Clock
+
+	mu   sync.Mutex
+	last time.Time
+}
+
+func (w *activityWriter) Write(buf []byte) (int, error) {
+	n, err := w.w.Write(buf)
+	w.mu.Lock()
+	w.last = w.clock.Now()
+	w.mu.Unlock()
+	return n, err
+}
+
+// Last returns the last time anything was written.
+func (w *activityWriter) Last() time.Time {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.last
+}
@@ -0,0 +1,58 @@
+package core
+
+import (
+	"sync"
+	"time"
+
+	"github.com/runningwild/clock"
+)
+
+// BanList keeps track of who isn't allowed to join, and until when.  It is safe to use from multiple
+// goroutines.
+type BanList struct {
+	clock clock.Clock
+
+	mu sync.Mutex
+
+	// bans maps from whoever is banned to when their ban expires, which is the zero Time for bans that
+	// never expire.
+	bans map[string]time.Time
+}
+
+// MakeBanList returns an empty BanList that uses c to tell when bans expire.
+func MakeBanList(c clock.Clock) *BanList {
+	return &BanList{clock: c, bans: make(map[string]time.Time)}
+}
+
+// Add bans key for d, or forever if d is zero.  Any ban key already has is replaced.
+func (b *BanList) Add(key string, d time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var expires time.Time
+	if d > 0 {
+		expires = b.clock.Now().Add(d)
+	}
+	b.bans[key] = expires
+}
+
+// Remove lifts any ban on key.
+func (b *BanList) Remove(key string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.bans, key)
+}
+
+// Banned returns true if key is banned.  Expired bans are forgotten.
+func (b *BanList) Banned(key string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	expires, ok := b.bans[key]
+	if !ok {
+		return false
+	}
+	if !expires.IsZero() && !b.clock.Now().Before(expires) {
+		delete(b.bans, key)
+		return false
+	}
+	return true
+}
@@ -0,0 +1,43 @@
+package core_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/runningwild/clock"
+	"github.com/runningwild/sluice/core"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestBanList(t *testing.T) {
+	Convey("BanList", t, func() {
+		fc := &clock.FakeClock{}
+		bans := core.MakeBanList(fc)
+		So(bans.Banned("127.0.0.1"), ShouldBeFalse)
+
+		Convey("Bans that don't expire last forever.", func() {
+			bans.Add("127.0.0.1", 0)
+			So(bans.Banned("127.0.0.1"), ShouldBeTrue)
+			So(bans.Banned("127.0.0.2"), ShouldBeFalse)
+			fc.Inc(1000 * time.Hour)
+			So(bans.Banned("127.0.0.1"), ShouldBeTrue)
+		})
+
+		Convey("Bans that expire last until they do.", func() {
+			bans.Add("bob", time.Minute)
+			fc.Inc(59 * time.Second)
+			So(bans.Banned("bob"), ShouldBeTrue)
+			fc.Inc(time.Second)
+			So(bans.Banned("bob"), ShouldBeFalse)
+		})
+
+		Convey("Bans can be replaced and lifted.", func() {
+			bans.Add("bob", time.Minute)
+			bans.Add("bob", 0)
+			fc.Inc(time.Hour)
+			So(bans.Banned("bob"), ShouldBeTrue)
+			bans.Remove("bob")
+			So(bans.Banned("bob"), ShouldBeFalse)
+		})
+	})
+}
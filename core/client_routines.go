@@ -7,7 +7,9 @@ import (
 // ClientSendChunksHandler handles chunks that are sent from the user to sluice so that they can be
 // dispatched.  Chunks from fromCore are sent to toHost, and if they come from a reliable stream
 // they are also stored until they are truncated.  Chunks received from reserved require special
-// handling.
+// handling.  Once fromCore is closed ClientSendChunksHandler keeps going until the host has
+// truncated every reliable chunk, so that nothing is lost when a client leaves, and then returns.
+// It returns right away if reserved is closed.
 func ClientSendChunksHandler(config *Config, fromCore, reserved <-chan Chunk, toHost chan<- Chunk) {
 	pt := make(PacketTracker)
 	positions := make(PositionUpdate)
@@ -21,13 +23,18 @@ func ClientSendChunksHandler(config *Config, fromCore, reserved <-chan Chunk, to
 		// tracked and used to determine when to send the next position chunk.
 		case chunk, ok := <-fromCore:
 			if !ok {
-				return
+				if len(pt) == 0 {
+					return
+				}
+				fromCore = nil
+				break
 			}
 			stream := config.GetStreamConfigById(chunk.Stream)
 			if stream == nil {
 				config.Printf("tried to send a chunk on unknown stream %d\n", chunk.Stream)
 				break
 			}
+			chunk.Source = config.Node
 			toHost <- chunk
 			if stream.Mode.Reliable() {
 				pt.Add(chunk)
@@ -62,6 +69,15 @@ func ClientSendChunksHandler(config *Config, fromCore, reserved <-chan Chunk, to
 					}
 				}
 
+			case StreamPing:
+				// Ping chunks are sent here from ClientRecvChunksHandler.  The host uses them to measure
+				// our round trip time, so we answer them as quickly as possible.
+				toHost <- Chunk{
+					Stream:   StreamPong,
+					Source:   config.Node,
+					Sequence: chunk.Sequence,
+				}
+
 			case StreamTruncate:
 				// Truncate chunks are sent here from ClientRecvChunksHandler, they let us know what chunks
 				// we no longer have to track.  These chunks typically come less rapidly than other chunks
@@ -77,6 +93,9 @@ func ClientSendChunksHandler(config *Config, fromCore, reserved <-chan Chunk, to
 						reminder.Clear(stream)
 					}
 				}
+				if fromCore == nil && len(pt) == 0 {
+					return
+				}
 			}
 
 		// The reminder triggers whenever we have chunks on a reliable stream that we haven't
@@ -98,18 +117,20 @@ func ClientSendChunksHandler(config *Config, fromCore, reserved <-chan Chunk, to
 	}
 }
 
-func makeMerger(config *Config, mode Mode, sl Streamlet) ChunkMerger {
-	switch config.Streams[sl.Stream].Mode {
+// makeMerger returns a ChunkMerger appropriate for mode.  start is only used by reliable modes, and
+// is the first SequenceId that the merger should expect.
+func makeMerger(config *Config, mode Mode, start SequenceId) ChunkMerger {
+	switch mode {
 	case ModeUnreliableUnordered:
 		return MakeUnreliableUnorderedChunkMerger(config.MaxUnreliableAge)
 	case ModeUnreliableOrdered:
 		return MakeUnreliableOrderedChunkMerger(config.MaxUnreliableAge)
 	case ModeReliableUnordered:
-		return MakeReliableUnorderedChunkMerger(config.Starts[sl])
+		return MakeReliableUnorderedChunkMerger(start)
 	case ModeReliableOrdered:
-		return MakeReliableOrderedChunkMerger(config.Starts[sl])
+		return MakeReliableOrderedChunkMerger(start)
 	default:
-		panic(fmt.Sprintf("unknown mode %v for stream %v", config.Streams[sl.Stream].Mode, sl.Stream))
+		panic(fmt.Sprintf("unknown mode %v", mode))
 	}
 }
 
@@ -119,12 +140,17 @@ type Packet struct {
 	Data   []byte
 }
 
-// ClientRecvChunksHandler takes incoming chunks from fromHost and sends them to toCore.  Reserved
-// chunks from the host are sent immediately to reserved.
+// ClientRecvChunksHandler takes incoming chunks from fromHost and sends them to toCore.  Duplicate
+// chunks, which can arrive when another client is sending to us directly as well as through the
+// host, are dropped.  Join, Leave, and Punch chunks from the host are confirmed like reliable
+// chunks and each one is sent to toCore once, in order, as a Packet on the same stream whose Data
+// is the announcement.  Once a node leaves everything we were tracking from it is forgotten.  Other
+// reserved chunks from the host are sent immediately to reserved.
 func ClientRecvChunksHandler(config *Config, fromHost <-chan Chunk, toCore chan<- Packet, toHost, reserved chan<- Chunk) {
 	defer close(reserved)
 	mergers := make(map[Streamlet]ChunkMerger)
-	ticker := config.Clock.Tick(config.Confirmation)
+	ticker := MakeTicker(config.Confirmation, config.Clock)
+	defer ticker.Stop()
 	trackers := make(map[Streamlet]*SequenceTracker)
 	for sl, start := range config.Starts {
 		trackers[sl] = MakeSequenceTracker(sl.Stream, sl.Node, start)
@@ -135,6 +161,48 @@ func ClientRecvChunksHandler(config *Config, fromHost <-chan Chunk, toCore chan<
 			if !ok {
 				return
 			}
+			if chunk.Stream.IsAnnouncement() {
+				sl := Streamlet{chunk.Stream, HostNodeId}
+				tracker, ok := trackers[sl]
+				if !ok {
+					tracker = MakeSequenceTracker(sl.Stream, sl.Node, FirstSequenceId)
+					trackers[sl] = tracker
+				}
+				if tracker.Contains(chunk.Sequence) {
+					break
+				}
+				tracker.AddSequenceId(chunk.Sequence)
+				merger, ok := mergers[sl]
+				if !ok {
+					merger = MakeReliableOrderedChunkMerger(FirstSequenceId)
+					mergers[sl] = merger
+				}
+				for _, data := range merger.AddChunk(chunk) {
+					if chunk.Stream == StreamLeave {
+						node, _, err := ParseLeaveChunkData(data)
+						if err != nil {
+							config.Printf("error parsing leave chunk data: %v\n", err)
+							continue
+						}
+						for sl := range mergers {
+							if sl.Node == node {
+								delete(mergers, sl)
+							}
+						}
+						for sl := range trackers {
+							if sl.Node == node {
+								delete(trackers, sl)
+							}
+						}
+					}
+					toCore <- Packet{
+						Stream: chunk.Stream,
+						Source: HostNodeId,
+						Data:   data,
+					}
+				}
+				break
+			}
 			if chunk.Stream.IsReserved() {
 				reserved <- chunk
 				break
@@ -145,9 +213,20 @@ func ClientRecvChunksHandler(config *Config, fromHost <-chan Chunk, toCore chan<
 				break
 			}
 			sl := Streamlet{chunk.Stream, chunk.Source}
+			if stream.Mode.Reliable() {
+				tracker, ok := trackers[sl]
+				if !ok {
+					tracker = MakeSequenceTracker(sl.Stream, sl.Node, config.GetStart(sl))
+					trackers[sl] = tracker
+				}
+				if tracker.Contains(chunk.Sequence) {
+					break
+				}
+				tracker.AddSequenceId(chunk.Sequence)
+			}
 			merger, ok := mergers[sl]
 			if !ok {
-				merger = makeMerger(config, stream.Mode, sl)
+				merger = makeMerger(config, stream.Mode, config.GetStart(sl))
 				mergers[sl] = merger
 			}
 			for _, packetData := range merger.AddChunk(chunk) {
@@ -157,16 +236,8 @@ func ClientRecvChunksHandler(config *Config, fromHost <-chan Chunk, toCore chan<
 					Data:   packetData,
 				}
 			}
-			if stream.Mode.Reliable() {
-				tracker, ok := trackers[sl]
-				if !ok {
-					config.Printf("No tracker exists for %v\n", sl)
-				} else {
-					tracker.AddSequenceId(chunk.Sequence)
-				}
-			}
 
-		case <-ticker:
+		case <-ticker.C:
 			for _, tracker := range trackers {
 				for _, data := range MakeSequenceTrackerChunkDatas(config, tracker) {
 					toHost <- Chunk{
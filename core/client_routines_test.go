@@ -100,6 +100,14 @@ func TestClientSendChunks(t *testing.T) {
 			So(verifySimpleChunk(pt.Get(config.GetIdFromName("RO"), config.Node, 42)), ShouldBeTrue)
 		})
 
+		Convey("Answers pings with pongs.", func() {
+			reserved <- core.Chunk{Stream: core.StreamPing, Source: core.HostNodeId, Target: config.Node, Sequence: 12}
+			pong := <-toHost
+			So(pong.Stream, ShouldEqual, core.StreamPong)
+			So(pong.Source, ShouldEqual, config.Node)
+			So(pong.Sequence, ShouldEqual, 12)
+		})
+
 		Convey("After it gets a bunch of chunks on reliable streams.", func() {
 			N := 100
 			go func() {
@@ -694,3 +702,226 @@ func TestClientRecvChunks(t *testing.T) {
 
 	})
 }
+
+func TestClientRecvAnnouncements(t *testing.T) {
+	Convey("ClientRecvChunksHandler with announcements", t, func() {
+		config := &core.Config{
+			Node:   5,
+			Logger: log.New(os.Stdout, "", log.Lshortfile|log.Ltime),
+			GlobalConfig: core.GlobalConfig{
+				Streams: map[core.StreamId]core.StreamConfig{
+					10: core.StreamConfig{
+						Name:      "RB",
+						Id:        10,
+						Mode:      core.ModeReliableOrdered,
+						Broadcast: true,
+					},
+				},
+				MaxChunkDataSize: 50,
+				Confirmation:     10 * time.Millisecond,
+				Clock:            &clock.RealClock{},
+			},
+		}
+		fromHost := make(chan core.Chunk)
+		toCore := make(chan core.Packet)
+		toHost := make(chan core.Chunk)
+		reserved := make(chan core.Chunk)
+		handlerIsDone := make(chan struct{})
+		defer func() {
+			close(fromHost)
+			for {
+				select {
+				case <-handlerIsDone:
+					return
+				case <-toHost:
+				case <-toCore:
+				}
+			}
+		}()
+		go func() {
+			core.ClientRecvChunksHandler(config, fromHost, toCore, toHost, reserved)
+			close(handlerIsDone)
+		}()
+		announce := func(stream core.StreamId, sequence core.SequenceId, node core.NodeId) {
+			data := core.MakeAnnouncementChunkData(node)
+			if stream == core.StreamLeave {
+				data = core.MakeLeaveChunkData(node, core.LeaveTimeout)
+			}
+			fromHost <- core.Chunk{
+				Stream:   stream,
+				Source:   core.HostNodeId,
+				Target:   config.Node,
+				Sequence: sequence,
+				Data:     data,
+			}
+		}
+
+		Convey("Join and Leave chunks are sent to toCore exactly once.", func() {
+			go func() {
+				announce(core.StreamJoin, 1, 6)
+				announce(core.StreamJoin, 1, 6)
+				announce(core.StreamJoin, 2, 7)
+				announce(core.StreamLeave, 1, 6)
+				announce(core.StreamLeave, 1, 6)
+				announce(core.StreamJoin, 3, 8)
+			}()
+			expected := []struct {
+				stream core.StreamId
+				node   core.NodeId
+			}{
+				{core.StreamJoin, 6},
+				{core.StreamJoin, 7},
+				{core.StreamLeave, 6},
+				{core.StreamJoin, 8},
+			}
+			for _, e := range expected {
+				packet := <-toCore
+				So(packet.Stream, ShouldEqual, e.stream)
+				So(packet.Source, ShouldEqual, core.HostNodeId)
+				if e.stream == core.StreamLeave {
+					node, reason, err := core.ParseLeaveChunkData(packet.Data)
+					So(err, ShouldBeNil)
+					So(node, ShouldEqual, e.node)
+					So(reason, ShouldEqual, core.LeaveTimeout)
+				} else {
+					node, err := core.ParseAnnouncementChunkData(packet.Data)
+					So(err, ShouldBeNil)
+					So(node, ShouldEqual, e.node)
+				}
+			}
+		})
+
+		Convey("Punch chunks are sent to toCore in order.", func() {
+			punch := func(sequence core.SequenceId, start bool) {
+				fromHost <- core.Chunk{
+					Stream:   core.StreamPunch,
+					Source:   core.HostNodeId,
+					Target:   config.Node,
+					Sequence: sequence,
+					Data:     core.MakePunchChunkData(&core.Punch{Start: start, Node: 6, Addr: "addr"}),
+				}
+			}
+			go func() {
+				punch(2, false)
+				punch(2, false)
+				punch(1, true)
+			}()
+			for _, start := range []bool{true, false} {
+				packet := <-toCore
+				So(packet.Stream, ShouldEqual, core.StreamPunch)
+				p, err := core.ParsePunchChunkData(packet.Data)
+				So(err, ShouldBeNil)
+				So(p.Start, ShouldEqual, start)
+			}
+		})
+
+		Convey("Reliable chunks that arrive twice are only used once.", func() {
+			stream := config.GetIdFromName("RB")
+			go func() {
+				fromHost <- makeSimpleChunk(stream, 6, 2)
+				fromHost <- makeSimpleChunk(stream, 6, 2)
+				fromHost <- makeSimpleChunk(stream, 6, 1)
+				fromHost <- makeSimpleChunk(stream, 6, 2)
+				fromHost <- makeSimpleChunk(stream, 6, 1)
+				fromHost <- makeSimpleChunk(stream, 6, 3)
+				fromHost <- makeSimpleChunk(stream, 6, 4)
+			}()
+			for sequence := core.SequenceId(1); sequence <= 4; sequence++ {
+				packet := <-toCore
+				So(packet.Source, ShouldEqual, 6)
+				So(packet.Data, ShouldResemble, makeSimpleChunk(stream, 6, sequence).Data)
+			}
+		})
+
+		Convey("Join chunks are confirmed to the host.", func() {
+			go func() {
+				for range toCore {
+				}
+			}()
+			announce(core.StreamJoin, 1, 6)
+			for {
+				chunk := <-toHost
+				So(chunk.Stream, ShouldEqual, core.StreamConfirm)
+				st, err := core.ParseSequenceTrackerChunkData(chunk.Data)
+				So(err, ShouldBeNil)
+				if st.StreamId() == core.StreamJoin {
+					So(st.NodeId(), ShouldEqual, core.HostNodeId)
+					So(st.Contains(1), ShouldBeTrue)
+					break
+				}
+			}
+		})
+
+		Convey("Nothing is remembered about a node after it leaves.", func() {
+			go func() {
+				for range toCore {
+				}
+			}()
+			stream := config.GetIdFromName("RB")
+			fromHost <- makeSimpleChunk(stream, 6, 1)
+			announce(core.StreamLeave, 1, 6)
+
+			// Every batch of confirm chunks has exactly one for StreamLeave, so everything between two
+			// of them was sent after the Leave chunk was handled.
+			leaves := 0
+			for leaves < 2 {
+				chunk := <-toHost
+				st, err := core.ParseSequenceTrackerChunkData(chunk.Data)
+				So(err, ShouldBeNil)
+				if st.StreamId() == core.StreamLeave {
+					leaves++
+				} else if leaves > 0 {
+					So(st.NodeId(), ShouldNotEqual, 6)
+				}
+			}
+		})
+	})
+}
+
+func TestClientSendChunksFlush(t *testing.T) {
+	Convey("ClientSendChunksHandler doesn't return until every reliable chunk has been truncated.", t, func() {
+		config := &core.Config{
+			Node: 5,
+			GlobalConfig: core.GlobalConfig{
+				Streams: map[core.StreamId]core.StreamConfig{
+					10: core.StreamConfig{
+						Name: "RO",
+						Id:   10,
+						Mode: core.ModeReliableOrdered,
+					},
+				},
+				MaxChunkDataSize: 50,
+				PositionChunkMin: time.Hour,
+				PositionChunkMax: time.Hour,
+				Clock:            &clock.RealClock{},
+			},
+		}
+		fromCore := make(chan core.Chunk)
+		reserved := make(chan core.Chunk)
+		toHost := make(chan core.Chunk)
+		handlerIsDone := make(chan struct{})
+		go func() {
+			core.ClientSendChunksHandler(config, fromCore, reserved, toHost)
+			close(handlerIsDone)
+		}()
+		fromCore <- makeSimpleChunk(10, config.Node, 1)
+		<-toHost
+		fromCore <- makeSimpleChunk(10, config.Node, 2)
+		<-toHost
+		close(fromCore)
+
+		truncate := func(sequence core.SequenceId) {
+			for _, data := range core.MakeTruncateChunkDatas(config, core.TruncateRequest{10: sequence}) {
+				reserved <- core.Chunk{Stream: core.StreamTruncate, Data: data}
+			}
+		}
+		truncate(1)
+		select {
+		case <-handlerIsDone:
+			So("returned early", ShouldBeEmpty)
+		case <-time.After(20 * time.Millisecond):
+		}
+		truncate(2)
+		<-handlerIsDone
+	})
+}
@@ -1,16 +1,22 @@
 package core
 
 import (
+	"crypto/ecdh"
 	"fmt"
 	"time"
 
 	"github.com/runningwild/clock"
+	"github.com/runningwild/network"
 )
 
-// NodeId is used to identify clients.  The Host has NodeId == 1.  NodeIds are not reused, so it a
-// client disconnects and then reconnects it will be assigned a new, previously unused, NodeId.
+// NodeId is used to identify clients.  The Host has NodeId == 1.  NodeIds are not reused until every
+// one of them has been used, so a client that disconnects and then reconnects is usually assigned a
+// new NodeId.  Once they have all been used, the NodeIds of clients that have left are reused.
 type NodeId uint16
 
+// HostNodeId is the NodeId of the host.
+const HostNodeId NodeId = 1
+
 // StreamId is used to distinguish different streams.  Users identify streams with arbitrary
 // strings, and those are assigned StreamIds.  There are also reserved StreamIds for all of the
 // low-level data that sluice needs to send.
@@ -29,6 +35,9 @@ type Streamlet struct {
 // starts at 1 and is incremented for each chunk.
 type SequenceId uint32
 
+// FirstSequenceId is the SequenceId of the first chunk sent on any streamlet.
+const FirstSequenceId SequenceId = 1
+
 // SubsequenceIndex is used to order chunks that all came from the same packet.  If a packet did not
 // get split into multiple packets the SubsequenceIndex will be 0, otherwise the first chunk in that
 // packet will be 1, and the index will be incremented for each successive chunk.  Note that for a
@@ -37,8 +46,8 @@ type SequenceId uint32
 type SubsequenceIndex uint16
 
 // Mode defines what kind of reliability is expected on a stream.  Regardless of the mode, all
-// packets that do arrive will be subject to a CRC, and will be reassembled into their original
-// length.  Duplicate packets are also removed for all modes.
+// packets that do arrive will be subject to a CRC, or authenticated if there is a Key, and will be
+// reassembled into their original length.  Duplicate packets are also removed for all modes.
 type Mode int
 
 const (
@@ -70,6 +79,19 @@ func (m Mode) Reliable() bool {
 func (m Mode) Ordered() bool {
 	return m == ModeUnreliableOrdered || m == ModeReliableOrdered
 }
+func (m Mode) String() string {
+	switch m {
+	case ModeUnreliableUnordered:
+		return "ModeUnreliableUnordered"
+	case ModeUnreliableOrdered:
+		return "ModeUnreliableOrdered"
+	case ModeReliableUnordered:
+		return "ModeReliableUnordered"
+	case ModeReliableOrdered:
+		return "ModeReliableOrdered"
+	}
+	return fmt.Sprintf("Mode(%d)", int(m))
+}
 
 const (
 	StreamMaxUserDefined StreamId = 1<<15 + iota
@@ -93,29 +115,62 @@ const (
 	// have received by now.
 	StreamPosition
 
-	// Ping/Pong chunks are initiated by the host (Ping) and responded to by the client (Pong).
+	// Ping/Pong chunks are initiated by the host (Ping) and responded to by the client (Pong).  Clients
+	// also ping the host and the clients they have a direct route to, so that they can report their
+	// own round trip times in Stats chunks.  A Pong has the same SequenceId as the Ping it responds
+	// to.
 	StreamPing
 	StreamPong
 
 	// Ding/Dang/Dong chunks are a way for the host to gague how fast two client might be able to
 	// talk to each other.  The host sends a Ding to client A with the address of client B, client A
-	// sends a Dang to client B, who then sends a Dong back to the host.
+	// sends a Dang to client B, who then sends a Dong back to the host.  All three chunks have the
+	// same SequenceId so the host can tell which Ding a Dong is for.  The host also sends client B a
+	// Dang with the address of client A, and B only answers a Dang that it was told to expect.
 	StreamDing
 	StreamDang
 	StreamDong
 
 	// Punch chunks are sent from the host to a client to indicate that it should start or stop
-	// sending data directly to another client.
+	// sending data directly to another client.  A client also sends a Punch chunk directly to the
+	// other client when it starts, so that any NATs between them will let the other client's chunks
+	// through.
 	StreamPunch
 
-	// Stats chunks are sent from client to the host to let it know what sort of delays it sees
-	// on a ping/pong with whatever clients it is connected with.
+	// Stats chunks are sent from client to the host to let it know what round trip time, jitter, and
+	// loss it sees to every node it hears from.
 	StreamStats
 
 	// Join and Leave chunks are sent from the host to each client every time another client joins
-	// or leaves the sluice.
+	// or leaves the sluice.  A client also sends a Join chunk to the host to ask to join, which is
+	// padded so that it is never smaller than the Cookie chunk the host answers with, and a Leave
+	// chunk when it is leaving.  A client that already joined can send a Join chunk with its
+	// session token to resume its session from a new address.  When the host shuts down it sends
+	// each client a Leave chunk about itself.
 	StreamJoin
 	StreamLeave
+
+	// Welcome chunks are sent from the host to a client in response to its Join chunk.  They tell
+	// the client its NodeId, its session token, and where it should start on each reliable
+	// streamlet.
+	StreamWelcome
+
+	// Cookie chunks are sent from the host in response to a Join chunk that doesn't have a valid
+	// cookie.  The client must ask to join again with the cookie before the host will welcome it.
+	StreamCookie
+
+	// Handshake chunks are sent from the host to a client that asked to join with an ephemeral key,
+	// so that it can derive the keys for its session.  They are sent outside of any connection,
+	// before any of the Welcome chunks, which are sealed with those keys.
+	StreamHandshake
+
+	// Refuse chunks are sent from the host in response to a Join chunk with a valid cookie from a
+	// client that it won't let join, and say why.
+	StreamRefuse
+
+	// GlobalConfig chunks are sent from the host to a client with its Welcome chunks.  They tell the
+	// client the streams and tuning values that the host uses, so that the client can use the same.
+	StreamGlobalConfig
 )
 
 // StreamConfig contains all the config data for a user-defined stream.
@@ -130,6 +185,12 @@ func (stream StreamId) IsReserved() bool {
 	return stream > StreamMaxUserDefined
 }
 
+// IsAnnouncement returns true for the reserved streams that the host uses to tell a client about
+// other clients.  Chunks on these streams are delivered reliably and in order.
+func (stream StreamId) IsAnnouncement() bool {
+	return stream == StreamJoin || stream == StreamLeave || stream == StreamPunch
+}
+
 // Config contains information for how to run the sluice network.
 type Config struct {
 	GlobalConfig
@@ -141,10 +202,51 @@ type Config struct {
 	// receive on that streamlet.
 	Starts map[Streamlet]SequenceId
 
+	// Identity is the host's static X25519 key.  If the host has one, every client that joins does a
+	// key exchange with it, and everything between them is sealed with keys that belong to that
+	// client's session alone.  Clients ignore it.
+	Identity *ecdh.PrivateKey
+
+	// HostKey is the public key of the Identity a client expects the host to have.  If a client has
+	// one it won't join a host with any other Identity, or without one.  The host ignores it.
+	HostKey []byte
+
+	// JoinData is sent to the host with a client's request to join, for the host's Authenticate to
+	// check.  It can be at most MaxJoinDataSize bytes long.  The host ignores it.
+	JoinData []byte
+
+	// AppVersion is the version of the application, such as a build number, which a client sends to
+	// the host with its request to join for the host's CheckAppVersion to check.  It can be at most
+	// MaxAppVersionSize bytes long.  The host ignores it.
+	AppVersion string
+
+	// CheckAppVersion is called by the host with the AppVersion of every client that asks to join.
+	// If it returns an error the client isn't let in, and is told the error as the reason, which
+	// should tell it to update.  It is called before the host checks the client's streams, its
+	// limits, or Authenticate, so that an outdated client is told to update rather than anything
+	// that follows from it being outdated.  It is called from the host's main routine, so it
+	// shouldn't take long.  If it is nil every version is let in.  Clients ignore it.
+	CheckAppVersion func(version string) error
+
+	// Authenticate is called by the host with the address and JoinData of every client that asks to
+	// join, before the client is given a NodeId.  If it returns an error the client isn't let in, and
+	// is told the error as the reason.  Otherwise it returns the client's identity, such as the
+	// player in its ticket, which the host can ban.  It is called from the host's main routine, so it
+	// shouldn't take long.  If it is nil every client is let in.  Clients ignore it.
+	Authenticate func(addr network.Addr, data []byte) (identity string, err error)
+
+	// MaxClients is the most clients the host will have at once, and MaxClientsPerIP is the most it
+	// will have at once from any one IP address.  Clients that ask to join past either limit are
+	// refused.  If either is zero that limit isn't checked, though the host can never have more
+	// clients than there are NodeIds.  Clients ignore them.
+	MaxClients      int
+	MaxClientsPerIP int
+
 	Logger Printer
 }
 
-// GlobalConfig contains the configuration for a sluice network that is constant for all nodes.
+// GlobalConfig contains the configuration for a sluice network that is constant for all nodes.  The
+// host sends everything in it but the Clock and the Key to each client when it joins.
 type GlobalConfig struct {
 	Streams map[StreamId]StreamConfig
 
@@ -162,6 +264,35 @@ type GlobalConfig struct {
 	MaxUnreliableAge SequenceId
 
 	Confirmation time.Duration
+
+	// Ping is how often the host pings each client to measure its round trip time, and how often
+	// each client pings the host and the clients it has direct routes to.  If Ping is zero nobody
+	// pings.
+	Ping time.Duration
+
+	// Stats is how often each client sends the host a Stats chunk.  If Stats is zero clients never
+	// send them.
+	Stats time.Duration
+
+	// Keepalive is how long the host or a client can go without sending anything to the other before
+	// it sends a Ping, so that the other knows it is still there.  If Keepalive is zero nobody sends
+	// pings just to keep the connection alive.
+	Keepalive time.Duration
+
+	// Timeout is how long the host waits without hearing anything from a client before it decides
+	// the client is gone and removes it, and how long a client waits without hearing from the host
+	// before it gives up on the host.  If Timeout is zero nobody ever times out.
+	Timeout time.Duration
+
+	// Ding is how often the host sends a Ding to measure the latency between a pair of clients.  Each
+	// Ding measures a different pair, so every pair is measured once every Ding*n*(n-1) for n
+	// clients.  If Ding is zero the host never sends Dings.
+	Ding time.Duration
+
+	// Key is a key shared by the host and every client.  If it is set every datagram is encrypted
+	// and authenticated with AES-GCM using it, instead of only being protected by a CRC, so it must
+	// be 16, 24, or 32 bytes long.
+	Key []byte
 }
 
 type Printer interface {
@@ -175,6 +306,8 @@ func (c *Config) Printf(format string, v ...interface{}) {
 	c.Logger.Printf(format, v...)
 }
 
+// Validate returns an error if c can't be used by a host, or by a client once it has the host's
+// GlobalConfig.
 func (c *Config) Validate() error {
 	if c == nil || c.Streams == nil {
 		return fmt.Errorf("Config and Config.Stream must both not be nil")
@@ -182,13 +315,31 @@ func (c *Config) Validate() error {
 	if c.MaxChunkDataSize < 25 || c.MaxChunkDataSize > 30000 {
 		return fmt.Errorf("Config.MaxChunkDataSize must be in the range (25, 30000)")
 	}
-	for streamId := range c.Streams {
+	for streamId, stream := range c.Streams {
+		if stream.Id != streamId {
+			return fmt.Errorf("Config.Streams[%d] has mismatched id %d", streamId, stream.Id)
+		}
 		if streamId == 0 {
 			return fmt.Errorf("Config cannot contain streams with id == 0")
 		}
 		if streamId >= StreamMaxUserDefined {
 			return fmt.Errorf("Config cannot contain streams with id >= %d", StreamMaxUserDefined)
 		}
+		if stream.Mode < 0 || stream.Mode >= ModeMax {
+			return fmt.Errorf("Config.Streams[%d] has unknown mode %d", streamId, stream.Mode)
+		}
+	}
+	if err := c.ValidateJoin(); err != nil {
+		return err
+	}
+	if c.Identity != nil && c.Identity.Curve() != ecdh.X25519() {
+		return fmt.Errorf("Config.Identity must be an X25519 key")
+	}
+	if c.MaxClients < 0 || c.MaxClientsPerIP < 0 {
+		return fmt.Errorf("Config.MaxClients and Config.MaxClientsPerIP must not be negative")
+	}
+	if c.Timeout > 0 && c.Keepalive >= c.Timeout {
+		return fmt.Errorf("Config.Keepalive must be shorter than Config.Timeout")
 	}
 	names := make(map[string]struct{})
 	for _, stream := range c.Streams {
@@ -200,6 +351,27 @@ func (c *Config) Validate() error {
 	return nil
 }
 
+// ValidateJoin returns an error if a client can't use c to join a host.  It only checks what a
+// client needs before the host sends it the rest of the GlobalConfig.
+func (c *Config) ValidateJoin() error {
+	if c == nil {
+		return fmt.Errorf("Config must not be nil")
+	}
+	if n := len(c.Key); n != 0 && n != 16 && n != 24 && n != 32 {
+		return fmt.Errorf("Config.Key must be 16, 24, or 32 bytes long")
+	}
+	if len(c.JoinData) > MaxJoinDataSize {
+		return fmt.Errorf("Config.JoinData can be at most %d bytes long", MaxJoinDataSize)
+	}
+	if len(c.AppVersion) > MaxAppVersionSize {
+		return fmt.Errorf("Config.AppVersion can be at most %d bytes long", MaxAppVersionSize)
+	}
+	if n := len(c.HostKey); n != 0 && n != PublicKeySize {
+		return fmt.Errorf("Config.HostKey must be %d bytes long", PublicKeySize)
+	}
+	return nil
+}
+
 // GetIdFromName returns the StreamId of the stream with the specified name, or 0 if no such stream
 // is in the config.
 func (c *Config) GetIdFromName(name string) StreamId {
@@ -222,6 +394,15 @@ func (c *Config) GetStreamConfigByName(name string) *StreamConfig {
 	return nil
 }
 
+// GetStart returns the first SequenceId this node should expect to receive on sl.  Streamlets that
+// aren't in Starts start at FirstSequenceId.
+func (c *Config) GetStart(sl Streamlet) SequenceId {
+	if start, ok := c.Starts[sl]; ok {
+		return start
+	}
+	return FirstSequenceId
+}
+
 // GetStreamConfigById returns the StreamConfig for the specified id, or 0 if no such stream is in
 // the config.
 func (c *Config) GetStreamConfigById(id StreamId) *StreamConfig {
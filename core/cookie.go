@@ -0,0 +1,67 @@
+package core
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"time"
+
+	"github.com/runningwild/clock"
+)
+
+// cookieLifetime is how long a cookie is good for after the host makes it.
+const cookieLifetime = 10 * time.Second
+
+// cookieMACSize is the number of bytes of the MAC that are kept in a cookie.
+const cookieMACSize = 16
+
+// CookieSize is the number of bytes in a cookie.
+const CookieSize = 4 + cookieMACSize
+
+// CookieJar makes and checks the cookies the host sends in response to requests to join.  A client
+// has to send its cookie back before the host does anything else for it, which shows that the
+// client can receive datagrams at the address it claims to be at.  Cookies are a MAC of the
+// client's address and the time they were made, so the host doesn't have to remember anything about
+// the clients it has sent them to.
+type CookieJar struct {
+	clock  clock.Clock
+	secret [32]byte
+}
+
+// MakeCookieJar returns a CookieJar with a new random secret, so cookies made by any other
+// CookieJar won't be accepted by it.
+func MakeCookieJar(c clock.Clock) (*CookieJar, error) {
+	jar := &CookieJar{clock: c}
+	if _, err := rand.Read(jar.secret[:]); err != nil {
+		return nil, err
+	}
+	return jar, nil
+}
+
+// Make returns a cookie for addr.  Cookies only keep the time they were made to the second, which is
+// plenty for telling when they've expired.
+func (jar *CookieJar) Make(addr string) []byte {
+	return jar.make(addr, uint32(jar.clock.Now().Unix()))
+}
+
+// Check returns true if cookie was made by this CookieJar for addr within the last cookieLifetime.
+func (jar *CookieJar) Check(addr string, cookie []byte) bool {
+	if len(cookie) != CookieSize {
+		return false
+	}
+	var made uint32
+	ConsumeUint32(cookie, &made)
+	age := uint32(jar.clock.Now().Unix()) - made
+	if time.Duration(age)*time.Second > cookieLifetime {
+		return false
+	}
+	return hmac.Equal(cookie, jar.make(addr, made))
+}
+
+func (jar *CookieJar) make(addr string, made uint32) []byte {
+	cookie := AppendUint32(nil, made)
+	mac := hmac.New(sha256.New, jar.secret[:])
+	mac.Write(cookie)
+	mac.Write([]byte(addr))
+	return append(cookie, mac.Sum(nil)[0:cookieMACSize]...)
+}
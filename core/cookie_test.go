@@ -0,0 +1,48 @@
+package core_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/runningwild/clock"
+	"github.com/runningwild/sluice/core"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestCookieJar(t *testing.T) {
+	Convey("CookieJar", t, func() {
+		fc := &clock.FakeClock{}
+		jar, err := core.MakeCookieJar(fc)
+		So(err, ShouldBeNil)
+		cookie := jar.Make("127.0.0.1:1234")
+		So(len(cookie), ShouldEqual, core.CookieSize)
+
+		Convey("Accepts its own cookies for the address they were made for.", func() {
+			So(jar.Check("127.0.0.1:1234", cookie), ShouldBeTrue)
+			So(jar.Check("127.0.0.1:1235", cookie), ShouldBeFalse)
+		})
+
+		Convey("Rejects cookies that have been tampered with.", func() {
+			for i := range cookie {
+				cookie[i]++
+				So(jar.Check("127.0.0.1:1234", cookie), ShouldBeFalse)
+				cookie[i]--
+			}
+			So(jar.Check("127.0.0.1:1234", cookie[1:]), ShouldBeFalse)
+			So(jar.Check("127.0.0.1:1234", nil), ShouldBeFalse)
+		})
+
+		Convey("Rejects cookies from other jars.", func() {
+			other, err := core.MakeCookieJar(fc)
+			So(err, ShouldBeNil)
+			So(other.Check("127.0.0.1:1234", cookie), ShouldBeFalse)
+		})
+
+		Convey("Rejects cookies once they expire.", func() {
+			fc.Inc(5 * time.Second)
+			So(jar.Check("127.0.0.1:1234", cookie), ShouldBeTrue)
+			fc.Inc(10 * time.Second)
+			So(jar.Check("127.0.0.1:1234", cookie), ShouldBeFalse)
+		})
+	})
+}
@@ -1,28 +1,38 @@
 package core
 
 import (
-	"fmt"
 	"github.com/runningwild/clock"
 	"github.com/runningwild/network"
 	"log"
 
-	"hash/crc32"
 	"io"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
-var crcTable *crc32.Table
+// ConnectionId identifies a client's connection to the host.  The host picks one for each client
+// when it joins, and it is carried in every datagram between them.
+type ConnectionId uint32
 
-func init() {
-	crcTable = crc32.MakeTable(crc32.Castagnoli)
-}
+// NoConnection is the ConnectionId of datagrams that aren't part of a connection, such as requests
+// to join and datagrams sent directly between clients.
+const NoConnection ConnectionId = 0
 
 type Chunk struct {
-	// SourceAddr is set, for incoming dispatches, to the addr of the host that sent it to us.  This
-	// is primary for the host, so it can verify that a particular value of SourceAddr always has
-	// the same value for Source.
+	// SourceAddr is set, for incoming dispatches, to the addr of the host that sent it to us.
 	SourceAddr network.Addr
 
+	// Connection is set, for incoming dispatches, to the ConnectionId of the datagram the chunk
+	// arrived in.  The host uses this rather than SourceAddr to tell which client a chunk came from,
+	// since addresses can change, and can be shared by clients behind the same NAT.
+	Connection ConnectionId
+
+	// Version is set, for incoming dispatches, to the ProtocolVersion of the datagram the chunk
+	// arrived in.  Anything sent in reply to a chunk from someone without a connection yet should be
+	// framed with it, since it is the only version we know they speak.
+	Version ProtocolVersion
+
 	// TODO: If we make the configs available when serializing/parsing we could remove the bytes
 	// needed for the Target field if it is a broadcast stream.
 	Target NodeId
@@ -72,17 +82,43 @@ func ConsumeChunk(buf []byte, payload *Chunk) ([]byte, error) {
 	return ConsumeBytesWithLength(buf, &payload.Data)
 }
 
+// unkeyed is used by the functions that send and receive datagrams without a Framer.
+var unkeyed = &Framer{}
+
 // ParseChunks parses buf, which should be data serialized by BatchAndSend, and returns the
-// resulting chunks.
+// resulting chunks.  Each chunk's Connection is set to the ConnectionId of the datagram.
 func ParseChunks(buf []byte) ([]Chunk, error) {
-	var crc uint32
-	buf = ConsumeUint32(buf, &crc)
-	if crc != crc32.Checksum(buf, crcTable) {
-		return nil, fmt.Errorf("CRC mismatch")
+	return unkeyed.ParseChunks(buf)
+}
+
+// WriteChunks serializes chunks into a single datagram on connection and writes it to conn.  It is
+// for the few chunks that have to be sent outside of BatchAndSend, such as when joining or leaving.
+func WriteChunks(chunks []Chunk, connection ConnectionId, conn io.Writer) {
+	unkeyed.WriteChunks(chunks, connection, conn)
+}
+
+// BatchAndSend reads from chunks and serialiezes them and sends them along conn in datagrams on
+// connection.  It will batch together multiple chunks into a single send, and it chooses a cutoff
+// based on cutoffBytes and cutoffMs.  If either cutoffBytes or cutoffMs is less than or equal to
+// zero, BatchAndSend will send each chunk individually.
+func BatchAndSend(chunks <-chan Chunk, connection ConnectionId, conn io.Writer, c clock.Clock, cutoffBytes int, cutoffMs int) {
+	unkeyed.BatchAndSend(chunks, connection, conn, c, cutoffBytes, cutoffMs)
+}
+
+// ParseChunks is like the function ParseChunks, but for datagrams framed by f.  Keyed datagrams that
+// have already been received are rejected with ErrReplayed, and counted, before any of their chunks
+// are returned.
+func (f *Framer) ParseChunks(buf []byte) ([]Chunk, error) {
+	connection, version, buf, err := f.open(buf)
+	if err == ErrReplayed {
+		atomic.AddUint64(&f.replayed, 1)
+	}
+	if err != nil {
+		return nil, err
 	}
 	var chunks []Chunk
 	for len(buf) > 0 {
-		var chunk Chunk
+		chunk := Chunk{Connection: connection, Version: version}
 		var err error
 		buf, err = ConsumeChunk(buf, &chunk)
 		if err != nil {
@@ -93,41 +129,57 @@ func ParseChunks(buf []byte) ([]Chunk, error) {
 	return chunks, nil
 }
 
-// sendSerializedData sets the leading CRC on buf and writes the data to conn.  Any errors on the
-// write will be logged but otherwise ignored.
-func sendSerializedData(buf []byte, conn io.Writer) {
-	// Prefix buf with a crc of everything we've appended to it.
-	AppendUint32(buf[0:0], crc32.Checksum(buf[4:], crcTable))
-	_, err := conn.Write(buf)
+// sendSerializedData frames buf and writes the datagram to conn.  Any errors on the write will be
+// logged but otherwise ignored.
+func (f *Framer) sendSerializedData(buf []byte, conn io.Writer) {
+	_, err := conn.Write(f.seal(buf))
 	if err != nil {
 		log.Printf("Failed to write %d bytes in BatchAndSend: %v", err)
 	}
 }
 
-// BatchAndSend reads from chunks and serialiezes them and sends them along conn.  It will batch
-// together multiple chunks into a single send, and it chooses a cutoff based on cutoffBytes and
-// cutoffMs.  If either cutoffBytes or cutoffMs is less than or equal to zero, BatchAndSend will
-// send each chunk individually.
-func BatchAndSend(chunks <-chan Chunk, conn io.Writer, c clock.Clock, cutoffBytes int, cutoffMs int) {
+// WriteChunks is like the function WriteChunks, but frames the datagram with f, or with the
+// session Framer for connection if f has one.
+func (f *Framer) WriteChunks(chunks []Chunk, connection ConnectionId, conn io.Writer) {
+	f.WriteChunksIn(f.versionFor(connection), chunks, connection, conn)
+}
+
+// WriteChunksIn is like WriteChunks, but frames the datagram with version rather than the
+// ProtocolVersion set for connection.
+func (f *Framer) WriteChunksIn(version ProtocolVersion, chunks []Chunk, connection ConnectionId, conn io.Writer) {
+	f = f.framerFor(connection)
+	buf := f.appendHeader(nil, version, connection)
+	for i := range chunks {
+		buf = AppendChunk(buf, &chunks[i])
+	}
+	f.sendSerializedData(buf, conn)
+}
+
+// BatchAndSend is like the function BatchAndSend, but frames the datagrams with f, or with the
+// session Framer for connection if f has one.
+func (f *Framer) BatchAndSend(chunks <-chan Chunk, connection ConnectionId, conn io.Writer, c clock.Clock, cutoffBytes int, cutoffMs int) {
+	version := f.versionFor(connection)
+	f = f.framerFor(connection)
 	if cutoffMs < 0 {
 		cutoffMs = 0
 	}
 	var timeout <-chan time.Time
-	buf := AppendUint32(nil, 0) // Make room for a CRC.
+	buf := f.appendHeader(nil, version, connection)
+	headerSize := len(buf)
 	numChunks := 0
 	for {
 		select {
 		case chunk, ok := <-chunks:
 			if !ok {
 				// Send any queued up chunks before quitting.
-				sendSerializedData(buf, conn)
+				f.sendSerializedData(buf, conn)
 				return
 			}
 			chunkLength := chunk.SerializedLength()
 			if len(buf)+chunkLength >= cutoffBytes && numChunks > 0 {
-				sendSerializedData(buf, conn)
+				f.sendSerializedData(buf, conn)
 				numChunks = 0
-				buf = buf[0:4] // Leave 4 bytes at the front for the CRC
+				buf = buf[0:headerSize] // Keep the header at the front
 				timeout = nil
 			}
 			buf = AppendChunk(buf, &chunk)
@@ -137,9 +189,9 @@ func BatchAndSend(chunks <-chan Chunk, conn io.Writer, c clock.Clock, cutoffByte
 			}
 
 		case <-timeout:
-			sendSerializedData(buf, conn)
+			f.sendSerializedData(buf, conn)
 			numChunks = 0
-			buf = buf[0:4] // Leave 4 bytes at the front for the CRC
+			buf = buf[0:headerSize] // Keep the header at the front
 			timeout = nil
 
 		}
@@ -150,8 +202,20 @@ type ReadFromer interface {
 	ReadFrom(buf []byte) (n int, addr network.Addr, err error)
 }
 
+// ReceiveAndSplit reads datagrams from conn and sends every chunk in them on chunks, with SourceAddr
+// set to where the datagram came from.  chunks is closed once conn is.
 func ReceiveAndSplit(conn ReadFromer, chunks chan<- Chunk, maxChunkSize int) {
-	defer close(chunks)
+	unkeyed.ReceiveAndSplit(conn, chunks, maxChunkSize)
+}
+
+// ReceiveAndSplit is like the function ReceiveAndSplit, but for datagrams framed by f.
+func (f *Framer) ReceiveAndSplit(conn ReadFromer, chunks chan<- Chunk, maxChunkSize int) {
+	// chunks can't be closed until everything we've received has been sent on it.
+	var sending sync.WaitGroup
+	defer func() {
+		sending.Wait()
+		close(chunks)
+	}()
 	buf := make([]byte, maxChunkSize)
 	for {
 		n, addr, err := conn.ReadFrom(buf)
@@ -159,12 +223,14 @@ func ReceiveAndSplit(conn ReadFromer, chunks chan<- Chunk, maxChunkSize int) {
 			log.Printf("ReceiveAndSplit connection was closed.")
 			return
 		}
-		parsedChunks, err := ParseChunks(buf[0:n])
+		parsedChunks, err := f.ParseChunks(buf[0:n])
 		if err != nil {
 			log.Printf("Error parsing chunks: %v", err)
 			continue
 		}
+		sending.Add(1)
 		go func() {
+			defer sending.Done()
 			for _, chunk := range parsedChunks {
 				chunk.SourceAddr = addr
 				chunks <- chunk
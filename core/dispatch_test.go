@@ -162,7 +162,7 @@ func TestSerializeAndParseChunks(t *testing.T) {
 		conn := makeFakeBlockingConn(0)
 		defer conn.Close()
 		c := &clock.FakeClock{}
-		go core.BatchAndSend(chunksChan, conn, c, 10000000, 1000)
+		go core.BatchAndSend(chunksChan, 0xdeadbeef, conn, c, 10000000, 1000)
 
 		for _, chunk := range chunks {
 			chunksChan <- chunk
@@ -187,6 +187,7 @@ func TestSerializeAndParseChunks(t *testing.T) {
 				So(parsed[i].Stream, ShouldEqual, chunks[i].Stream)
 				So(parsed[i].Sequence, ShouldEqual, chunks[i].Sequence)
 				So(string(parsed[i].Data), ShouldEqual, string(chunks[i].Data))
+				So(parsed[i].Connection, ShouldEqual, core.ConnectionId(0xdeadbeef))
 			}
 		})
 
@@ -199,6 +200,30 @@ func TestSerializeAndParseChunks(t *testing.T) {
 				serializedData[i]--
 			}
 		})
+
+		Convey("Then if only part of that data arrives it should fail to parse.", func() {
+			for i := 0; i < len(serializedData); i++ {
+				parsed, err := core.ParseChunks(serializedData[0:i])
+				So(parsed, ShouldBeNil)
+				So(err, ShouldNotBeNil)
+			}
+		})
+	})
+
+	Convey("Chunks written with WriteChunks are sent in a single datagram that parses correctly.", t, func() {
+		conn := makeFakeBlockingConn(0)
+		defer conn.Close()
+		core.WriteChunks(chunks, core.NoConnection, conn)
+		serializedData := make([]byte, 100000)
+		n, err := conn.Read(serializedData)
+		So(err, ShouldBeNil)
+		parsed, err := core.ParseChunks(serializedData[0:n])
+		So(err, ShouldBeNil)
+		So(len(parsed), ShouldEqual, len(chunks))
+		for i := range chunks {
+			So(areChunksEqual(&parsed[i], &chunks[i]), ShouldBeTrue)
+			So(parsed[i].Connection, ShouldEqual, core.NoConnection)
+		}
 	})
 
 	Convey("Sending chunks through BatchAndSend and piping that to ReceiveAndSplit should result in the original chunks.", t, func() {
@@ -207,7 +232,7 @@ func TestSerializeAndParseChunks(t *testing.T) {
 		conn := makeFakeBlockingConn(0)
 		defer conn.Close()
 		c := &clock.FakeClock{}
-		go core.BatchAndSend(chunksIn, conn, c, -1, -1)
+		go core.BatchAndSend(chunksIn, 3, conn, c, -1, -1)
 		go core.ReceiveAndSplit(conn, chunksOut, 100000)
 		go func() {
 			for _, chunk := range chunks {
@@ -0,0 +1,73 @@
+package core
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"sort"
+)
+
+// FingerprintSize is the number of bytes in a GlobalConfig's Fingerprint.
+const FingerprintSize = sha256.Size
+
+// Fingerprint returns a hash of the parts of g that the host and its clients can't work together
+// without agreeing on: every stream's id, name, mode, and whether it broadcasts, and the
+// MaxChunkDataSize.  It doesn't depend on the order of the Streams map.
+func (g *GlobalConfig) Fingerprint() []byte {
+	data := []byte("sluice config")
+	data = AppendUint32(data, uint32(g.MaxChunkDataSize))
+	for _, id := range sortedStreamIds(g.Streams) {
+		stream := g.Streams[id]
+		data = AppendStreamId(data, id)
+		data = AppendUint8(data, uint8(stream.Mode))
+		data = AppendBool(data, stream.Broadcast)
+		data = AppendStringWithLength(data, stream.Name)
+	}
+	sum := sha256.Sum256(data)
+	return sum[:]
+}
+
+// Differences describes every way that the parts of g that go into its Fingerprint differ from
+// those of the host's GlobalConfig.  It is empty if they have the same Fingerprint.
+func (g *GlobalConfig) Differences(host *GlobalConfig) []string {
+	var diffs []string
+	if g.MaxChunkDataSize != host.MaxChunkDataSize {
+		diffs = append(diffs, fmt.Sprintf("MaxChunkDataSize is %d, the host's is %d", g.MaxChunkDataSize, host.MaxChunkDataSize))
+	}
+	all := make(map[StreamId]StreamConfig)
+	for id, stream := range host.Streams {
+		all[id] = stream
+	}
+	for id, stream := range g.Streams {
+		all[id] = stream
+	}
+	for _, id := range sortedStreamIds(all) {
+		ours, inOurs := g.Streams[id]
+		theirs, inTheirs := host.Streams[id]
+		switch {
+		case !inTheirs:
+			diffs = append(diffs, fmt.Sprintf("stream %d (%q) isn't on the host", id, ours.Name))
+		case !inOurs:
+			diffs = append(diffs, fmt.Sprintf("stream %d (%q) is only on the host", id, theirs.Name))
+		default:
+			if ours.Name != theirs.Name {
+				diffs = append(diffs, fmt.Sprintf("stream %d is named %q, the host's is named %q", id, ours.Name, theirs.Name))
+			}
+			if ours.Mode != theirs.Mode {
+				diffs = append(diffs, fmt.Sprintf("stream %d (%q) is %v, the host's is %v", id, ours.Name, ours.Mode, theirs.Mode))
+			}
+			if ours.Broadcast != theirs.Broadcast {
+				diffs = append(diffs, fmt.Sprintf("stream %d (%q) has Broadcast %t, the host's has %t", id, ours.Name, ours.Broadcast, theirs.Broadcast))
+			}
+		}
+	}
+	return diffs
+}
+
+func sortedStreamIds(streams map[StreamId]StreamConfig) []StreamId {
+	var ids []StreamId
+	for id := range streams {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
@@ -0,0 +1,74 @@
+package core_test
+
+import (
+	"testing"
+
+	"github.com/runningwild/sluice/core"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func makeFingerprintConfig() *core.GlobalConfig {
+	return &core.GlobalConfig{
+		Streams: map[core.StreamId]core.StreamConfig{
+			1: core.StreamConfig{Name: "Positions", Id: 1, Mode: core.ModeUnreliableOrdered, Broadcast: true},
+			2: core.StreamConfig{Name: "Actions", Id: 2, Mode: core.ModeReliableOrdered},
+			3: core.StreamConfig{Name: "Chat", Id: 3, Mode: core.ModeReliableUnordered, Broadcast: true},
+		},
+		MaxChunkDataSize: 1000,
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	Convey("Fingerprint", t, func() {
+		g := makeFingerprintConfig()
+
+		Convey("is the same for the same streams and chunk size.", func() {
+			So(len(g.Fingerprint()), ShouldEqual, core.FingerprintSize)
+			So(g.Fingerprint(), ShouldResemble, makeFingerprintConfig().Fingerprint())
+			So(g.Differences(makeFingerprintConfig()), ShouldBeEmpty)
+		})
+
+		Convey("ignores everything else.", func() {
+			other := makeFingerprintConfig()
+			other.Timeout = 12345
+			other.Key = []byte("0123456789abcdef")
+			So(other.Fingerprint(), ShouldResemble, g.Fingerprint())
+		})
+
+		Convey("changes with the chunk size.", func() {
+			other := makeFingerprintConfig()
+			other.MaxChunkDataSize = 500
+			So(other.Fingerprint(), ShouldNotResemble, g.Fingerprint())
+			So(other.Differences(g), ShouldResemble, []string{"MaxChunkDataSize is 500, the host's is 1000"})
+		})
+
+		Convey("changes with every part of every stream.", func() {
+			for _, change := range []func(*core.StreamConfig){
+				func(s *core.StreamConfig) { s.Name = "Moves" },
+				func(s *core.StreamConfig) { s.Mode = core.ModeUnreliableUnordered },
+				func(s *core.StreamConfig) { s.Broadcast = true },
+			} {
+				other := makeFingerprintConfig()
+				stream := other.Streams[2]
+				change(&stream)
+				other.Streams[2] = stream
+				So(other.Fingerprint(), ShouldNotResemble, g.Fingerprint())
+				So(len(other.Differences(g)), ShouldEqual, 1)
+			}
+		})
+
+		Convey("lists each stream that differs.", func() {
+			other := makeFingerprintConfig()
+			delete(other.Streams, 1)
+			other.Streams[4] = core.StreamConfig{Name: "Voice", Id: 4, Mode: core.ModeUnreliableUnordered}
+			stream := other.Streams[2]
+			stream.Mode = core.ModeUnreliableOrdered
+			other.Streams[2] = stream
+			So(other.Differences(g), ShouldResemble, []string{
+				`stream 1 ("Positions") is only on the host`,
+				`stream 2 ("Actions") is ModeUnreliableOrdered, the host's is ModeReliableOrdered`,
+				`stream 4 ("Voice") isn't on the host`,
+			})
+		})
+	})
+}
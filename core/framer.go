@@ -0,0 +1,391 @@
+package core
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"sync"
+	"sync/atomic"
+)
+
+var crcTable *crc32.Table
+
+func init() {
+	crcTable = crc32.MakeTable(crc32.Castagnoli)
+}
+
+// unkeyedHeaderSize is the number of bytes at the front of a datagram framed without a key, the
+// preamble and a ConnectionId followed by a CRC.
+const unkeyedHeaderSize = preambleSize + 8
+
+// keyedHeaderSize is the number of bytes at the front of a datagram framed with a key, the preamble
+// and a ConnectionId followed by the salt of the Framer that sealed it and the datagram's counter,
+// which together with the ConnectionId is the nonce.
+const keyedHeaderSize = preambleSize + 4 + saltSize + 8
+
+// saltSize is the number of bytes in a Framer's salt.  It is big enough that no two Framers will
+// ever pick the same one.
+const saltSize = 12
+
+// MaxNoConnectionPeers is how many senders of keyed datagrams without a connection a Framer keeps
+// track of.  Once there are more than this the one we heard from least recently is forgotten, and
+// anything it sent could be replayed, which is harmless since all it can have sent is a request to
+// join.
+const MaxNoConnectionPeers = 1024
+
+// replayWindowSize is how far behind the newest datagram from a sender an older one can arrive and
+// still be accepted.
+const replayWindowSize = 64
+
+// ErrReplayed is returned for a datagram that was already received, or that is too old to tell.
+var ErrReplayed = errors.New("datagram was replayed")
+
+// Framer turns chunks into datagrams and datagrams back into chunks.  Without a key every datagram
+// has a CRC, which catches corruption but nothing else.  With a key every datagram is encrypted and
+// authenticated with AES-GCM, so it can't be read or forged by anyone without the key, and a
+// datagram that has already been received once is rejected.  Every Framer seals with its own key,
+// derived from the key it was given and a random salt, so Framers that share a key never share a
+// nonce.  Each connection counts the datagrams sealed on it separately, so that how much is sent on
+// one connection doesn't make datagrams on another look too old to the peer receiving them.  Every
+// datagram starts with a preamble and its ConnectionId, and datagrams on a connection
+// that has its own session Framer are framed by that instead.  Datagrams are framed with the
+// ProtocolVersion set for their connection, and datagrams in any of the SupportedVersions are
+// accepted.
+type Framer struct {
+	// replayed is how many datagrams have been rejected because they were replayed.  It is only
+	// accessed atomically.
+	replayed uint64
+
+	// sealer seals the datagrams we send with the key derived from salt, which is random and goes
+	// in every datagram we send.  openKey is what the key of every peer we receive from is derived
+	// from.  It is the same as the key sealer was derived from unless the Framer is for a session,
+	// which uses a different key in each direction.
+	sealer  cipher.AEAD
+	salt    [saltSize]byte
+	openKey []byte
+
+	// peers holds what we need to open datagrams from each peer, sessions holds the Framers for
+	// connections that have their own keys, and versions holds the ProtocolVersions of connections
+	// that don't use SupportedVersions.Min.  opened counts the datagrams we've opened, and is used to
+	// tell which peer we heard from least recently.
+	mu       sync.Mutex
+	peers    map[peer]*peerState
+	sessions map[ConnectionId]*Framer
+	versions map[ConnectionId]ProtocolVersion
+	opened   uint64
+
+	// counters holds the counter of the last datagram sealed on each connection, and sent is the
+	// highest counter sealed on any of them.  A connection that isn't in counters starts counting
+	// from sent, so a ConnectionId that is used again never seals two datagrams with the same nonce.
+	counters map[ConnectionId]uint64
+	sent     uint64
+}
+
+// peer identifies a sender of keyed datagrams.  Every Framer has its own salt, and a sender that
+// is a client of ours always uses the same connection.
+type peer struct {
+	connection ConnectionId
+	salt       [saltSize]byte
+}
+
+// peerState is what a Framer keeps about a peer, the key it opens the peer's datagrams with, which
+// of them it has received, and when it last heard from the peer.
+type peerState struct {
+	opener cipher.AEAD
+	window replayWindow
+	heard  uint64
+}
+
+// MakeFramer returns a Framer that uses key, which must be empty or a valid AES key.  An empty key
+// means datagrams are only protected by a CRC.
+func MakeFramer(key []byte) (*Framer, error) {
+	if len(key) == 0 {
+		return &Framer{
+			peers:    make(map[peer]*peerState),
+			sessions: make(map[ConnectionId]*Framer),
+			versions: make(map[ConnectionId]ProtocolVersion),
+			counters: make(map[ConnectionId]uint64),
+		}, nil
+	}
+	return makeKeyedFramer(key, key)
+}
+
+// makeKeyedFramer returns a Framer that seals with keys derived from sealKey and opens with keys
+// derived from openKey.
+func makeKeyedFramer(sealKey, openKey []byte) (*Framer, error) {
+	f := &Framer{
+		openKey:  openKey,
+		peers:    make(map[peer]*peerState),
+		sessions: make(map[ConnectionId]*Framer),
+		versions: make(map[ConnectionId]ProtocolVersion),
+		counters: make(map[ConnectionId]uint64),
+	}
+	if _, err := rand.Read(f.salt[:]); err != nil {
+		return nil, err
+	}
+	var err error
+	if f.sealer, err = makeAEAD(sealKey, f.salt); err != nil {
+		return nil, err
+	}
+
+	// Make sure that openKey works too, rather than finding out when something arrives.
+	if _, err := makeAEAD(openKey, f.salt); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// makeAEAD returns the AEAD for the key derived from key and salt, which is the same size as key.
+func makeAEAD(key []byte, salt [saltSize]byte) (cipher.AEAD, error) {
+	derived, err := hkdf.Key(sha256.New, key, salt[:], "sluice datagram key", len(key))
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(derived)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// AddSession makes session frame every datagram on connection, in both directions.
+func (f *Framer) AddSession(connection ConnectionId, session *Framer) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.sessions[connection] = session
+}
+
+// SetVersion makes every datagram on connection be framed with version, rather than
+// SupportedVersions.Min.
+func (f *Framer) SetVersion(connection ConnectionId, version ProtocolVersion) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.versions[connection] = version
+}
+
+// versionFor returns the ProtocolVersion to frame datagrams on connection with.
+func (f *Framer) versionFor(connection ConnectionId) ProtocolVersion {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if version, ok := f.versions[connection]; ok {
+		return version
+	}
+	return SupportedVersions.Min
+}
+
+// RemoveSession goes back to framing datagrams on connection with f, in SupportedVersions.Min, and
+// forgets which datagrams have been received on it.
+func (f *Framer) RemoveSession(connection ConnectionId) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.sessions, connection)
+	delete(f.versions, connection)
+	delete(f.counters, connection)
+	for p := range f.peers {
+		if p.connection == connection {
+			delete(f.peers, p)
+		}
+	}
+}
+
+// Replayed returns the number of datagrams that have been rejected because they were already
+// received, including those on sessions.
+func (f *Framer) Replayed() uint64 {
+	return atomic.LoadUint64(&f.replayed)
+}
+
+// framerFor returns the Framer for datagrams on connection.
+func (f *Framer) framerFor(connection ConnectionId) *Framer {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if session, ok := f.sessions[connection]; ok {
+		return session
+	}
+	return f
+}
+
+// appendHeader appends room for the header of a datagram on connection framed with version to buf.
+func (f *Framer) appendHeader(buf []byte, version ProtocolVersion, connection ConnectionId) []byte {
+	buf = appendPreamble(buf, version)
+	buf = AppendUint32(buf, uint32(connection))
+	if f.sealer == nil {
+		return AppendUint32(buf, 0)
+	}
+	buf = append(buf, f.salt[:]...)
+	return AppendUint64(buf, 0)
+}
+
+// seal finishes the datagram in buf, which starts with a header from appendHeader, and returns it.
+func (f *Framer) seal(buf []byte) []byte {
+	if f.sealer == nil {
+		// Fill in a crc of everything else in buf.
+		AppendUint32(buf[preambleSize+4:preambleSize+4], checksum(buf))
+		return buf
+	}
+	var connection uint32
+	ConsumeUint32(buf[preambleSize:], &connection)
+	AppendUint64(buf[keyedHeaderSize-8:keyedHeaderSize-8], f.count(ConnectionId(connection)))
+	sealed := make([]byte, keyedHeaderSize, len(buf)+f.sealer.Overhead())
+	copy(sealed, buf)
+	return f.sealer.Seal(sealed, nonce(buf), buf[keyedHeaderSize:], buf[0:keyedHeaderSize])
+}
+
+// count returns the counter for the next datagram sealed on connection.
+func (f *Framer) count(connection ConnectionId) uint64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	counter, ok := f.counters[connection]
+	if !ok {
+		counter = f.sent
+	}
+	counter++
+	f.counters[connection] = counter
+	if counter > f.sent {
+		f.sent = counter
+	}
+	return counter
+}
+
+// nonce returns the nonce of the keyed datagram in buf.  Every Framer seals with its own key, so the
+// nonce only needs to be different for each datagram a Framer seals, and is the ConnectionId
+// followed by the counter.
+func nonce(buf []byte) []byte {
+	var n [12]byte
+	copy(n[0:4], buf[preambleSize:preambleSize+4])
+	copy(n[4:], buf[keyedHeaderSize-8:keyedHeaderSize])
+	return n[:]
+}
+
+// checksum returns the CRC of everything in an unkeyed datagram but the CRC itself.
+func checksum(buf []byte) uint32 {
+	return crc32.Update(crc32.Checksum(buf[0:preambleSize+4], crcTable), crcTable, buf[unkeyedHeaderSize:])
+}
+
+// open checks a datagram and returns its ConnectionId, the ProtocolVersion it was framed with, and
+// the serialized chunks in it.  Datagrams framed with a ProtocolVersion that isn't supported are
+// rejected with a *VersionError.
+func (f *Framer) open(buf []byte) (ConnectionId, ProtocolVersion, []byte, error) {
+	if err := CheckPreamble(buf); err != nil {
+		return NoConnection, 0, nil, err
+	}
+	version := ProtocolVersion(buf[2])
+	var connection uint32
+	if len(buf) >= preambleSize+4 {
+		ConsumeUint32(buf[preambleSize:], &connection)
+		if session := f.framerFor(ConnectionId(connection)); session != f {
+			return session.open(buf)
+		}
+	}
+	if f.sealer == nil {
+		if len(buf) < unkeyedHeaderSize {
+			return NoConnection, 0, nil, fmt.Errorf("datagram is only %d bytes", len(buf))
+		}
+		var crc uint32
+		ConsumeUint32(buf[preambleSize+4:], &crc)
+		if crc != checksum(buf) {
+			return NoConnection, 0, nil, fmt.Errorf("CRC mismatch")
+		}
+		return ConnectionId(connection), version, buf[unkeyedHeaderSize:], nil
+	}
+
+	if len(buf) < keyedHeaderSize {
+		return NoConnection, 0, nil, fmt.Errorf("datagram is only %d bytes", len(buf))
+	}
+	p := peer{connection: ConnectionId(connection)}
+	copy(p.salt[:], buf[preambleSize+4:])
+	var counter uint64
+	ConsumeUint64(buf[keyedHeaderSize-8:], &counter)
+	f.mu.Lock()
+	state, ok := f.peers[p]
+	f.mu.Unlock()
+	if !ok {
+		// Nothing is kept about a peer until one of its datagrams is authentic.
+		opener, err := makeAEAD(f.openKey, p.salt)
+		if err != nil {
+			return NoConnection, 0, nil, err
+		}
+		state = &peerState{opener: opener}
+	}
+	opened, err := state.opener.Open(nil, nonce(buf), buf[keyedHeaderSize:], buf[0:keyedHeaderSize])
+	if err != nil {
+		return NoConnection, 0, nil, fmt.Errorf("datagram failed authentication")
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if existing, ok := f.peers[p]; ok {
+		state = existing
+	} else {
+		f.addPeer(p, state)
+	}
+	f.opened++
+	state.heard = f.opened
+	if !state.window.accept(counter) {
+		return NoConnection, 0, nil, ErrReplayed
+	}
+	return ConnectionId(connection), version, opened, nil
+}
+
+// addPeer starts keeping state about p.  If p doesn't have a connection, and that makes for more than
+// MaxNoConnectionPeers of them, the one we heard from least recently is forgotten.  f.mu must be
+// held.
+func (f *Framer) addPeer(p peer, state *peerState) {
+	f.peers[p] = state
+	if p.connection != NoConnection {
+		return
+	}
+	count := 0
+	var oldest peer
+	var oldestHeard uint64
+	for q, s := range f.peers {
+		if q.connection != NoConnection {
+			continue
+		}
+		count++
+		if q != p && (oldestHeard == 0 || s.heard < oldestHeard) {
+			oldest, oldestHeard = q, s.heard
+		}
+	}
+	if count > MaxNoConnectionPeers {
+		delete(f.peers, oldest)
+	}
+}
+
+// replayWindow remembers which of the most recent replayWindowSize datagrams from a single sender
+// have been received.
+type replayWindow struct {
+	// newest is the counter of the newest datagram received.  Bit i of seen is set if the datagram
+	// with counter newest-i has been received.
+	newest uint64
+	seen   uint64
+}
+
+// accept returns true if the datagram with counter hasn't been received before, and remembers that
+// it has now.  Datagrams too old to tell are never accepted.
+func (w *replayWindow) accept(counter uint64) bool {
+	if counter == 0 {
+		// Counters start at 1.
+		return false
+	}
+	if counter > w.newest {
+		shift := counter - w.newest
+		if shift >= replayWindowSize {
+			w.seen = 0
+		} else {
+			w.seen <<= shift
+		}
+		w.seen |= 1
+		w.newest = counter
+		return true
+	}
+	age := w.newest - counter
+	if age >= replayWindowSize || w.seen&(1<<age) != 0 {
+		return false
+	}
+	w.seen |= 1 << age
+	return true
+}
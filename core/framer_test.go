@@ -0,0 +1,273 @@
+package core_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/runningwild/sluice/core"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// datagramRecorder keeps a copy of every datagram written to it.
+type datagramRecorder struct {
+	datagrams [][]byte
+}
+
+func (r *datagramRecorder) Write(data []byte) (int, error) {
+	r.datagrams = append(r.datagrams, append([]byte(nil), data...))
+	return len(data), nil
+}
+
+func TestFramer(t *testing.T) {
+	Convey("Framer", t, func() {
+		key := []byte("0123456789abcdef")
+		sender, err := core.MakeFramer(key)
+		So(err, ShouldBeNil)
+		receiver, err := core.MakeFramer(key)
+		So(err, ShouldBeNil)
+		var recorder datagramRecorder
+		chunk := core.Chunk{Source: 3, Target: 4, Stream: 5, Sequence: 6, Data: []byte("thundercats")}
+		for i := 0; i < 100; i++ {
+			sender.WriteChunks([]core.Chunk{chunk}, 7, &recorder)
+		}
+		datagrams := recorder.datagrams
+
+		Convey("Round trips datagrams sealed with the same key.", func() {
+			chunks, err := receiver.ParseChunks(datagrams[0])
+			So(err, ShouldBeNil)
+			So(len(chunks), ShouldEqual, 1)
+			So(chunks[0].Connection, ShouldEqual, core.ConnectionId(7))
+			So(chunks[0].Source, ShouldEqual, chunk.Source)
+			So(chunks[0].Target, ShouldEqual, chunk.Target)
+			So(chunks[0].Stream, ShouldEqual, chunk.Stream)
+			So(chunks[0].Sequence, ShouldEqual, chunk.Sequence)
+			So(string(chunks[0].Data), ShouldEqual, string(chunk.Data))
+		})
+
+		Convey("Doesn't send the data in the clear.", func() {
+			So(bytes.Contains(datagrams[0], chunk.Data), ShouldBeFalse)
+		})
+
+		Convey("Rejects datagrams that have been tampered with.", func() {
+			datagram := datagrams[0]
+			for i := range datagram {
+				datagram[i]++
+				_, err := receiver.ParseChunks(datagram)
+				So(err, ShouldNotBeNil)
+				datagram[i]--
+			}
+			_, err := receiver.ParseChunks(datagram[1:])
+			So(err, ShouldNotBeNil)
+			_, err = receiver.ParseChunks(datagram[0 : len(datagram)-1])
+			So(err, ShouldNotBeNil)
+			_, err = receiver.ParseChunks(nil)
+			So(err, ShouldNotBeNil)
+
+			// Rejected datagrams don't count as received.
+			_, err = receiver.ParseChunks(datagram)
+			So(err, ShouldBeNil)
+		})
+
+		Convey("Rejects datagrams sealed with a different key.", func() {
+			other, err := core.MakeFramer([]byte("fedcba9876543210"))
+			So(err, ShouldBeNil)
+			_, err = other.ParseChunks(datagrams[0])
+			So(err, ShouldNotBeNil)
+			unkeyed, err := core.MakeFramer(nil)
+			So(err, ShouldBeNil)
+			_, err = unkeyed.ParseChunks(datagrams[0])
+			So(err, ShouldNotBeNil)
+			_, err = core.ParseChunks(datagrams[0])
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("Rejects and counts datagrams that were already received.", func() {
+			_, err := receiver.ParseChunks(datagrams[5])
+			So(err, ShouldBeNil)
+			So(receiver.Replayed(), ShouldEqual, 0)
+			_, err = receiver.ParseChunks(datagrams[5])
+			So(err, ShouldEqual, core.ErrReplayed)
+			So(receiver.Replayed(), ShouldEqual, 1)
+		})
+
+		Convey("Counts replays on its sessions.", func() {
+			framer, err := core.MakeFramer(nil)
+			So(err, ShouldBeNil)
+			framer.AddSession(7, receiver)
+			_, err = framer.ParseChunks(datagrams[5])
+			So(err, ShouldBeNil)
+			_, err = framer.ParseChunks(datagrams[5])
+			So(err, ShouldEqual, core.ErrReplayed)
+			So(framer.Replayed(), ShouldEqual, 1)
+		})
+
+		Convey("Keeps a separate window for each connection.", func() {
+			var otherRecorder datagramRecorder
+			sender.WriteChunks([]core.Chunk{chunk}, 8, &otherRecorder)
+			_, err := receiver.ParseChunks(otherRecorder.datagrams[0])
+			So(err, ShouldBeNil)
+			_, err = receiver.ParseChunks(datagrams[0])
+			So(err, ShouldBeNil)
+
+			// Forgetting a connection forgets what was received on it.
+			receiver.RemoveSession(8)
+			_, err = receiver.ParseChunks(otherRecorder.datagrams[0])
+			So(err, ShouldBeNil)
+			_, err = receiver.ParseChunks(datagrams[0])
+			So(err, ShouldEqual, core.ErrReplayed)
+		})
+
+		Convey("Accepts datagrams that arrive out of order on one of many connections.", func() {
+			// With a counter shared by every connection, the two datagrams on connection 50 would be
+			// too far apart for the second to be accepted after the first.
+			recorders := make(map[core.ConnectionId]*datagramRecorder)
+			for i := 0; i < 2; i++ {
+				for connection := core.ConnectionId(10); connection < 10+2*64; connection++ {
+					if recorders[connection] == nil {
+						recorders[connection] = &datagramRecorder{}
+					}
+					sender.WriteChunks([]core.Chunk{chunk}, connection, recorders[connection])
+				}
+			}
+			swapped := recorders[50].datagrams
+			_, err := receiver.ParseChunks(swapped[1])
+			So(err, ShouldBeNil)
+			_, err = receiver.ParseChunks(swapped[0])
+			So(err, ShouldBeNil)
+			So(receiver.Replayed(), ShouldEqual, 0)
+		})
+
+		Convey("Accepts datagrams that arrive out of order.", func() {
+			for _, i := range []int{10, 3, 7, 4, 9, 8, 5, 6} {
+				_, err := receiver.ParseChunks(datagrams[i])
+				So(err, ShouldBeNil)
+			}
+			for i := 3; i <= 10; i++ {
+				_, err := receiver.ParseChunks(datagrams[i])
+				So(err, ShouldNotBeNil)
+			}
+		})
+
+		Convey("Rejects datagrams that are too old to tell if they were already received.", func() {
+			_, err := receiver.ParseChunks(datagrams[99])
+			So(err, ShouldBeNil)
+			_, err = receiver.ParseChunks(datagrams[0])
+			So(err, ShouldNotBeNil)
+			_, err = receiver.ParseChunks(datagrams[90])
+			So(err, ShouldBeNil)
+		})
+
+		Convey("Accepts datagrams from every sender with the key.", func() {
+			other, err := core.MakeFramer(key)
+			So(err, ShouldBeNil)
+			var otherRecorder datagramRecorder
+			other.WriteChunks([]core.Chunk{chunk}, 7, &otherRecorder)
+			_, err = receiver.ParseChunks(datagrams[0])
+			So(err, ShouldBeNil)
+			_, err = receiver.ParseChunks(otherRecorder.datagrams[0])
+			So(err, ShouldBeNil)
+		})
+
+		Convey("Seals with a different key from every other sender with the key.", func() {
+			// Both first datagrams have the same counter and contents, so they would only be the
+			// same if the keys were.
+			other, err := core.MakeFramer(key)
+			So(err, ShouldBeNil)
+			var otherRecorder datagramRecorder
+			other.WriteChunks([]core.Chunk{chunk}, 7, &otherRecorder)
+			So(len(otherRecorder.datagrams[0]), ShouldEqual, len(datagrams[0]))
+			So(otherRecorder.datagrams[0][len(datagrams[0])-30:], ShouldNotResemble, datagrams[0][len(datagrams[0])-30:])
+		})
+
+		Convey("Forgets the senders without a connection it heard from least recently once there are too many.", func() {
+			send := func(framer *core.Framer) [][]byte {
+				var recorder datagramRecorder
+				framer.WriteChunks([]core.Chunk{chunk}, core.NoConnection, &recorder)
+				framer.WriteChunks([]core.Chunk{chunk}, core.NoConnection, &recorder)
+				return recorder.datagrams
+			}
+			_, err := receiver.ParseChunks(datagrams[0])
+			So(err, ShouldBeNil)
+			kept := send(sender)
+			_, err = receiver.ParseChunks(kept[0])
+			So(err, ShouldBeNil)
+			var others [][][]byte
+			for i := 0; i < core.MaxNoConnectionPeers; i++ {
+				other, err := core.MakeFramer(key)
+				So(err, ShouldBeNil)
+				others = append(others, send(other))
+				_, err = receiver.ParseChunks(others[i][0])
+				So(err, ShouldBeNil)
+				if i == core.MaxNoConnectionPeers/2 {
+					_, err = receiver.ParseChunks(kept[1])
+					So(err, ShouldBeNil)
+				}
+			}
+
+			// The first of the others is the only one that was forgotten, so it is the only one that
+			// can be replayed.
+			_, err = receiver.ParseChunks(others[1][0])
+			So(err, ShouldEqual, core.ErrReplayed)
+			_, err = receiver.ParseChunks(kept[0])
+			So(err, ShouldEqual, core.ErrReplayed)
+			_, err = receiver.ParseChunks(others[0][0])
+			So(err, ShouldBeNil)
+
+			// Senders with a connection are never forgotten this way.
+			_, err = receiver.ParseChunks(datagrams[0])
+			So(err, ShouldEqual, core.ErrReplayed)
+		})
+	})
+
+	Convey("Framers use the session for a connection if they have one.", t, func() {
+		framer, err := core.MakeFramer(nil)
+		So(err, ShouldBeNil)
+		session, err := core.MakeFramer([]byte("0123456789abcdef"))
+		So(err, ShouldBeNil)
+		framer.AddSession(7, session)
+		var recorder datagramRecorder
+		chunk := core.Chunk{Source: 3, Target: 4, Stream: 5, Sequence: 6, Data: []byte("thundercats")}
+		framer.WriteChunks([]core.Chunk{chunk}, 7, &recorder)
+		framer.WriteChunks([]core.Chunk{chunk}, 8, &recorder)
+
+		// Only the datagram on connection 7 is sealed with the session.
+		_, err = core.ParseChunks(recorder.datagrams[0])
+		So(err, ShouldNotBeNil)
+		_, err = core.ParseChunks(recorder.datagrams[1])
+		So(err, ShouldBeNil)
+
+		chunks, err := framer.ParseChunks(recorder.datagrams[0])
+		So(err, ShouldBeNil)
+		So(chunks[0].Connection, ShouldEqual, core.ConnectionId(7))
+		_, err = framer.ParseChunks(recorder.datagrams[1])
+		So(err, ShouldBeNil)
+
+		// Datagrams on connection 7 that aren't sealed with the session are rejected.
+		var unsealed datagramRecorder
+		core.WriteChunks([]core.Chunk{chunk}, 7, &unsealed)
+		_, err = framer.ParseChunks(unsealed.datagrams[0])
+		So(err, ShouldNotBeNil)
+
+		framer.RemoveSession(7)
+		_, err = framer.ParseChunks(unsealed.datagrams[0])
+		So(err, ShouldBeNil)
+	})
+
+	Convey("Framers without a key use a CRC.", t, func() {
+		framer, err := core.MakeFramer(nil)
+		So(err, ShouldBeNil)
+		var recorder datagramRecorder
+		chunk := core.Chunk{Source: 3, Target: 4, Stream: 5, Sequence: 6, Data: []byte("thundercats")}
+		framer.WriteChunks([]core.Chunk{chunk}, 7, &recorder)
+		chunks, err := core.ParseChunks(recorder.datagrams[0])
+		So(err, ShouldBeNil)
+		So(len(chunks), ShouldEqual, 1)
+		So(chunks[0].Connection, ShouldEqual, core.ConnectionId(7))
+		So(string(chunks[0].Data), ShouldEqual, string(chunk.Data))
+	})
+
+	Convey("Framers can't be made with an invalid key.", t, func() {
+		_, err := core.MakeFramer([]byte("short"))
+		So(err, ShouldNotBeNil)
+	})
+}
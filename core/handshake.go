@@ -0,0 +1,109 @@
+package core
+
+import (
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"fmt"
+)
+
+// PublicKeySize is the number of bytes in an X25519 public key.
+const PublicKeySize = 32
+
+// sessionKeySize is the number of bytes in each of the keys a session uses.
+const sessionKeySize = 32
+
+// KeyExchange is a client's half of the key exchange it does with the host while joining.  The
+// client sends its ephemeral public key with its request to join, and the host answers with its
+// static public key and an ephemeral public key of its own.  The session keys come from both the
+// ephemeral-ephemeral and ephemeral-static Diffie-Hellman results, so only the holder of the host's
+// static key can derive them, and they can't be recovered later from either static key.
+type KeyExchange struct {
+	private *ecdh.PrivateKey
+}
+
+// MakeKeyExchange returns a KeyExchange with a new ephemeral key.
+func MakeKeyExchange() (*KeyExchange, error) {
+	private, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &KeyExchange{private: private}, nil
+}
+
+// Public returns the ephemeral public key to send to the host.
+func (kx *KeyExchange) Public() []byte {
+	return kx.private.PublicKey().Bytes()
+}
+
+// Finish returns the Framer for the session the host set up with h.  key is the Key from the
+// GlobalConfig, which is mixed in to the session keys if there is one.
+func (kx *KeyExchange) Finish(h *Handshake, key []byte) (*Framer, error) {
+	hostKey, err := ecdh.X25519().NewPublicKey(h.HostKey)
+	if err != nil {
+		return nil, err
+	}
+	hostEphemeral, err := ecdh.X25519().NewPublicKey(h.Ephemeral)
+	if err != nil {
+		return nil, err
+	}
+	ee, err := kx.private.ECDH(hostEphemeral)
+	if err != nil {
+		return nil, err
+	}
+	es, err := kx.private.ECDH(hostKey)
+	if err != nil {
+		return nil, err
+	}
+	toHost, toClient, err := deriveSessionKeys(ee, es, kx.Public(), h, key)
+	if err != nil {
+		return nil, err
+	}
+	return makeKeyedFramer(toHost, toClient)
+}
+
+// AcceptKeyExchange is the host's half of the key exchange.  identity is the host's static key and
+// ephemeral is the public key the client sent.  It returns the Handshake to send to the client and
+// the Framer for the session.  The host's ephemeral key is thrown away once the session keys are
+// derived.
+func AcceptKeyExchange(identity *ecdh.PrivateKey, ephemeral []byte, key []byte) (*Handshake, *Framer, error) {
+	clientEphemeral, err := ecdh.X25519().NewPublicKey(ephemeral)
+	if err != nil {
+		return nil, nil, err
+	}
+	private, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	h := &Handshake{HostKey: identity.PublicKey().Bytes(), Ephemeral: private.PublicKey().Bytes()}
+	ee, err := private.ECDH(clientEphemeral)
+	if err != nil {
+		return nil, nil, err
+	}
+	es, err := identity.ECDH(clientEphemeral)
+	if err != nil {
+		return nil, nil, err
+	}
+	toHost, toClient, err := deriveSessionKeys(ee, es, ephemeral, h, key)
+	if err != nil {
+		return nil, nil, err
+	}
+	framer, err := makeKeyedFramer(toClient, toHost)
+	if err != nil {
+		return nil, nil, err
+	}
+	return h, framer, nil
+}
+
+// deriveSessionKeys derives the keys for each direction of a session from the results of the
+// Diffie-Hellman exchanges and every public key involved.
+func deriveSessionKeys(ee, es, clientEphemeral []byte, h *Handshake, key []byte) (toHost, toClient []byte, err error) {
+	secret := append(append([]byte(nil), ee...), es...)
+	info := "sluice session keys" + string(clientEphemeral) + string(h.Ephemeral) + string(h.HostKey)
+	keys, err := hkdf.Key(sha256.New, secret, key, info, 2*sessionKeySize)
+	if err != nil {
+		return nil, nil, fmt.Errorf("unable to derive session keys: %v", err)
+	}
+	return keys[0:sessionKeySize], keys[sessionKeySize:], nil
+}
@@ -0,0 +1,97 @@
+package core_test
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"testing"
+
+	"github.com/runningwild/sluice/core"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+// exchange does a key exchange between a new client and a host with identity, and returns the
+// Framers for each end of the session.
+func exchange(identity *ecdh.PrivateKey, clientKey, hostKey []byte) (client, host *core.Framer) {
+	kx, err := core.MakeKeyExchange()
+	So(err, ShouldBeNil)
+	h, host, err := core.AcceptKeyExchange(identity, kx.Public(), hostKey)
+	So(err, ShouldBeNil)
+	So(h.HostKey, ShouldResemble, identity.PublicKey().Bytes())
+	client, err = kx.Finish(h, clientKey)
+	So(err, ShouldBeNil)
+	return client, host
+}
+
+// seal returns a datagram on connection 7 sealed by f.
+func seal(f *core.Framer) []byte {
+	var recorder datagramRecorder
+	f.WriteChunks([]core.Chunk{{Source: 2, Target: 1, Stream: 5, Data: []byte("thundercats")}}, 7, &recorder)
+	return recorder.datagrams[0]
+}
+
+func TestKeyExchange(t *testing.T) {
+	Convey("KeyExchange", t, func() {
+		identity, err := ecdh.X25519().GenerateKey(rand.Reader)
+		So(err, ShouldBeNil)
+
+		Convey("gives both ends the same session.", func() {
+			client, host := exchange(identity, nil, nil)
+			chunks, err := host.ParseChunks(seal(client))
+			So(err, ShouldBeNil)
+			So(string(chunks[0].Data), ShouldEqual, "thundercats")
+			chunks, err = client.ParseChunks(seal(host))
+			So(err, ShouldBeNil)
+			So(string(chunks[0].Data), ShouldEqual, "thundercats")
+		})
+
+		Convey("uses a different key in each direction.", func() {
+			client, host := exchange(identity, nil, nil)
+			_, err := client.ParseChunks(seal(client))
+			So(err, ShouldNotBeNil)
+			_, err = host.ParseChunks(seal(host))
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("gives every session different keys.", func() {
+			client, host := exchange(identity, nil, nil)
+			otherClient, otherHost := exchange(identity, nil, nil)
+			_, err := host.ParseChunks(seal(otherClient))
+			So(err, ShouldNotBeNil)
+			_, err = otherHost.ParseChunks(seal(client))
+			So(err, ShouldNotBeNil)
+			_, err = client.ParseChunks(seal(otherHost))
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("only works with the host that has the identity the client was told about.", func() {
+			impostor, err := ecdh.X25519().GenerateKey(rand.Reader)
+			So(err, ShouldBeNil)
+			kx, err := core.MakeKeyExchange()
+			So(err, ShouldBeNil)
+			h, host, err := core.AcceptKeyExchange(impostor, kx.Public(), nil)
+			So(err, ShouldBeNil)
+			h.HostKey = identity.PublicKey().Bytes()
+			client, err := kx.Finish(h, nil)
+			So(err, ShouldBeNil)
+			_, err = client.ParseChunks(seal(host))
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("mixes in the shared key.", func() {
+			key := []byte("0123456789abcdef")
+			client, host := exchange(identity, key, key)
+			_, err := host.ParseChunks(seal(client))
+			So(err, ShouldBeNil)
+			client, host = exchange(identity, key, nil)
+			_, err = host.ParseChunks(seal(client))
+			So(err, ShouldNotBeNil)
+		})
+
+		Convey("rejects bad public keys.", func() {
+			_, _, err := core.AcceptKeyExchange(identity, nil, nil)
+			So(err, ShouldNotBeNil)
+			_, _, err = core.AcceptKeyExchange(identity, make([]byte, core.PublicKeySize), nil)
+			So(err, ShouldNotBeNil)
+		})
+	})
+}
@@ -1,33 +1,350 @@
 package core
 
+import (
+	"time"
+)
+
+// maxResendsPerPosition limits how many SequenceIds the host will ask for in response to a single
+// position chunk.  Anything past this limit will be asked for when the next position chunk arrives.
+const maxResendsPerPosition = 1024
+
+// maxOutstandingPings is how many of the most recent pings to each client the host remembers.  A
+// pong in response to an older ping is ignored.
+const maxOutstandingPings = 16
+
 // HostCommunicateWithClient handles all of the communication with a single client.  Specifically
 // the data being sent to and from this routine will come directly from a single client's
-// ClientSendChunksHandler and ClientRecvChunksHandler routines.
-// func HostRoutine(config *Config, fromOutside, fromInside <-chan RawPacket, toOutside, toInside chan<- RawPacket, c clock.Clock, ticker <-chan time.Time) {
-// fromClient chunks are assembled into packets with a chunk tracker and sent to toCore
-// fromCore chunks are sent immediately to toClient
-func HostCommunicateWithClient(config *Config, node NodeId, fromClient, fromCore <-chan Chunk, toClient chan<- Chunk, toCore chan<- Packet) {
-//	truncate := config.Clock.Tick(config.Truncate)
-//	position := config.Clock.Tick(config.Truncate)
-//	for {
-//		select {
-//		case chunk := <-fromClient:
-//			if !chunk.Stream.IsReserved() {
-//				stream, ok := config.GetStreamConfigById(chunk.Stream)
-//				if !ok {
-//					config.Printf("Got an unknown stream %d", chunk.Stream)
-//					break
-//				}
-//				// TODO: Assemble using chunk mergers here.
-//				toCore <- chunk
-//				if stream.Mode.Reliable() {
-//					// TODO: If this chunk indicates that a sequence is missing, we should immediately
-//					// ask for a resend
-//				}
-//			}
-
-//		case chunk := <-fromCore:
-//			toClient <- chunk
-//		}
-//	}
+// ClientSendChunksHandler and ClientRecvChunksHandler routines.  Chunks from fromClient are
+// assembled into packets and sent to toCore, chunks from fromCore are sent immediately to toClient.
+// Chunks from the client on broadcast streams are also sent to toRelay, with their Source set to
+// node, so that they can be sent to every other client.  Chunks on reliable broadcast streams are
+// sent to toRelay in order, and only once every chunk before them has been received.  Join, Leave,
+// and Punch chunks from fromCore tell this client about other clients, they are numbered and sent
+// reliably by this routine.  Reliable chunks that the client hasn't confirmed are resent once they
+// have been outstanding for longer than the client's RTT suggests they should be, whether or not the
+// client has confirmed anything else on their streamlet.  The client is pinged every config.Ping,
+// and its round trip time is recorded in rtts.  The client is also pinged whenever nothing has been
+// sent to it for config.Keepalive.  Pings from the client are answered right away.
+// HostCommunicateWithClient returns once fromClient is closed.
+func HostCommunicateWithClient(config *Config, node NodeId, rtts *RTTTable, fromClient, fromCore <-chan Chunk, toClient, toRelay chan<- Chunk, toCore chan<- Packet) {
+	h := &hostClientHandler{
+		config:   config,
+		node:     node,
+		rtts:     rtts,
+		toClient: toClient,
+		toRelay:  toRelay,
+		toCore:   toCore,
+		mergers:  make(map[StreamId]ChunkMerger),
+		trackers: make(map[StreamId]*SequenceTracker),
+		pending:  make(PacketTracker),
+		pt:       make(PacketTracker),
+		sent:     make(map[Streamlet]map[SequenceId]time.Time),
+
+		announcements: make(map[StreamId]SequenceId),
+		pings:         make(map[SequenceId]time.Time),
+	}
+	resends := MakeTicker(config.Confirmation, config.Clock)
+	defer resends.Stop()
+	var pings, keepalives <-chan time.Time
+	if config.Ping > 0 {
+		ticker := MakeTicker(config.Ping, config.Clock)
+		defer ticker.Stop()
+		pings = ticker.C
+	}
+	if config.Keepalive > 0 {
+		ticker := MakeTicker(config.Keepalive, config.Clock)
+		defer ticker.Stop()
+		keepalives = ticker.C
+	}
+	for {
+		select {
+		case chunk, ok := <-fromClient:
+			if !ok {
+				return
+			}
+			switch chunk.Stream {
+			case StreamPosition:
+				h.handlePosition(chunk)
+			case StreamConfirm:
+				h.handleConfirm(chunk)
+			case StreamPing:
+				h.send(Chunk{
+					Stream:   StreamPong,
+					Source:   HostNodeId,
+					Target:   h.node,
+					Sequence: chunk.Sequence,
+				})
+			case StreamPong:
+				h.handlePong(chunk)
+			default:
+				if chunk.Stream.IsReserved() {
+					break
+				}
+				h.handleClientChunk(chunk)
+			}
+
+		case chunk, ok := <-fromCore:
+			if !ok {
+				fromCore = nil
+				break
+			}
+			h.handleCoreChunk(chunk)
+
+		case <-resends.C:
+			for sl := range h.sent {
+				h.resend(sl)
+			}
+
+		case <-pings:
+			h.ping()
+
+		case <-keepalives:
+			if h.config.Clock.Now().Sub(h.lastSent) >= h.config.Keepalive {
+				h.ping()
+			}
+		}
+	}
+}
+
+// hostClientHandler holds the state HostCommunicateWithClient keeps about a single client.
+type hostClientHandler struct {
+	config   *Config
+	node     NodeId
+	rtts     *RTTTable
+	toClient chan<- Chunk
+	toRelay  chan<- Chunk
+	toCore   chan<- Packet
+
+	// All chunks from this client are on streamlets belonging to node, so mergers and trackers
+	// only need to be keyed by stream.
+	mergers  map[StreamId]ChunkMerger
+	trackers map[StreamId]*SequenceTracker
+
+	// pending holds chunks on reliable broadcast streams that can't be relayed until the chunks
+	// before them arrive.
+	pending PacketTracker
+
+	// pt holds all reliable chunks sent to the client that it hasn't confirmed yet, and sent holds
+	// the last time each of them was sent.
+	pt   PacketTracker
+	sent map[Streamlet]map[SequenceId]time.Time
+
+	// announcements holds the next SequenceId to use for Join, Leave, and Punch chunks sent to the
+	// client.
+	announcements map[StreamId]SequenceId
+
+	// pings holds the time each recent ping was sent, lastPing is the SequenceId of the most recent.
+	pings    map[SequenceId]time.Time
+	lastPing SequenceId
+
+	// lastSent is the last time anything was sent to the client.
+	lastSent time.Time
+}
+
+// send sends chunk to the client.
+func (h *hostClientHandler) send(chunk Chunk) {
+	h.lastSent = h.config.Clock.Now()
+	h.toClient <- chunk
+}
+
+func (h *hostClientHandler) getTracker(stream StreamId) *SequenceTracker {
+	tracker, ok := h.trackers[stream]
+	if !ok {
+		tracker = MakeSequenceTracker(stream, h.node, FirstSequenceId)
+		h.trackers[stream] = tracker
+	}
+	return tracker
+}
+
+// handleClientChunk relays and merges a chunk on a user-defined stream that came from the client.
+// Relaying happens first so that other clients aren't kept waiting on whoever reads toCore.
+func (h *hostClientHandler) handleClientChunk(chunk Chunk) {
+	stream := h.config.GetStreamConfigById(chunk.Stream)
+	if stream == nil {
+		h.config.Printf("Got a chunk from node %d on stream %d which does not exist.\n", h.node, chunk.Stream)
+		return
+	}
+
+	// The client does not get to decide who it is, the host already knows that.
+	chunk.Source = h.node
+	if stream.Mode.Reliable() {
+		tracker := h.getTracker(stream.Id)
+		if tracker.Contains(chunk.Sequence) {
+			return
+		}
+		prev := tracker.MaxContiguousSequence()
+		tracker.AddSequenceId(chunk.Sequence)
+		if stream.Broadcast {
+			h.pending.Add(chunk)
+			for sequence := prev + 1; sequence <= tracker.MaxContiguousSequence(); sequence++ {
+				h.toRelay <- *h.pending.Get(stream.Id, h.node, sequence)
+				h.pending.Remove(stream.Id, h.node, sequence)
+			}
+		}
+	} else if stream.Broadcast {
+		h.toRelay <- chunk
+	}
+
+	merger, ok := h.mergers[stream.Id]
+	if !ok {
+		merger = makeMerger(h.config, stream.Mode, FirstSequenceId)
+		h.mergers[stream.Id] = merger
+	}
+	for _, packetData := range merger.AddChunk(chunk) {
+		h.toCore <- Packet{
+			Stream: stream.Id,
+			Source: h.node,
+			Data:   packetData,
+		}
+	}
+}
+
+// handlePosition responds to a position chunk, which tells us what the client has sent on its
+// reliable streams.  We ask for anything we're missing, and let the client know what it can forget.
+func (h *hostClientHandler) handlePosition(chunk Chunk) {
+	update, err := ParsePositionChunkData(chunk.Data)
+	if err != nil {
+		h.config.Printf("error parsing position chunk data from node %d: %v\n", h.node, err)
+		return
+	}
+	resend := make(ResendRequest)
+	truncate := make(TruncateRequest)
+	for streamId, position := range update {
+		stream := h.config.GetStreamConfigById(streamId)
+		if stream == nil || !stream.Mode.Reliable() {
+			h.config.Printf("Got a position chunk from node %d for stream %d which is not reliable.\n", h.node, streamId)
+			continue
+		}
+		tracker := h.getTracker(streamId)
+		for sequence := tracker.MaxContiguousSequence() + 1; sequence <= position; sequence++ {
+			if len(resend[streamId]) >= maxResendsPerPosition {
+				break
+			}
+			if !tracker.Contains(sequence) {
+				resend[streamId] = append(resend[streamId], sequence)
+			}
+		}
+		if tracker.MaxContiguousSequence() >= FirstSequenceId {
+			truncate[streamId] = tracker.MaxContiguousSequence()
+		}
+	}
+	for _, data := range MakeResendChunkDatas(h.config, resend) {
+		h.send(Chunk{
+			Stream: StreamResend,
+			Source: HostNodeId,
+			Target: h.node,
+			Data:   data,
+		})
+	}
+	for _, data := range MakeTruncateChunkDatas(h.config, truncate) {
+		h.send(Chunk{
+			Stream: StreamTruncate,
+			Source: HostNodeId,
+			Target: h.node,
+			Data:   data,
+		})
+	}
+}
+
+// handleConfirm responds to a confirm chunk, which tells us what the client has received on a
+// reliable streamlet.  We can stop tracking anything it has, and anything it still doesn't have
+// after a reasonable amount of time gets sent again.
+func (h *hostClientHandler) handleConfirm(chunk Chunk) {
+	st, err := ParseSequenceTrackerChunkData(chunk.Data)
+	if err != nil {
+		h.config.Printf("error parsing confirm chunk data from node %d: %v\n", h.node, err)
+		return
+	}
+	h.pt.RemoveSequenceTracked(st)
+	h.resend(Streamlet{st.StreamId(), st.NodeId()})
+}
+
+// resend sends every chunk on sl that the client hasn't confirmed again if it has gone unconfirmed
+// for longer than retransmitTimeout.  A client can only confirm streamlets it knows about, so this
+// can't wait for a confirm chunk, otherwise a streamlet whose every chunk was lost would never be
+// resent.
+func (h *hostClientHandler) resend(sl Streamlet) {
+	now := h.config.Clock.Now()
+	for sequence, t := range h.sent[sl] {
+		chunk := h.pt.Get(sl.Stream, sl.Node, sequence)
+		if chunk == nil {
+			delete(h.sent[sl], sequence)
+			continue
+		}
+		if now.Sub(t) > h.retransmitTimeout() {
+			h.send(*chunk)
+			h.sent[sl][sequence] = now
+		}
+	}
+	if len(h.sent[sl]) == 0 {
+		delete(h.sent, sl)
+	}
+}
+
+// retransmitTimeout is how long a reliable chunk can go unconfirmed before it is sent again.  The
+// client only confirms chunks every config.Confirmation, so that is added to the client's RTT.  If
+// we don't know the client's RTT yet we just wait for two confirmations.
+func (h *hostClientHandler) retransmitTimeout() time.Duration {
+	rtt, ok := h.rtts.Get(h.node)
+	if !ok {
+		return 2 * h.config.Confirmation
+	}
+	return h.config.Confirmation + rtt.Timeout()
+}
+
+// ping sends a ping chunk to the client and remembers when it was sent.
+func (h *hostClientHandler) ping() {
+	h.lastPing++
+	h.pings[h.lastPing] = h.config.Clock.Now()
+	delete(h.pings, h.lastPing-maxOutstandingPings)
+	h.send(Chunk{
+		Stream:   StreamPing,
+		Source:   HostNodeId,
+		Target:   h.node,
+		Sequence: h.lastPing,
+	})
+}
+
+// handlePong records the time it took the client to respond to one of our pings.
+func (h *hostClientHandler) handlePong(chunk Chunk) {
+	sent, ok := h.pings[chunk.Sequence]
+	if !ok {
+		return
+	}
+	delete(h.pings, chunk.Sequence)
+	h.rtts.Add(h.node, h.config.Clock.Now().Sub(sent))
+}
+
+// handleCoreChunk sends a chunk to the client, and tracks it if it is on a reliable stream.  Join,
+// Leave, and Punch chunks are given the next SequenceId on their stream and are always tracked.
+func (h *hostClientHandler) handleCoreChunk(chunk Chunk) {
+	if chunk.Stream.IsAnnouncement() {
+		sequence, ok := h.announcements[chunk.Stream]
+		if !ok {
+			sequence = FirstSequenceId
+		}
+		h.announcements[chunk.Stream] = sequence + 1
+		chunk.Source = HostNodeId
+		chunk.Target = h.node
+		chunk.Sequence = sequence
+		h.send(chunk)
+		h.track(chunk)
+		return
+	}
+	h.send(chunk)
+	stream := h.config.GetStreamConfigById(chunk.Stream)
+	if stream == nil || !stream.Mode.Reliable() {
+		return
+	}
+	h.track(chunk)
+}
+
+// track keeps chunk around until the client confirms that it has received it.
+func (h *hostClientHandler) track(chunk Chunk) {
+	h.pt.Add(chunk)
+	sl := Streamlet{chunk.Stream, chunk.Source}
+	if _, ok := h.sent[sl]; !ok {
+		h.sent[sl] = make(map[SequenceId]time.Time)
+	}
+	h.sent[sl][chunk.Sequence] = h.config.Clock.Now()
 }
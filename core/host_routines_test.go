@@ -0,0 +1,457 @@
+package core_test
+
+import (
+	"log"
+	"os"
+	"time"
+
+	"github.com/runningwild/clock"
+	"github.com/runningwild/sluice/core"
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+)
+
+func TestHostCommunicateWithClient(t *testing.T) {
+	Convey("HostCommunicateWithClient", t, func() {
+		fc := &clock.FakeClock{}
+		config := &core.Config{
+			Node:   core.HostNodeId,
+			Logger: log.New(os.Stdout, "", log.Lshortfile|log.Ltime),
+			GlobalConfig: core.GlobalConfig{
+				Streams: map[core.StreamId]core.StreamConfig{
+					7: core.StreamConfig{
+						Name: "UU",
+						Id:   7,
+						Mode: core.ModeUnreliableUnordered,
+					},
+					10: core.StreamConfig{
+						Name: "RO",
+						Id:   10,
+						Mode: core.ModeReliableOrdered,
+					},
+					11: core.StreamConfig{
+						Name:      "UB",
+						Id:        11,
+						Mode:      core.ModeUnreliableUnordered,
+						Broadcast: true,
+					},
+					12: core.StreamConfig{
+						Name:      "RB",
+						Id:        12,
+						Mode:      core.ModeReliableOrdered,
+						Broadcast: true,
+					},
+				},
+				MaxChunkDataSize: 50,
+				MaxUnreliableAge: 25,
+				Confirmation:     10 * time.Millisecond,
+				Ping:             time.Hour,
+				Clock:            fc,
+			},
+		}
+		var node core.NodeId = 777
+		rtts := core.MakeRTTTable()
+		fromClient := make(chan core.Chunk)
+		fromCore := make(chan core.Chunk)
+		toClient := make(chan core.Chunk)
+		toRelay := make(chan core.Chunk)
+		toCore := make(chan core.Packet)
+		handlerIsDone := make(chan struct{})
+		defer func() {
+			close(fromClient)
+			for {
+				select {
+				case <-handlerIsDone:
+					return
+				case <-toClient:
+				case <-toRelay:
+				case <-toCore:
+				}
+			}
+		}()
+		go func() {
+			core.HostCommunicateWithClient(config, node, rtts, fromClient, fromCore, toClient, toRelay, toCore)
+			close(handlerIsDone)
+		}()
+
+		Convey("Chunks from the client are assembled into packets and sent to toCore.", func() {
+			stream := config.GetIdFromName("UU")
+			sent := make(chan struct{})
+			go func() {
+				for _, chunk := range makeChunks(config, stream, node, 1, 5) {
+					fromClient <- chunk
+				}
+				close(sent)
+			}()
+			packet := <-toCore
+			<-sent
+			So(packet.Stream, ShouldEqual, stream)
+			So(packet.Source, ShouldEqual, node)
+			So(verifyPacket(packet.Data, stream, node, 1, 5), ShouldBeTrue)
+		})
+
+		Convey("Packets are attributed to the client regardless of the chunk's Source.", func() {
+			stream := config.GetIdFromName("UU")
+			chunk := makeSimpleChunk(stream, node, 1)
+			chunk.Source = core.HostNodeId
+			fromClient <- chunk
+			packet := <-toCore
+			So(packet.Source, ShouldEqual, node)
+		})
+
+		Convey("Reliable and Ordered streams produce all packets in order.", func() {
+			stream := config.GetIdFromName("RO")
+			sent := make(chan struct{})
+			go func() {
+				var chunks []core.Chunk
+				chunks = append(chunks, makeChunks(config, stream, node, 1, 5)...)
+				chunks = append(chunks, makeChunks(config, stream, node, 6, 5)...)
+				chunks = append(chunks, makeChunks(config, stream, node, 11, 5)...)
+				// Send them in reverse order
+				for i := range chunks {
+					fromClient <- chunks[len(chunks)-1-i]
+				}
+				close(sent)
+			}()
+			So(verifyPacket((<-toCore).Data, stream, node, 1, 5), ShouldBeTrue)
+			So(verifyPacket((<-toCore).Data, stream, node, 6, 5), ShouldBeTrue)
+			So(verifyPacket((<-toCore).Data, stream, node, 11, 5), ShouldBeTrue)
+			<-sent
+		})
+
+		Convey("Chunks on unknown streams are dropped.", func() {
+			fromClient <- makeSimpleChunk(123, node, 1)
+			fromClient <- makeSimpleChunk(config.GetIdFromName("UU"), node, 1)
+			packet := <-toCore
+			So(packet.Stream, ShouldEqual, config.GetIdFromName("UU"))
+		})
+
+		Convey("Chunks from fromCore are sent to toClient.", func() {
+			go func() {
+				fromCore <- makeSimpleChunk(config.GetIdFromName("UU"), core.HostNodeId, 10)
+				fromCore <- makeSimpleChunk(config.GetIdFromName("RO"), core.HostNodeId, 11)
+			}()
+			for i := 0; i < 2; i++ {
+				chunk := <-toClient
+				So(verifySimpleChunk(&chunk), ShouldBeTrue)
+			}
+		})
+
+		Convey("Position chunks from the client are answered with resend and truncate chunks.", func() {
+			go func() {
+				for range toCore {
+				}
+			}()
+			stream := config.GetIdFromName("RO")
+			fromClient <- makeSimpleChunk(stream, node, 1)
+			fromClient <- makeSimpleChunk(stream, node, 2)
+			fromClient <- makeSimpleChunk(stream, node, 4)
+			for _, data := range core.MakePositionChunkDatas(config, core.PositionUpdate{stream: 6}) {
+				fromClient <- core.Chunk{
+					Stream: core.StreamPosition,
+					Source: node,
+					Data:   data,
+				}
+			}
+			resendChunk := <-toClient
+			So(resendChunk.Stream, ShouldEqual, core.StreamResend)
+			So(resendChunk.Target, ShouldEqual, node)
+			resend, err := core.ParseResendChunkData(resendChunk.Data)
+			So(err, ShouldBeNil)
+			So(resend, ShouldResemble, core.ResendRequest{stream: []core.SequenceId{3, 5, 6}})
+
+			truncateChunk := <-toClient
+			So(truncateChunk.Stream, ShouldEqual, core.StreamTruncate)
+			truncate, err := core.ParseTruncateChunkData(truncateChunk.Data)
+			So(err, ShouldBeNil)
+			So(truncate, ShouldResemble, core.TruncateRequest{stream: 2})
+		})
+
+		Convey("Reliable chunks sent to the client are resent until they are confirmed.", func() {
+			stream := config.GetIdFromName("RO")
+			for i := 1; i <= 5; i++ {
+				fromCore <- makeSimpleChunk(stream, core.HostNodeId, core.SequenceId(i))
+				<-toClient
+			}
+			st := core.MakeSequenceTracker(stream, core.HostNodeId, 1)
+			st.AddSequenceId(1)
+			st.AddSequenceId(2)
+			st.AddSequenceId(4)
+			confirm := func() {
+				for _, data := range core.MakeSequenceTrackerChunkDatas(config, st) {
+					fromClient <- core.Chunk{
+						Stream: core.StreamConfirm,
+						Source: node,
+						Data:   data,
+					}
+				}
+			}
+
+			// decoy is used to check that nothing was sent to the client before it.
+			decoy := makeSimpleChunk(config.GetIdFromName("UU"), core.HostNodeId, 100)
+			confirm()
+			fromCore <- decoy
+			chunk := <-toClient
+			So(chunk.Sequence, ShouldEqual, decoy.Sequence)
+
+			fc.Inc(time.Second)
+			resent := make(map[core.SequenceId]bool)
+			for i := 0; i < 2; i++ {
+				chunk := <-toClient
+				So(verifySimpleChunk(&chunk), ShouldBeTrue)
+				resent[chunk.Sequence] = true
+			}
+			So(resent, ShouldResemble, map[core.SequenceId]bool{3: true, 5: true})
+
+			Convey("And are not resent once they are confirmed.", func() {
+				st.AddSequenceId(3)
+				st.AddSequenceId(5)
+				confirm()
+				fc.Inc(time.Second)
+				fromCore <- decoy
+				chunk := <-toClient
+				So(chunk.Sequence, ShouldEqual, decoy.Sequence)
+			})
+		})
+
+		Convey("Reliable chunks are resent even if the client never confirms anything on their streamlet.", func() {
+			stream := config.GetIdFromName("RO")
+			fromCore <- makeSimpleChunk(stream, core.HostNodeId, 1)
+			<-toClient
+
+			// Once the decoy makes it through we know the chunk has been tracked.
+			decoy := makeSimpleChunk(config.GetIdFromName("UU"), core.HostNodeId, 100)
+			fromCore <- decoy
+			<-toClient
+			fc.Inc(time.Second)
+			chunk := <-toClient
+			So(verifySimpleChunk(&chunk), ShouldBeTrue)
+			So(chunk.Stream, ShouldEqual, stream)
+			So(chunk.Sequence, ShouldEqual, 1)
+		})
+
+		Convey("Chunks on unreliable broadcast streams are relayed immediately.", func() {
+			go func() {
+				for range toCore {
+				}
+			}()
+			stream := config.GetIdFromName("UB")
+			for _, sequence := range []core.SequenceId{3, 1, 2} {
+				chunk := makeSimpleChunk(stream, node, sequence)
+				chunk.Source = 0
+				fromClient <- chunk
+				relayed := <-toRelay
+				So(relayed.Source, ShouldEqual, node)
+				So(relayed.Sequence, ShouldEqual, sequence)
+			}
+		})
+
+		Convey("Chunks on reliable broadcast streams are relayed in order, without duplicates.", func() {
+			go func() {
+				for range toCore {
+				}
+			}()
+			stream := config.GetIdFromName("RB")
+			var relayed []core.SequenceId
+			done := make(chan struct{})
+			go func() {
+				for chunk := range toRelay {
+					So(verifySimpleChunk(&chunk), ShouldBeTrue)
+					relayed = append(relayed, chunk.Sequence)
+					if len(relayed) == 5 {
+						close(done)
+						return
+					}
+				}
+			}()
+			for _, sequence := range []core.SequenceId{2, 4, 1, 2, 5, 3, 1} {
+				fromClient <- makeSimpleChunk(stream, node, sequence)
+			}
+			<-done
+			So(relayed, ShouldResemble, []core.SequenceId{1, 2, 3, 4, 5})
+		})
+
+		Convey("Chunks on non-broadcast streams are not relayed.", func() {
+			go func() {
+				for range toCore {
+				}
+			}()
+			fromClient <- makeSimpleChunk(config.GetIdFromName("UU"), node, 1)
+			fromClient <- makeSimpleChunk(config.GetIdFromName("UB"), node, 1)
+			relayed := <-toRelay
+			So(relayed.Stream, ShouldEqual, config.GetIdFromName("UB"))
+		})
+
+		Convey("Relayed chunks sent to the client are tracked by their original source.", func() {
+			stream := config.GetIdFromName("RB")
+			var other core.NodeId = 778
+			fromCore <- makeSimpleChunk(stream, other, 1)
+			<-toClient
+			fromCore <- makeSimpleChunk(stream, other, 2)
+			<-toClient
+			st := core.MakeSequenceTracker(stream, other, 1)
+			st.AddSequenceId(2)
+			for _, data := range core.MakeSequenceTrackerChunkDatas(config, st) {
+				fromClient <- core.Chunk{
+					Stream: core.StreamConfirm,
+					Source: node,
+					Data:   data,
+				}
+			}
+			fc.Inc(time.Second)
+			chunk := <-toClient
+			So(verifySimpleChunk(&chunk), ShouldBeTrue)
+			So(chunk.Source, ShouldEqual, other)
+			So(chunk.Sequence, ShouldEqual, 1)
+		})
+
+		Convey("Join, Leave, and Punch chunks are numbered and sent reliably.", func() {
+			announcements := []core.Chunk{
+				core.Chunk{Stream: core.StreamJoin, Data: core.MakeAnnouncementChunkData(3)},
+				core.Chunk{Stream: core.StreamJoin, Data: core.MakeAnnouncementChunkData(4)},
+				core.Chunk{Stream: core.StreamLeave, Data: core.MakeLeaveChunkData(3, core.LeaveClosed)},
+				core.Chunk{Stream: core.StreamPunch, Data: core.MakePunchChunkData(&core.Punch{Start: true, Node: 4})},
+			}
+			var sequences []core.SequenceId
+			for _, announcement := range announcements {
+				fromCore <- announcement
+				chunk := <-toClient
+				So(chunk.Source, ShouldEqual, core.HostNodeId)
+				So(chunk.Target, ShouldEqual, node)
+				sequences = append(sequences, chunk.Sequence)
+			}
+			So(sequences, ShouldResemble, []core.SequenceId{1, 2, 1, 1})
+
+			// Everything but the first join is confirmed, so that is the only thing resent.
+			joins := core.MakeSequenceTracker(core.StreamJoin, core.HostNodeId, 1)
+			joins.AddSequenceId(2)
+			leaves := core.MakeSequenceTracker(core.StreamLeave, core.HostNodeId, 1)
+			leaves.AddSequenceId(1)
+			punches := core.MakeSequenceTracker(core.StreamPunch, core.HostNodeId, 1)
+			punches.AddSequenceId(1)
+			for _, st := range []*core.SequenceTracker{joins, leaves, punches} {
+				for _, data := range core.MakeSequenceTrackerChunkDatas(config, st) {
+					fromClient <- core.Chunk{
+						Stream: core.StreamConfirm,
+						Source: node,
+						Data:   data,
+					}
+				}
+			}
+			fc.Inc(time.Second)
+			chunk := <-toClient
+			So(chunk.Stream, ShouldEqual, core.StreamJoin)
+			So(chunk.Sequence, ShouldEqual, 1)
+			announced, err := core.ParseAnnouncementChunkData(chunk.Data)
+			So(err, ShouldBeNil)
+			So(announced, ShouldEqual, 3)
+		})
+
+		Convey("Clients are pinged, and their pongs are used to estimate their RTT.", func() {
+			// Once the decoy makes it through we know the handler is waiting to ping.
+			decoy := makeSimpleChunk(config.GetIdFromName("UU"), core.HostNodeId, 100)
+			fromCore <- decoy
+			<-toClient
+			fc.Inc(time.Hour)
+			ping := <-toClient
+			So(ping.Stream, ShouldEqual, core.StreamPing)
+			So(ping.Target, ShouldEqual, node)
+			fc.Inc(30 * time.Millisecond)
+			fromClient <- core.Chunk{Stream: core.StreamPong, Source: node, Sequence: ping.Sequence}
+			fromCore <- decoy
+			<-toClient
+
+			// Duplicate and unknown pongs are ignored.
+			fc.Inc(30 * time.Millisecond)
+			fromClient <- core.Chunk{Stream: core.StreamPong, Source: node, Sequence: ping.Sequence}
+			fromClient <- core.Chunk{Stream: core.StreamPong, Source: node, Sequence: ping.Sequence + 1}
+
+			// Once the decoy makes it through we know the pongs have been handled.
+			fromCore <- decoy
+			<-toClient
+			rtt, ok := rtts.Get(node)
+			So(ok, ShouldBeTrue)
+			So(rtt.Samples, ShouldEqual, 1)
+			So(rtt.Smoothed, ShouldEqual, 30*time.Millisecond)
+
+			Convey("And reliable chunks are resent based on the RTT.", func() {
+				// The timeout is 10ms + 30ms + 4*15ms.
+				stream := config.GetIdFromName("RO")
+				fromCore <- makeSimpleChunk(stream, core.HostNodeId, 1)
+				<-toClient
+				fromCore <- decoy
+				<-toClient
+				fc.Inc(90 * time.Millisecond)
+				fromCore <- decoy
+				chunk := <-toClient
+				So(chunk.Sequence, ShouldEqual, decoy.Sequence)
+
+				fc.Inc(20 * time.Millisecond)
+				chunk = <-toClient
+				So(chunk.Stream, ShouldEqual, stream)
+				So(chunk.Sequence, ShouldEqual, 1)
+			})
+		})
+
+		Convey("Pings from the client are answered with pongs.", func() {
+			fromClient <- core.Chunk{Stream: core.StreamPing, Source: node, Sequence: 5}
+			pong := <-toClient
+			So(pong.Stream, ShouldEqual, core.StreamPong)
+			So(pong.Source, ShouldEqual, core.HostNodeId)
+			So(pong.Target, ShouldEqual, node)
+			So(pong.Sequence, ShouldEqual, 5)
+		})
+	})
+}
+
+func TestHostKeepalive(t *testing.T) {
+	Convey("HostCommunicateWithClient pings the client when it has been idle for Keepalive.", t, func() {
+		fc := &clock.FakeClock{}
+		config := &core.Config{
+			Node: core.HostNodeId,
+			GlobalConfig: core.GlobalConfig{
+				Streams: map[core.StreamId]core.StreamConfig{
+					7: core.StreamConfig{
+						Name: "UU",
+						Id:   7,
+						Mode: core.ModeUnreliableUnordered,
+					},
+				},
+				MaxChunkDataSize: 50,
+				MaxUnreliableAge: 25,
+				Confirmation:     time.Hour,
+				Keepalive:        time.Minute,
+				Clock:            fc,
+			},
+		}
+		fromClient := make(chan core.Chunk)
+		fromCore := make(chan core.Chunk)
+		toClient := make(chan core.Chunk)
+		handlerIsDone := make(chan struct{})
+		defer func() {
+			close(fromClient)
+			<-handlerIsDone
+		}()
+		go func() {
+			core.HostCommunicateWithClient(config, 777, core.MakeRTTTable(), fromClient, fromCore, toClient, nil, nil)
+			close(handlerIsDone)
+		}()
+
+		// Once the decoy makes it through we know the handler is waiting for the keepalive.
+		decoy := makeSimpleChunk(7, core.HostNodeId, 100)
+		fromCore <- decoy
+		<-toClient
+		fc.Inc(time.Minute)
+		ping := <-toClient
+		So(ping.Stream, ShouldEqual, core.StreamPing)
+		So(ping.Target, ShouldEqual, 777)
+
+		// Nothing is sent if something else was sent recently.
+		fc.Inc(59 * time.Second)
+		fromCore <- decoy
+		<-toClient
+		fc.Inc(time.Second)
+		fromCore <- decoy
+		So((<-toClient).Sequence, ShouldEqual, decoy.Sequence)
+	})
+}
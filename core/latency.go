@@ -0,0 +1,207 @@
+package core
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Link is the one-way path from one client to another.
+type Link struct {
+	From, To NodeId
+}
+
+// LatencyMatrix holds an estimate of the latency between every pair of clients.  The estimates are
+// of one-way latency, and are smoothed the same way as RTTs.  It is safe to use from multiple
+// goroutines.
+type LatencyMatrix struct {
+	mu    sync.RWMutex
+	links map[Link]RTT
+}
+
+// MakeLatencyMatrix returns an empty LatencyMatrix.
+func MakeLatencyMatrix() *LatencyMatrix {
+	return &LatencyMatrix{links: make(map[Link]RTT)}
+}
+
+// Add updates the latency of link with a new sample.
+func (m *LatencyMatrix) Add(link Link, sample time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	latency := m.links[link]
+	latency.Add(sample)
+	m.links[link] = latency
+}
+
+// Get returns the latency of link, and false if there haven't been any samples for it yet.
+func (m *LatencyMatrix) Get(link Link) (RTT, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	latency, ok := m.links[link]
+	return latency, ok
+}
+
+// All returns a copy of the latency of every link that has been measured.
+func (m *LatencyMatrix) All() map[Link]RTT {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	links := make(map[Link]RTT)
+	for link, latency := range m.links {
+		links[link] = latency
+	}
+	return links
+}
+
+// Remove forgets every link to or from node.
+func (m *LatencyMatrix) Remove(node NodeId) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for link := range m.links {
+		if link.From == node || link.To == node {
+			delete(m.links, link)
+		}
+	}
+}
+
+// maxOutstandingDings is how many of the most recent Dings the host remembers.  A Dong in response
+// to an older Ding is ignored.
+const maxOutstandingDings = 64
+
+// LatencyProber decides which pair of clients to measure next, and turns the Dongs that come back
+// into samples for a LatencyMatrix.
+type LatencyProber struct {
+	config *Config
+	rtts   *RTTTable
+	matrix *LatencyMatrix
+
+	// dings holds the link and send time of each recent Ding.  lastDing is the SequenceId of the most
+	// recent Ding, and last is the link it measured.
+	dings    map[SequenceId]ding
+	lastDing SequenceId
+	last     Link
+
+	// missed is the number of Dings in a row on each link that were never answered.
+	missed map[Link]int
+}
+
+type ding struct {
+	link Link
+	sent time.Time
+}
+
+// MakeLatencyProber returns a LatencyProber that records samples in matrix.  The RTTs in rtts are
+// needed to work out how much of each probe was spent between the clients.
+func MakeLatencyProber(config *Config, rtts *RTTTable, matrix *LatencyMatrix) *LatencyProber {
+	return &LatencyProber{
+		config: config,
+		rtts:   rtts,
+		matrix: matrix,
+		dings:  make(map[SequenceId]ding),
+		missed: make(map[Link]int),
+	}
+}
+
+// Ding picks the next link between the clients in addrs to measure, and returns the Ding chunk that
+// should be sent to link.From and the Dang chunk that should be sent to link.To, which tells it who
+// to expect a Dang from and where.  addrs maps from each client to the address other clients can
+// reach it at.  Ding returns false if there are fewer than two clients.
+func (p *LatencyProber) Ding(addrs map[NodeId]string) (Chunk, Chunk, bool) {
+	var nodes []int
+	for node := range addrs {
+		nodes = append(nodes, int(node))
+	}
+	if len(nodes) < 2 {
+		return Chunk{}, Chunk{}, false
+	}
+	sort.Ints(nodes)
+
+	// Links are measured in order, starting again at the beginning once we've done them all.
+	var first, next *Link
+	for _, from := range nodes {
+		for _, to := range nodes {
+			if from == to {
+				continue
+			}
+			link := Link{NodeId(from), NodeId(to)}
+			if first == nil {
+				first = &link
+			}
+			if next == nil && (link.From > p.last.From || (link.From == p.last.From && link.To > p.last.To)) {
+				next = &link
+			}
+		}
+	}
+	if next == nil {
+		next = first
+	}
+	p.last = *next
+
+	// If the last Ding on this link still hasn't been answered it probably never will be.
+	for sequence, d := range p.dings {
+		if d.link == p.last {
+			delete(p.dings, sequence)
+			p.missed[p.last]++
+		}
+	}
+
+	p.lastDing++
+	p.dings[p.lastDing] = ding{link: p.last, sent: p.config.Clock.Now()}
+	delete(p.dings, p.lastDing-maxOutstandingDings)
+	return Chunk{
+		Stream:   StreamDing,
+		Source:   HostNodeId,
+		Target:   p.last.From,
+		Sequence: p.lastDing,
+		Data:     MakeDingChunkData(p.last.To, addrs[p.last.To]),
+	}, Chunk{
+		Stream:   StreamDang,
+		Source:   HostNodeId,
+		Target:   p.last.To,
+		Sequence: p.lastDing,
+		Data:     MakeDingChunkData(p.last.From, addrs[p.last.From]),
+	}, true
+}
+
+// HandleDong records how long it took the Ding that chunk is in response to to go from the host to
+// one client, to the other, and back to the host.  node is the client that sent chunk.  The time
+// between the clients is estimated by subtracting half of each client's RTT.
+func (p *LatencyProber) HandleDong(node NodeId, chunk Chunk) {
+	d, ok := p.dings[chunk.Sequence]
+	if !ok || d.link.To != node {
+		return
+	}
+	delete(p.dings, chunk.Sequence)
+	delete(p.missed, d.link)
+	fromRTT, ok := p.rtts.Get(d.link.From)
+	if !ok {
+		return
+	}
+	toRTT, ok := p.rtts.Get(d.link.To)
+	if !ok {
+		return
+	}
+	sample := p.config.Clock.Now().Sub(d.sent) - fromRTT.Smoothed/2 - toRTT.Smoothed/2
+	if sample < 0 {
+		sample = 0
+	}
+	p.matrix.Add(d.link, sample)
+}
+
+// Missed returns the number of Dings in a row on link that were never answered.
+func (p *LatencyProber) Missed(link Link) int {
+	return p.missed[link]
+}
+
+// Remove forgets about any Dings that involve node.
+func (p *LatencyProber) Remove(node NodeId) {
+	for sequence, d := range p.dings {
+		if d.link.From == node || d.link.To == node {
+			delete(p.dings, sequence)
+		}
+	}
+	for link := range p.missed {
+		if link.From == node || link.To == node {
+			delete(p.missed, link)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package core_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/runningwild/clock"
+	"github.com/runningwild/sluice/core"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestLatencyMatrix(t *testing.T) {
+	Convey("LatencyMatrix", t, func() {
+		matrix := core.MakeLatencyMatrix()
+		matrix.Add(core.Link{2, 3}, 10*time.Millisecond)
+		matrix.Add(core.Link{3, 2}, 20*time.Millisecond)
+		matrix.Add(core.Link{3, 4}, 30*time.Millisecond)
+
+		Convey("Keeps each direction of a link separately.", func() {
+			latency, ok := matrix.Get(core.Link{2, 3})
+			So(ok, ShouldBeTrue)
+			So(latency.Smoothed, ShouldEqual, 10*time.Millisecond)
+			latency, ok = matrix.Get(core.Link{3, 2})
+			So(ok, ShouldBeTrue)
+			So(latency.Smoothed, ShouldEqual, 20*time.Millisecond)
+			_, ok = matrix.Get(core.Link{4, 3})
+			So(ok, ShouldBeFalse)
+			So(len(matrix.All()), ShouldEqual, 3)
+		})
+
+		Convey("Forgets every link to and from a node that is removed.", func() {
+			matrix.Remove(2)
+			all := matrix.All()
+			So(len(all), ShouldEqual, 1)
+			So(all[core.Link{3, 4}].Smoothed, ShouldEqual, 30*time.Millisecond)
+		})
+	})
+}
+
+func TestLatencyProber(t *testing.T) {
+	Convey("LatencyProber", t, func() {
+		fc := &clock.FakeClock{}
+		config := &core.Config{GlobalConfig: core.GlobalConfig{Clock: fc}}
+		rtts := core.MakeRTTTable()
+		matrix := core.MakeLatencyMatrix()
+		prober := core.MakeLatencyProber(config, rtts, matrix)
+		addrs := map[core.NodeId]string{
+			2: "addr2",
+			3: "addr3",
+			4: "addr4",
+		}
+
+		Convey("Needs at least two clients.", func() {
+			_, _, ok := prober.Ding(map[core.NodeId]string{2: "addr2"})
+			So(ok, ShouldBeFalse)
+		})
+
+		Convey("Measures every link in turn.", func() {
+			var links []core.Link
+			for i := 0; i < 7; i++ {
+				chunk, expect, ok := prober.Ding(addrs)
+				So(ok, ShouldBeTrue)
+				So(chunk.Stream, ShouldEqual, core.StreamDing)
+				to, addr, err := core.ParseDingChunkData(chunk.Data)
+				So(err, ShouldBeNil)
+				So(addr, ShouldEqual, addrs[to])
+
+				// The other client is told to expect a Dang from the one the Ding is sent to.
+				So(expect.Stream, ShouldEqual, core.StreamDang)
+				So(expect.Target, ShouldEqual, to)
+				So(expect.Sequence, ShouldEqual, chunk.Sequence)
+				from, addr, err := core.ParseDingChunkData(expect.Data)
+				So(err, ShouldBeNil)
+				So(from, ShouldEqual, chunk.Target)
+				So(addr, ShouldEqual, addrs[from])
+				links = append(links, core.Link{chunk.Target, to})
+			}
+			So(links, ShouldResemble, []core.Link{
+				{2, 3}, {2, 4}, {3, 2}, {3, 4}, {4, 2}, {4, 3}, {2, 3},
+			})
+		})
+
+		Convey("Counts Dings in a row that are never answered.", func() {
+			var chunk core.Chunk
+			for i := 0; i < 13; i++ {
+				chunk, _, _ = prober.Ding(addrs)
+			}
+			So(chunk.Target, ShouldEqual, 2)
+			So(prober.Missed(core.Link{2, 3}), ShouldEqual, 2)
+			So(prober.Missed(core.Link{2, 4}), ShouldEqual, 1)
+
+			prober.HandleDong(3, core.Chunk{Stream: core.StreamDong, Source: 3, Sequence: chunk.Sequence})
+			So(prober.Missed(core.Link{2, 3}), ShouldEqual, 0)
+			prober.Remove(4)
+			So(prober.Missed(core.Link{2, 4}), ShouldEqual, 0)
+		})
+
+		Convey("Turns Dongs into samples once it knows both clients' RTTs.", func() {
+			chunk, _, _ := prober.Ding(addrs)
+			fc.Inc(100 * time.Millisecond)
+			dong := core.Chunk{Stream: core.StreamDong, Source: 3, Sequence: chunk.Sequence}
+			prober.HandleDong(3, dong)
+			_, ok := matrix.Get(core.Link{2, 3})
+			So(ok, ShouldBeFalse)
+
+			rtts.Add(2, 40*time.Millisecond)
+			rtts.Add(3, 60*time.Millisecond)
+			chunk, _, _ = prober.Ding(addrs)
+			chunk, _, _ = prober.Ding(addrs)
+			So(chunk.Target, ShouldEqual, 3)
+			fc.Inc(100 * time.Millisecond)
+
+			Convey("Dongs from the wrong client are ignored.", func() {
+				prober.HandleDong(4, core.Chunk{Stream: core.StreamDong, Source: 4, Sequence: chunk.Sequence})
+				So(len(matrix.All()), ShouldEqual, 0)
+			})
+
+			Convey("Dongs are only counted once.", func() {
+				dong := core.Chunk{Stream: core.StreamDong, Source: 2, Sequence: chunk.Sequence}
+				prober.HandleDong(2, dong)
+				fc.Inc(100 * time.Millisecond)
+				prober.HandleDong(2, dong)
+				latency, ok := matrix.Get(core.Link{3, 2})
+				So(ok, ShouldBeTrue)
+				So(latency.Samples, ShouldEqual, 1)
+				So(latency.Smoothed, ShouldEqual, 50*time.Millisecond)
+			})
+
+			Convey("Dongs for a node that was removed are ignored.", func() {
+				prober.Remove(3)
+				prober.HandleDong(2, core.Chunk{Stream: core.StreamDong, Source: 2, Sequence: chunk.Sequence})
+				So(len(matrix.All()), ShouldEqual, 0)
+			})
+		})
+	})
+}
@@ -9,7 +9,7 @@ func WriterRoutine(config StreamConfig, target NodeId, maxChunkDataSize int, pac
 	if config.Broadcast && target != 0 {
 		panic("Cannot target with a broadcast stream.")
 	}
-	var sequence SequenceId = 0
+	sequence := FirstSequenceId
 	for packet := range packets {
 		if len(packet) <= maxChunkDataSize {
 			chunks <- Chunk{
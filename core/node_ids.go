@@ -0,0 +1,45 @@
+package core
+
+// MaxClientNodeIds is the number of NodeIds there are for clients.
+const MaxClientNodeIds = 1<<16 - 2
+
+// NodeIdAllocator hands out NodeIds to clients as they join.  NodeIds are handed out in order, so a
+// node that has left can't be confused with a new one until every NodeId has been used.  After that
+// the NodeIds of nodes that have left are handed out again.
+type NodeIdAllocator struct {
+	next NodeId
+	used map[NodeId]bool
+}
+
+// MakeNodeIdAllocator returns a NodeIdAllocator that hasn't handed out any NodeIds.
+func MakeNodeIdAllocator() *NodeIdAllocator {
+	return &NodeIdAllocator{next: HostNodeId + 1, used: make(map[NodeId]bool)}
+}
+
+// Allocate returns an unused NodeId, and false if every NodeId is in use.
+func (a *NodeIdAllocator) Allocate() (NodeId, bool) {
+	if len(a.used) >= MaxClientNodeIds {
+		return 0, false
+	}
+	for {
+		node := a.next
+		a.next++
+		if a.next == 0 {
+			a.next = HostNodeId + 1
+		}
+		if !a.used[node] {
+			a.used[node] = true
+			return node, true
+		}
+	}
+}
+
+// Free makes node available to be handed out again, once every other NodeId has been.
+func (a *NodeIdAllocator) Free(node NodeId) {
+	delete(a.used, node)
+}
+
+// InUse returns the number of NodeIds that have been handed out and not freed.
+func (a *NodeIdAllocator) InUse() int {
+	return len(a.used)
+}
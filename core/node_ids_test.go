@@ -0,0 +1,55 @@
+package core_test
+
+import (
+	"testing"
+
+	"github.com/runningwild/sluice/core"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestNodeIdAllocator(t *testing.T) {
+	Convey("NodeIdAllocator", t, func() {
+		a := core.MakeNodeIdAllocator()
+
+		Convey("hands out NodeIds in order, starting after the host's.", func() {
+			for i := 0; i < 10; i++ {
+				node, ok := a.Allocate()
+				So(ok, ShouldBeTrue)
+				So(node, ShouldEqual, core.HostNodeId+1+core.NodeId(i))
+			}
+			So(a.InUse(), ShouldEqual, 10)
+		})
+
+		Convey("doesn't reuse NodeIds until they have all been handed out.", func() {
+			first, _ := a.Allocate()
+			a.Free(first)
+			second, _ := a.Allocate()
+			So(second, ShouldNotEqual, first)
+		})
+
+		Convey("reuses freed NodeIds once they have all been handed out.", func() {
+			seen := make(map[core.NodeId]bool)
+			for i := 0; i < core.MaxClientNodeIds; i++ {
+				node, ok := a.Allocate()
+				So(ok, ShouldBeTrue)
+				So(seen[node], ShouldBeFalse)
+				So(node, ShouldNotEqual, 0)
+				So(node, ShouldNotEqual, core.HostNodeId)
+				seen[node] = true
+			}
+			_, ok := a.Allocate()
+			So(ok, ShouldBeFalse)
+
+			a.Free(100)
+			a.Free(5)
+			node, ok := a.Allocate()
+			So(ok, ShouldBeTrue)
+			So(node, ShouldEqual, 5)
+			node, ok = a.Allocate()
+			So(ok, ShouldBeTrue)
+			So(node, ShouldEqual, 100)
+			_, ok = a.Allocate()
+			So(ok, ShouldBeFalse)
+		})
+	})
+}
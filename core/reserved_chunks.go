@@ -2,6 +2,7 @@ package core
 
 import (
 	"fmt"
+	"time"
 )
 
 // ResendRequest is a map from StreamId to a list of SequenceIds of chunks on that stream that need
@@ -130,3 +131,531 @@ func ParsePositionChunkData(data []byte) (PositionUpdate, error) {
 	}
 	return PositionUpdate(s), nil
 }
+
+// SessionToken is a random value the host gives a client when it joins.  A client that presents it
+// later can resume its session from a different address.
+type SessionToken [8]byte
+
+// Welcome is sent from the host to a client in response to its join request.  The client's
+// ConnectionId is the one on the datagrams its welcome arrives in.
+type Welcome struct {
+	// Node is the NodeId the host has assigned to the client.
+	Node NodeId
+
+	// Session is the client's SessionToken.
+	Session SessionToken
+
+	// Version is the ProtocolVersion the host and the client use on the client's connection.
+	Version ProtocolVersion
+
+	// Starts maps from reliable streamlets to the first SequenceId the client should expect on
+	// them.  Streamlets that aren't present start at FirstSequenceId.
+	Starts map[Streamlet]SequenceId
+}
+
+// welcomeHeaderSize is the number of bytes at the start of each welcome chunk before its starts.
+const welcomeHeaderSize = 15
+
+// MakeWelcomeChunkDatas serializes w into one or more chunks.  Each chunk contains the NodeId, the
+// SessionToken, the ProtocolVersion, and the total number of starts, followed by repeated triples
+// of <StreamId, NodeId, SequenceId>, so a client can tell when it has received all of them
+// regardless of what order they arrive in.
+func MakeWelcomeChunkDatas(config *Config, w *Welcome) [][]byte {
+	header := func() []byte {
+		data := AppendNodeId(nil, w.Node)
+		data = append(data, w.Session[:]...)
+		data = append(data, byte(w.Version))
+		return AppendUint32(data, uint32(len(w.Starts)))
+	}
+	var ret [][]byte
+	current := header()
+	for sl, sequence := range w.Starts {
+		if len(current)+8 > config.MaxChunkDataSize && len(current) > welcomeHeaderSize {
+			ret = append(ret, current)
+			current = header()
+		}
+		current = AppendStreamId(current, sl.Stream)
+		current = AppendNodeId(current, sl.Node)
+		current = AppendSequenceId(current, sequence)
+	}
+	return append(ret, current)
+}
+
+// ParseWelcomeChunkData parses a single welcome chunk.  The returned Welcome only contains the
+// starts from this chunk, total is the number of starts across all of the chunks.
+func ParseWelcomeChunkData(data []byte) (w *Welcome, total int, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			w = nil
+			err = fmt.Errorf("unexpected parse error while parsing a welcome chunk: %q", r)
+		}
+	}()
+	w = &Welcome{Starts: make(map[Streamlet]SequenceId)}
+	data = ConsumeNodeId(data, &w.Node)
+	data = data[copy(w.Session[:], data[0:len(w.Session)]):]
+	w.Version = ProtocolVersion(data[0])
+	data = data[1:]
+	var count uint32
+	data = ConsumeUint32(data, &count)
+	for len(data) > 0 {
+		var sl Streamlet
+		var sequence SequenceId
+		data = ConsumeStreamId(data, &sl.Stream)
+		data = ConsumeNodeId(data, &sl.Node)
+		data = ConsumeSequenceId(data, &sequence)
+		w.Starts[sl] = sequence
+	}
+	return w, int(count), err
+}
+
+// globalConfigHeaderSize is the number of bytes at the start of each GlobalConfig chunk before its
+// streams.
+const globalConfigHeaderSize = 76
+
+// MakeGlobalConfigChunkDatas serializes everything in g that the host dictates to its clients into
+// one or more chunks.  That's everything but the Clock, which belongs to each node, and the Key,
+// which clients need before they can read anything from the host.  Each chunk contains the tuning
+// values and the total number of streams, followed by repeated <StreamId, Mode, Broadcast, Name>,
+// so a client can tell when it has received all of them regardless of what order they arrive in.
+func MakeGlobalConfigChunkDatas(config *Config, g *GlobalConfig) [][]byte {
+	header := func() []byte {
+		data := AppendUint32(nil, uint32(g.MaxChunkDataSize))
+		data = AppendSequenceId(data, g.MaxUnreliableAge)
+		for _, d := range []time.Duration{
+			g.PositionChunkMin, g.PositionChunkMax, g.Confirmation, g.Ping, g.Stats, g.Keepalive, g.Timeout, g.Ding,
+		} {
+			data = AppendUint64(data, uint64(d))
+		}
+		return AppendUint32(data, uint32(len(g.Streams)))
+	}
+	var ret [][]byte
+	current := header()
+	for id, stream := range g.Streams {
+		size := 6 + len(stream.Name)
+		if len(current)+size > config.MaxChunkDataSize && len(current) > globalConfigHeaderSize {
+			ret = append(ret, current)
+			current = header()
+		}
+		current = AppendStreamId(current, id)
+		current = AppendUint8(current, uint8(stream.Mode))
+		current = AppendBool(current, stream.Broadcast)
+		current = AppendStringWithLength(current, stream.Name)
+	}
+	return append(ret, current)
+}
+
+// ParseGlobalConfigChunkData parses a single GlobalConfig chunk.  The returned GlobalConfig only
+// contains the streams from this chunk, total is the number of streams across all of the chunks.
+// Streams with a Mode we don't know are an error.
+func ParseGlobalConfigChunkData(data []byte) (g *GlobalConfig, total int, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			g = nil
+			err = fmt.Errorf("unexpected parse error while parsing a global config chunk: %q", r)
+		}
+	}()
+	g = &GlobalConfig{Streams: make(map[StreamId]StreamConfig)}
+	var maxChunkDataSize uint32
+	data = ConsumeUint32(data, &maxChunkDataSize)
+	g.MaxChunkDataSize = int(maxChunkDataSize)
+	data = ConsumeSequenceId(data, &g.MaxUnreliableAge)
+	for _, d := range []*time.Duration{
+		&g.PositionChunkMin, &g.PositionChunkMax, &g.Confirmation, &g.Ping, &g.Stats, &g.Keepalive, &g.Timeout, &g.Ding,
+	} {
+		var nanoseconds uint64
+		data = ConsumeUint64(data, &nanoseconds)
+		*d = time.Duration(nanoseconds)
+	}
+	var count uint32
+	data = ConsumeUint32(data, &count)
+	for len(data) > 0 {
+		var stream StreamConfig
+		data = ConsumeStreamId(data, &stream.Id)
+		stream.Mode = Mode(data[0])
+		data = data[1:]
+		if stream.Mode >= ModeMax {
+			return nil, 0, fmt.Errorf("stream %d has an unknown mode %d", stream.Id, stream.Mode)
+		}
+		data = ConsumeBool(data, &stream.Broadcast)
+		if data, err = ConsumeStringWithLength(data, &stream.Name); err != nil {
+			return nil, 0, err
+		}
+		g.Streams[stream.Id] = stream
+	}
+	return g, int(count), nil
+}
+
+// joinRequestSize is the smallest a join request can be.  It leaves room for a cookie, so that the
+// host's answer to a request is never bigger than the request.
+const joinRequestSize = 12 + CookieSize
+
+// MaxJoinDataSize is the most application data a client can send with its request to join.
+const MaxJoinDataSize = 1024
+
+// MaxAppVersionSize is the longest application version a client can send with its request to join.
+const MaxAppVersionSize = 64
+
+// JoinRequest is sent from a client to the host in a Join chunk to ask to join.
+type JoinRequest struct {
+	// Versions are the ProtocolVersions the client speaks.
+	Versions VersionRange
+
+	// Cookie is empty if the client doesn't have one yet.
+	Cookie []byte
+
+	// Ephemeral is the client's ephemeral public key for the key exchange, which is empty if it
+	// doesn't do one.
+	Ephemeral []byte
+
+	// Fingerprint is the Fingerprint of the GlobalConfig the client expects the host to have, which
+	// is empty if it will use whatever the host has.
+	Fingerprint []byte
+
+	// AppVersion is the version of the application the client is running.
+	AppVersion string
+
+	// Data is whatever the application wants the host to check before it lets the client join.
+	Data []byte
+}
+
+// MakeJoinChunkData serializes r.
+func MakeJoinChunkData(r *JoinRequest) []byte {
+	data := []byte{byte(r.Versions.Min), byte(r.Versions.Max)}
+	data = AppendBytesWithLength(data, r.Cookie)
+	data = AppendBytesWithLength(data, r.Ephemeral)
+	data = AppendBytesWithLength(data, r.Fingerprint)
+	data = AppendStringWithLength(data, r.AppVersion)
+	data = AppendBytesWithLength(data, r.Data)
+	for len(data) < joinRequestSize {
+		data = append(data, 0)
+	}
+	return data
+}
+
+// ParseJoinChunkData parses the data from a Join chunk sent by a client that is asking to join.
+func ParseJoinChunkData(data []byte) (*JoinRequest, error) {
+	if len(data) < joinRequestSize {
+		return nil, fmt.Errorf("join chunk has length %d, expected at least %d", len(data), joinRequestSize)
+	}
+	r := JoinRequest{Versions: VersionRange{Min: ProtocolVersion(data[0]), Max: ProtocolVersion(data[1])}}
+	data = data[2:]
+	var err error
+	if data, err = ConsumeBytesWithLength(data, &r.Cookie); err != nil {
+		return nil, err
+	}
+	if data, err = ConsumeBytesWithLength(data, &r.Ephemeral); err != nil {
+		return nil, err
+	}
+	if data, err = ConsumeBytesWithLength(data, &r.Fingerprint); err != nil {
+		return nil, err
+	}
+	if data, err = ConsumeStringWithLength(data, &r.AppVersion); err != nil {
+		return nil, err
+	}
+	if _, err = ConsumeBytesWithLength(data, &r.Data); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// maxReasonSize is the longest reason the host will give a client for refusing to let it join, or
+// for kicking it.
+const maxReasonSize = 256
+
+// MakeRefuseChunkData serializes the reason the host gives a client for not letting it join.
+// Reasons longer than maxReasonSize are cut short.
+func MakeRefuseChunkData(reason string) []byte {
+	if len(reason) > maxReasonSize {
+		reason = reason[0:maxReasonSize]
+	}
+	return AppendStringWithLength(nil, reason)
+}
+
+// ParseRefuseChunkData parses the data from a Refuse chunk.
+func ParseRefuseChunkData(data []byte) (string, error) {
+	var reason string
+	_, err := ConsumeStringWithLength(data, &reason)
+	return reason, err
+}
+
+// Handshake is sent from the host to a client that asked to join with an ephemeral public key, so
+// that the client can finish the key exchange.
+type Handshake struct {
+	// HostKey is the public key of the host's Identity, and Ephemeral is the public key the host
+	// made for this client.
+	HostKey   []byte
+	Ephemeral []byte
+}
+
+// MakeHandshakeChunkData serializes h.
+func MakeHandshakeChunkData(h *Handshake) []byte {
+	return append(append([]byte(nil), h.HostKey...), h.Ephemeral...)
+}
+
+// ParseHandshakeChunkData parses the data from a Handshake chunk.
+func ParseHandshakeChunkData(data []byte) (*Handshake, error) {
+	if len(data) != 2*PublicKeySize {
+		return nil, fmt.Errorf("handshake chunk has length %d, expected %d", len(data), 2*PublicKeySize)
+	}
+	return &Handshake{
+		HostKey:   append([]byte(nil), data[0:PublicKeySize]...),
+		Ephemeral: append([]byte(nil), data[PublicKeySize:]...),
+	}, nil
+}
+
+// Resume is sent from a client to the host in a Join chunk to ask to carry on with its session,
+// which the host may know at a different address.
+type Resume struct {
+	Node    NodeId
+	Session SessionToken
+}
+
+// MakeResumeChunkData serializes r.
+func MakeResumeChunkData(r *Resume) []byte {
+	return append(AppendNodeId(nil, r.Node), r.Session[:]...)
+}
+
+// ParseResumeChunkData parses the data from a Join chunk sent by a client that wants to resume its
+// session.
+func ParseResumeChunkData(data []byte) (*Resume, error) {
+	var r Resume
+	if len(data) != 2+len(r.Session) {
+		return nil, fmt.Errorf("resume chunk has length %d, expected %d", len(data), 2+len(r.Session))
+	}
+	data = ConsumeNodeId(data, &r.Node)
+	copy(r.Session[:], data)
+	return &r, nil
+}
+
+// MakeAnnouncementChunkData serializes the NodeId carried by Join chunks sent from the host.
+func MakeAnnouncementChunkData(node NodeId) []byte {
+	return AppendNodeId(nil, node)
+}
+
+// ParseAnnouncementChunkData parses the data from a Join chunk sent from the host.
+func ParseAnnouncementChunkData(data []byte) (NodeId, error) {
+	if len(data) != 2 {
+		return 0, fmt.Errorf("announcement chunk has length %d, expected 2", len(data))
+	}
+	var node NodeId
+	ConsumeNodeId(data, &node)
+	return node, nil
+}
+
+// LeaveReason says why a node left the sluice.
+type LeaveReason uint8
+
+const (
+	// LeaveClosed means the node chose to leave.
+	LeaveClosed LeaveReason = iota
+
+	// LeaveTimeout means nothing was heard from the node for too long.
+	LeaveTimeout
+
+	// LeaveShutdown means the host shut down.
+	LeaveShutdown
+
+	// LeaveKicked means the host removed the node, either because the host's operator asked it to or
+	// for something like sending chunks that claim to be from another node.
+	LeaveKicked
+)
+
+func (r LeaveReason) String() string {
+	switch r {
+	case LeaveClosed:
+		return "closed"
+	case LeaveTimeout:
+		return "timed out"
+	case LeaveShutdown:
+		return "shut down"
+	case LeaveKicked:
+		return "kicked"
+	default:
+		return fmt.Sprintf("LeaveReason(%d)", uint8(r))
+	}
+}
+
+// MakeLeaveChunkData serializes the data in a Leave chunk, which says that node left and why.  A
+// client sends one to the host when it leaves, and the host sends one to every client when any node
+// leaves, including itself when it shuts down.
+func MakeLeaveChunkData(node NodeId, reason LeaveReason) []byte {
+	return AppendUint8(AppendNodeId(nil, node), uint8(reason))
+}
+
+// MakeHostLeaveChunkData serializes the data in a Leave chunk that the host sends to a client when
+// it stops talking to it, with a message for the client about why.  Messages longer than
+// maxReasonSize are cut short.
+func MakeHostLeaveChunkData(reason LeaveReason, message string) []byte {
+	if len(message) > maxReasonSize {
+		message = message[0:maxReasonSize]
+	}
+	return AppendStringWithLength(MakeLeaveChunkData(HostNodeId, reason), message)
+}
+
+// ParseLeaveChunkData parses the data from a Leave chunk.  Any message is ignored, ParseLeaveMessage
+// returns it.
+func ParseLeaveChunkData(data []byte) (NodeId, LeaveReason, error) {
+	if len(data) < 3 {
+		return 0, 0, fmt.Errorf("leave chunk has length %d, expected at least 3", len(data))
+	}
+	var node NodeId
+	data = ConsumeNodeId(data, &node)
+	return node, LeaveReason(data[0]), nil
+}
+
+// ParseLeaveMessage returns the message in a Leave chunk from MakeHostLeaveChunkData, or an empty
+// string if it doesn't have one.
+func ParseLeaveMessage(data []byte) string {
+	if len(data) <= 3 {
+		return ""
+	}
+	var message string
+	if _, err := ConsumeStringWithLength(data[3:], &message); err != nil {
+		return ""
+	}
+	return message
+}
+
+// MakeDingChunkData serializes the data in a Ding chunk, which tells a client to send a Dang chunk
+// to node at addr.
+func MakeDingChunkData(node NodeId, addr string) []byte {
+	data := AppendNodeId(nil, node)
+	return AppendStringWithLength(data, addr)
+}
+
+// ParseDingChunkData parses the data from a Ding chunk.
+func ParseDingChunkData(data []byte) (node NodeId, addr string, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("unexpected parse error while parsing a ding chunk: %q", r)
+		}
+	}()
+	data = ConsumeNodeId(data, &node)
+	data, err = ConsumeStringWithLength(data, &addr)
+	if err == nil && len(data) > 0 {
+		err = fmt.Errorf("ding chunk has %d extra bytes", len(data))
+	}
+	return node, addr, err
+}
+
+// Punch is sent from the host to both clients on a link to start or stop sending broadcast chunks
+// directly to each other.
+type Punch struct {
+	// Start is true if the clients should start sending directly to each other, and false if they
+	// should stop.
+	Start bool
+
+	// Node is the other client, and Addr is the address it can be reached at.
+	Node NodeId
+	Addr string
+}
+
+// MakePunchChunkData serializes p.
+func MakePunchChunkData(p *Punch) []byte {
+	data := AppendBool(nil, p.Start)
+	data = AppendNodeId(data, p.Node)
+	return AppendStringWithLength(data, p.Addr)
+}
+
+// ParsePunchChunkData parses the data from a Punch chunk.
+func ParsePunchChunkData(data []byte) (p *Punch, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			p = nil
+			err = fmt.Errorf("unexpected parse error while parsing a punch chunk: %q", r)
+		}
+	}()
+	p = &Punch{}
+	data = ConsumeBool(data, &p.Start)
+	data = ConsumeNodeId(data, &p.Node)
+	data, err = ConsumeStringWithLength(data, &p.Addr)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > 0 {
+		return nil, fmt.Errorf("punch chunk has %d extra bytes", len(data))
+	}
+	return p, nil
+}
+
+// StatsVersion is the version of the stats chunk format written by MakeStatsChunkDatas.
+const StatsVersion = 1
+
+// statsHeaderSize is the number of bytes at the start of each stats chunk before its entries, and
+// statsEntrySize is the size of each entry in the current version.
+const (
+	statsHeaderSize = 4
+	statsEntrySize  = 12
+)
+
+// PeerStats is what a client has measured about its connection to another node.
+type PeerStats struct {
+	Node NodeId
+
+	// RTT and Jitter are the smoothed round trip time and its variance.  They are zero if the client
+	// doesn't ping Node.
+	RTT    time.Duration
+	Jitter time.Duration
+
+	// Loss is the fraction of chunks from Node that never arrived, from 0 to 1.
+	Loss float64
+}
+
+// MakeStatsChunkDatas serializes stats into one or more chunks.  Each chunk starts with the format
+// version and the size of each entry, so that a host can read the fields it knows about from stats
+// sent by a newer client.  Each entry is <NodeId, RTT, Jitter, Loss>, with times in microseconds and
+// loss in 65535ths.
+func MakeStatsChunkDatas(config *Config, stats []PeerStats) [][]byte {
+	header := func() []byte {
+		data := AppendUint16(nil, StatsVersion)
+		return AppendUint16(data, statsEntrySize)
+	}
+	var ret [][]byte
+	current := header()
+	for _, s := range stats {
+		if len(current)+statsEntrySize > config.MaxChunkDataSize && len(current) > statsHeaderSize {
+			ret = append(ret, current)
+			current = header()
+		}
+		current = AppendNodeId(current, s.Node)
+		current = AppendUint32(current, uint32(s.RTT/time.Microsecond))
+		current = AppendUint32(current, uint32(s.Jitter/time.Microsecond))
+		current = AppendUint16(current, uint16(s.Loss*65535+0.5))
+	}
+	return append(ret, current)
+}
+
+// ParseStatsChunkData parses a single stats chunk.
+func ParseStatsChunkData(data []byte) (stats []PeerStats, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			stats = nil
+			err = fmt.Errorf("unexpected parse error while parsing a stats chunk: %q", r)
+		}
+	}()
+	var version, entrySize uint16
+	data = ConsumeUint16(data, &version)
+	data = ConsumeUint16(data, &entrySize)
+	if version < 1 || entrySize < statsEntrySize {
+		return nil, fmt.Errorf("unsupported stats chunk version %d with entries of size %d", version, entrySize)
+	}
+	if len(data)%int(entrySize) != 0 {
+		return nil, fmt.Errorf("stats chunk has %d bytes of entries, which isn't a multiple of %d", len(data), entrySize)
+	}
+	for len(data) > 0 {
+		var s PeerStats
+		var rtt, jitter uint32
+		var loss uint16
+		entry := data[0:int(entrySize)]
+		data = data[int(entrySize):]
+		entry = ConsumeNodeId(entry, &s.Node)
+		entry = ConsumeUint32(entry, &rtt)
+		entry = ConsumeUint32(entry, &jitter)
+		ConsumeUint16(entry, &loss)
+		s.RTT = time.Duration(rtt) * time.Microsecond
+		s.Jitter = time.Duration(jitter) * time.Microsecond
+		s.Loss = float64(loss) / 65535
+		stats = append(stats, s)
+	}
+	return stats, nil
+}
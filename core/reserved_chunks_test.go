@@ -1,8 +1,11 @@
 package core_test
 
 import (
+	"fmt"
 	"testing"
+	"time"
 
+	"github.com/runningwild/clock"
 	"github.com/runningwild/sluice/core"
 	. "github.com/smartystreets/goconvey/convey"
 )
@@ -122,3 +125,363 @@ func TestPositionChunks(t *testing.T) {
 		So(err, ShouldNotBeNil)
 	})
 }
+
+func TestWelcomeChunks(t *testing.T) {
+	w := &core.Welcome{
+		Node:    12,
+		Session: core.SessionToken{1, 2, 3, 4, 5, 6, 7, 8},
+		Version: 3,
+		Starts:  make(map[core.Streamlet]core.SequenceId),
+	}
+	for i := 1; i < 10; i++ {
+		w.Starts[core.Streamlet{core.StreamId(i), core.NodeId(i + 1)}] = core.SequenceId(i + 2)
+	}
+	Convey("The data that comes out of a welcome chunk is the same as the data that went into it.", t, func() {
+		var config core.Config
+		config.MaxChunkDataSize = 10000
+		datas := core.MakeWelcomeChunkDatas(&config, w)
+		So(len(datas), ShouldEqual, 1)
+		parsed, total, err := core.ParseWelcomeChunkData(datas[0])
+		So(err, ShouldBeNil)
+		So(total, ShouldEqual, len(w.Starts))
+		So(parsed, ShouldResemble, w)
+	})
+	Convey("Welcome data can be split across multiple chunks.", t, func() {
+		var config core.Config
+		config.MaxChunkDataSize = 25
+		datas := core.MakeWelcomeChunkDatas(&config, w)
+		So(len(datas), ShouldBeGreaterThan, 1)
+		merged := make(map[core.Streamlet]core.SequenceId)
+		for _, data := range datas {
+			So(len(data), ShouldBeLessThanOrEqualTo, config.MaxChunkDataSize)
+			parsed, total, err := core.ParseWelcomeChunkData(data)
+			So(err, ShouldBeNil)
+			So(total, ShouldEqual, len(w.Starts))
+			So(parsed.Node, ShouldEqual, w.Node)
+			So(parsed.Session, ShouldEqual, w.Session)
+			So(parsed.Version, ShouldEqual, w.Version)
+			for sl, sequence := range parsed.Starts {
+				merged[sl] = sequence
+			}
+		}
+		So(merged, ShouldResemble, w.Starts)
+	})
+	Convey("A welcome with no starts still makes a chunk.", t, func() {
+		var config core.Config
+		config.MaxChunkDataSize = 25
+		datas := core.MakeWelcomeChunkDatas(&config, &core.Welcome{Node: 3})
+		So(len(datas), ShouldEqual, 1)
+		parsed, total, err := core.ParseWelcomeChunkData(datas[0])
+		So(err, ShouldBeNil)
+		So(total, ShouldEqual, 0)
+		So(parsed.Node, ShouldEqual, 3)
+	})
+	Convey("Malformed welcome chunks return errors.", t, func() {
+		_, _, err := core.ParseWelcomeChunkData([]byte{1, 2, 3})
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestGlobalConfigChunks(t *testing.T) {
+	g := &core.GlobalConfig{
+		Streams:          make(map[core.StreamId]core.StreamConfig),
+		MaxChunkDataSize: 1000,
+		PositionChunkMin: 10 * time.Millisecond,
+		PositionChunkMax: 250 * time.Millisecond,
+		MaxUnreliableAge: 25,
+		Confirmation:     50 * time.Millisecond,
+		Ping:             time.Second,
+		Stats:            2 * time.Second,
+		Keepalive:        3 * time.Second,
+		Timeout:          10 * time.Second,
+		Ding:             500 * time.Millisecond,
+	}
+	for i := 1; i < 10; i++ {
+		id := core.StreamId(i)
+		g.Streams[id] = core.StreamConfig{
+			Name:      fmt.Sprintf("stream %d", i),
+			Id:        id,
+			Mode:      core.Mode(i % int(core.ModeMax)),
+			Broadcast: i%2 == 0,
+		}
+	}
+	Convey("The data that comes out of a global config chunk is the same as the data that went into it.", t, func() {
+		var config core.Config
+		config.MaxChunkDataSize = 10000
+		datas := core.MakeGlobalConfigChunkDatas(&config, g)
+		So(len(datas), ShouldEqual, 1)
+		parsed, total, err := core.ParseGlobalConfigChunkData(datas[0])
+		So(err, ShouldBeNil)
+		So(total, ShouldEqual, len(g.Streams))
+		So(parsed, ShouldResemble, g)
+	})
+	Convey("The clock and the key aren't sent.", t, func() {
+		var config core.Config
+		config.MaxChunkDataSize = 10000
+		keyed := *g
+		keyed.Key = []byte("0123456789abcdef")
+		keyed.Clock = &clock.FakeClock{}
+		parsed, _, err := core.ParseGlobalConfigChunkData(core.MakeGlobalConfigChunkDatas(&config, &keyed)[0])
+		So(err, ShouldBeNil)
+		So(parsed, ShouldResemble, g)
+	})
+	Convey("Global config data can be split across multiple chunks.", t, func() {
+		var config core.Config
+		config.MaxChunkDataSize = 100
+		datas := core.MakeGlobalConfigChunkDatas(&config, g)
+		So(len(datas), ShouldBeGreaterThan, 1)
+		merged := make(map[core.StreamId]core.StreamConfig)
+		for _, data := range datas {
+			So(len(data), ShouldBeLessThanOrEqualTo, config.MaxChunkDataSize)
+			parsed, total, err := core.ParseGlobalConfigChunkData(data)
+			So(err, ShouldBeNil)
+			So(total, ShouldEqual, len(g.Streams))
+			So(parsed.Timeout, ShouldEqual, g.Timeout)
+			for id, stream := range parsed.Streams {
+				merged[id] = stream
+			}
+		}
+		So(merged, ShouldResemble, g.Streams)
+	})
+	Convey("Malformed global config chunks return errors.", t, func() {
+		datas := core.MakeGlobalConfigChunkDatas(&core.Config{GlobalConfig: *g}, g)
+		_, _, err := core.ParseGlobalConfigChunkData(datas[0][0:10])
+		So(err, ShouldNotBeNil)
+		_, _, err = core.ParseGlobalConfigChunkData(datas[0][0 : len(datas[0])-1])
+		So(err, ShouldNotBeNil)
+	})
+	Convey("Global config chunks with streams in unknown modes return errors.", t, func() {
+		unknown := &core.GlobalConfig{
+			Streams:          map[core.StreamId]core.StreamConfig{1: {Name: "unknown", Id: 1, Mode: core.ModeMax}},
+			MaxChunkDataSize: 1000,
+		}
+		datas := core.MakeGlobalConfigChunkDatas(&core.Config{GlobalConfig: *unknown}, unknown)
+		_, _, err := core.ParseGlobalConfigChunkData(datas[0])
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestJoinChunks(t *testing.T) {
+	Convey("The request that comes out of a join chunk is the same as the one that went into it.", t, func() {
+		r := &core.JoinRequest{
+			Versions:    core.VersionRange{Min: 2, Max: 5},
+			Cookie:      make([]byte, core.CookieSize),
+			Ephemeral:   make([]byte, core.PublicKeySize),
+			Fingerprint: make([]byte, core.FingerprintSize),
+			AppVersion:  "1.2.3",
+			Data:        []byte("ticket"),
+		}
+		for i := range r.Cookie {
+			r.Cookie[i] = byte(i)
+		}
+		for i := range r.Ephemeral {
+			r.Ephemeral[i] = byte(100 + i)
+		}
+		for i := range r.Fingerprint {
+			r.Fingerprint[i] = byte(200 + i)
+		}
+		parsed, err := core.ParseJoinChunkData(core.MakeJoinChunkData(r))
+		So(err, ShouldBeNil)
+		So(parsed, ShouldResemble, r)
+	})
+	Convey("Join chunks without a cookie are padded to the same size as ones with a cookie.", t, func() {
+		data := core.MakeJoinChunkData(&core.JoinRequest{})
+		So(len(data), ShouldEqual, len(core.MakeJoinChunkData(&core.JoinRequest{Cookie: make([]byte, core.CookieSize)})))
+		parsed, err := core.ParseJoinChunkData(data)
+		So(err, ShouldBeNil)
+		So(len(parsed.Cookie), ShouldEqual, 0)
+		So(len(parsed.Ephemeral), ShouldEqual, 0)
+		So(len(parsed.Fingerprint), ShouldEqual, 0)
+		So(parsed.AppVersion, ShouldEqual, "")
+		So(len(parsed.Data), ShouldEqual, 0)
+	})
+	Convey("Malformed join chunks return errors.", t, func() {
+		_, err := core.ParseJoinChunkData(nil)
+		So(err, ShouldNotBeNil)
+		data := core.MakeJoinChunkData(&core.JoinRequest{})
+		data[2] = 100
+		_, err = core.ParseJoinChunkData(data)
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestRefuseChunks(t *testing.T) {
+	Convey("The reason that comes out of a refuse chunk is the same as the one that went into it.", t, func() {
+		reason, err := core.ParseRefuseChunkData(core.MakeRefuseChunkData("bad ticket"))
+		So(err, ShouldBeNil)
+		So(reason, ShouldEqual, "bad ticket")
+	})
+	Convey("Long reasons are cut short.", t, func() {
+		long := make([]byte, 10000)
+		for i := range long {
+			long[i] = 'a'
+		}
+		reason, err := core.ParseRefuseChunkData(core.MakeRefuseChunkData(string(long)))
+		So(err, ShouldBeNil)
+		So(len(reason), ShouldBeLessThan, 1000)
+	})
+	Convey("Malformed refuse chunks return errors.", t, func() {
+		_, err := core.ParseRefuseChunkData([]byte{0, 10, 'a'})
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestHandshakeChunks(t *testing.T) {
+	Convey("The keys that come out of a handshake chunk are the same as the ones that went into it.", t, func() {
+		h := &core.Handshake{HostKey: make([]byte, core.PublicKeySize), Ephemeral: make([]byte, core.PublicKeySize)}
+		for i := range h.HostKey {
+			h.HostKey[i] = byte(i)
+			h.Ephemeral[i] = byte(100 + i)
+		}
+		parsed, err := core.ParseHandshakeChunkData(core.MakeHandshakeChunkData(h))
+		So(err, ShouldBeNil)
+		So(parsed, ShouldResemble, h)
+	})
+	Convey("Malformed handshake chunks return errors.", t, func() {
+		_, err := core.ParseHandshakeChunkData(make([]byte, core.PublicKeySize))
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestResumeChunks(t *testing.T) {
+	Convey("The data that comes out of a resume chunk is the same as the data that went into it.", t, func() {
+		r := &core.Resume{Node: 12, Session: core.SessionToken{8, 7, 6, 5, 4, 3, 2, 1}}
+		parsed, err := core.ParseResumeChunkData(core.MakeResumeChunkData(r))
+		So(err, ShouldBeNil)
+		So(parsed, ShouldResemble, r)
+	})
+	Convey("Malformed resume chunks return errors.", t, func() {
+		_, err := core.ParseResumeChunkData([]byte{1, 2, 3})
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestAnnouncementChunks(t *testing.T) {
+	Convey("Announcement chunks can be parsed.", t, func() {
+		node, err := core.ParseAnnouncementChunkData(core.MakeAnnouncementChunkData(123))
+		So(err, ShouldBeNil)
+		So(node, ShouldEqual, 123)
+	})
+	Convey("Malformed announcement chunks return errors.", t, func() {
+		_, err := core.ParseAnnouncementChunkData([]byte{1})
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestLeaveChunks(t *testing.T) {
+	Convey("Leave chunks can be parsed.", t, func() {
+		node, reason, err := core.ParseLeaveChunkData(core.MakeLeaveChunkData(123, core.LeaveShutdown))
+		So(err, ShouldBeNil)
+		So(node, ShouldEqual, 123)
+		So(reason, ShouldEqual, core.LeaveShutdown)
+		So(core.LeaveKicked.String(), ShouldEqual, "kicked")
+		So(core.ParseLeaveMessage(core.MakeLeaveChunkData(123, core.LeaveShutdown)), ShouldEqual, "")
+	})
+	Convey("Leave chunks from the host can have a message.", t, func() {
+		data := core.MakeHostLeaveChunkData(core.LeaveKicked, "be nice")
+		node, reason, err := core.ParseLeaveChunkData(data)
+		So(err, ShouldBeNil)
+		So(node, ShouldEqual, core.HostNodeId)
+		So(reason, ShouldEqual, core.LeaveKicked)
+		So(core.ParseLeaveMessage(data), ShouldEqual, "be nice")
+		So(core.ParseLeaveMessage(data[0:5]), ShouldEqual, "")
+	})
+	Convey("Malformed leave chunks return errors.", t, func() {
+		_, _, err := core.ParseLeaveChunkData(core.MakeAnnouncementChunkData(123))
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestDingChunks(t *testing.T) {
+	Convey("The data that comes out of a ding chunk is the same as the data that went into it.", t, func() {
+		node, addr, err := core.ParseDingChunkData(core.MakeDingChunkData(12, "127.0.0.1:1234"))
+		So(err, ShouldBeNil)
+		So(node, ShouldEqual, 12)
+		So(addr, ShouldEqual, "127.0.0.1:1234")
+	})
+	Convey("Malformed ding chunks return errors.", t, func() {
+		_, _, err := core.ParseDingChunkData([]byte{1})
+		So(err, ShouldNotBeNil)
+		_, _, err = core.ParseDingChunkData([]byte{1, 0, 10, 0, 'a'})
+		So(err, ShouldNotBeNil)
+		_, _, err = core.ParseDingChunkData(append(core.MakeDingChunkData(12, "addr"), 1))
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestPunchChunks(t *testing.T) {
+	Convey("The data that comes out of a punch chunk is the same as the data that went into it.", t, func() {
+		for _, p := range []*core.Punch{
+			&core.Punch{Start: true, Node: 12, Addr: "127.0.0.1:1234"},
+			&core.Punch{Start: false, Node: 13},
+		} {
+			parsed, err := core.ParsePunchChunkData(core.MakePunchChunkData(p))
+			So(err, ShouldBeNil)
+			So(parsed, ShouldResemble, p)
+		}
+	})
+	Convey("Malformed punch chunks return errors.", t, func() {
+		_, err := core.ParsePunchChunkData([]byte{1, 2})
+		So(err, ShouldNotBeNil)
+		_, err = core.ParsePunchChunkData(append(core.MakePunchChunkData(&core.Punch{Node: 3}), 1))
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestStatsChunks(t *testing.T) {
+	config := core.Config{GlobalConfig: core.GlobalConfig{MaxChunkDataSize: 50}}
+	stats := []core.PeerStats{
+		{Node: core.HostNodeId, RTT: 20 * time.Millisecond, Jitter: 3 * time.Millisecond, Loss: 0.25},
+		{Node: 3},
+		{Node: 4, RTT: 5 * time.Millisecond, Jitter: 1500 * time.Microsecond, Loss: 1},
+		{Node: 5, Loss: 0.5},
+		{Node: 6, RTT: time.Second},
+	}
+	Convey("The stats that come out of stats chunks are the same as the stats that went into them.", t, func() {
+		datas := core.MakeStatsChunkDatas(&config, stats)
+		So(len(datas), ShouldBeGreaterThan, 1)
+		var parsed []core.PeerStats
+		for _, data := range datas {
+			So(len(data), ShouldBeLessThanOrEqualTo, config.MaxChunkDataSize)
+			s, err := core.ParseStatsChunkData(data)
+			So(err, ShouldBeNil)
+			parsed = append(parsed, s...)
+		}
+		So(len(parsed), ShouldEqual, len(stats))
+		for i := range stats {
+			So(parsed[i].Node, ShouldEqual, stats[i].Node)
+			So(parsed[i].RTT, ShouldEqual, stats[i].RTT)
+			So(parsed[i].Jitter, ShouldEqual, stats[i].Jitter)
+			So(parsed[i].Loss, ShouldAlmostEqual, stats[i].Loss, 0.0001)
+		}
+	})
+	Convey("Stats chunks with no stats can be parsed.", t, func() {
+		datas := core.MakeStatsChunkDatas(&config, nil)
+		So(len(datas), ShouldEqual, 1)
+		parsed, err := core.ParseStatsChunkData(datas[0])
+		So(err, ShouldBeNil)
+		So(len(parsed), ShouldEqual, 0)
+	})
+	Convey("Stats chunks from a later version with larger entries can be parsed.", t, func() {
+		data := core.AppendUint16(nil, core.StatsVersion+1)
+		data = core.AppendUint16(data, 14)
+		data = core.AppendNodeId(data, 7)
+		data = core.AppendUint32(data, 2000)
+		data = core.AppendUint32(data, 1000)
+		data = core.AppendUint16(data, 0)
+		data = core.AppendUint16(data, 0xffff)
+		parsed, err := core.ParseStatsChunkData(data)
+		So(err, ShouldBeNil)
+		So(parsed, ShouldResemble, []core.PeerStats{{Node: 7, RTT: 2 * time.Millisecond, Jitter: time.Millisecond}})
+	})
+	Convey("Malformed stats chunks return errors.", t, func() {
+		_, err := core.ParseStatsChunkData([]byte{1})
+		So(err, ShouldNotBeNil)
+		_, err = core.ParseStatsChunkData(append(core.MakeStatsChunkDatas(&config, stats[0:1])[0], 1))
+		So(err, ShouldNotBeNil)
+		_, err = core.ParseStatsChunkData(core.AppendUint16(core.AppendUint16(nil, 0), 12))
+		So(err, ShouldNotBeNil)
+		_, err = core.ParseStatsChunkData(core.AppendUint16(core.AppendUint16(nil, 1), 4))
+		So(err, ShouldNotBeNil)
+	})
+}
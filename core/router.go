@@ -0,0 +1,93 @@
+package core
+
+// maxMissedDings is how many Dings in a row can go unanswered on a link before the host decides
+// that the clients can't reach each other directly.
+const maxMissedDings = 2
+
+// Router decides which pairs of clients should send broadcast chunks directly to each other rather
+// than through the host.  A pair of clients uses a direct route if the latency between them is
+// lower in both directions than going through the host, and if Dings between them are being
+// answered.  If a direct route stops working the clients go back to using the host.
+type Router struct {
+	rtts   *RTTTable
+	matrix *LatencyMatrix
+	prober *LatencyProber
+
+	// direct holds every pair of clients that is using a direct route.  The From of each Link is
+	// always the lower NodeId.
+	direct map[Link]bool
+}
+
+// MakeRouter returns a Router where every client goes through the host.
+func MakeRouter(rtts *RTTTable, matrix *LatencyMatrix, prober *LatencyProber) *Router {
+	return &Router{
+		rtts:   rtts,
+		matrix: matrix,
+		prober: prober,
+		direct: make(map[Link]bool),
+	}
+}
+
+// pair returns link with the lower NodeId as From.
+func pair(link Link) Link {
+	if link.From > link.To {
+		return Link{link.To, link.From}
+	}
+	return link
+}
+
+// Direct returns true if link.From sends broadcast chunks directly to link.To.
+func (r *Router) Direct(link Link) bool {
+	return r.direct[pair(link)]
+}
+
+// faster returns true if link is working, and is faster than going through the host.
+func (r *Router) faster(link Link) bool {
+	if r.prober.Missed(link) >= maxMissedDings {
+		return false
+	}
+	latency, ok := r.matrix.Get(link)
+	if !ok {
+		return false
+	}
+	fromRTT, ok := r.rtts.Get(link.From)
+	if !ok {
+		return false
+	}
+	toRTT, ok := r.rtts.Get(link.To)
+	if !ok {
+		return false
+	}
+	return latency.Smoothed < (fromRTT.Smoothed+toRTT.Smoothed)/2
+}
+
+// Update decides which pairs of nodes should use direct routes.  It returns the pairs that should
+// start using a direct route and the pairs that should stop.
+func (r *Router) Update(nodes []NodeId) (start, stop []Link) {
+	for i := range nodes {
+		for j := range nodes {
+			link := Link{nodes[i], nodes[j]}
+			if link.From >= link.To {
+				continue
+			}
+			want := r.faster(link) && r.faster(Link{link.To, link.From})
+			if want && !r.direct[link] {
+				r.direct[link] = true
+				start = append(start, link)
+			} else if !want && r.direct[link] {
+				delete(r.direct, link)
+				stop = append(stop, link)
+			}
+		}
+	}
+	return start, stop
+}
+
+// Remove forgets about any routes to or from node.
+func (r *Router) Remove(node NodeId) {
+	for link := range r.direct {
+		if link.From == node || link.To == node {
+			delete(r.direct, link)
+		}
+	}
+}
@@ -0,0 +1,78 @@
+package core_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/runningwild/clock"
+	"github.com/runningwild/sluice/core"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestRouter(t *testing.T) {
+	Convey("Router", t, func() {
+		fc := &clock.FakeClock{}
+		config := &core.Config{GlobalConfig: core.GlobalConfig{Clock: fc}}
+		rtts := core.MakeRTTTable()
+		matrix := core.MakeLatencyMatrix()
+		prober := core.MakeLatencyProber(config, rtts, matrix)
+		router := core.MakeRouter(rtts, matrix, prober)
+		nodes := []core.NodeId{2, 3, 4}
+		for _, node := range nodes {
+			rtts.Add(node, 40*time.Millisecond)
+		}
+
+		Convey("Sends everything through the host until it knows of something faster.", func() {
+			start, stop := router.Update(nodes)
+			So(len(start), ShouldEqual, 0)
+			So(len(stop), ShouldEqual, 0)
+			matrix.Add(core.Link{2, 3}, 10*time.Millisecond)
+			start, stop = router.Update(nodes)
+			So(len(start), ShouldEqual, 0)
+			So(router.Direct(core.Link{2, 3}), ShouldBeFalse)
+		})
+
+		Convey("Only uses a direct route if it is faster in both directions.", func() {
+			matrix.Add(core.Link{2, 3}, 10*time.Millisecond)
+			matrix.Add(core.Link{3, 2}, 10*time.Millisecond)
+			matrix.Add(core.Link{3, 4}, 10*time.Millisecond)
+			matrix.Add(core.Link{4, 3}, 50*time.Millisecond)
+			start, stop := router.Update(nodes)
+			So(start, ShouldResemble, []core.Link{{2, 3}})
+			So(len(stop), ShouldEqual, 0)
+			So(router.Direct(core.Link{2, 3}), ShouldBeTrue)
+			So(router.Direct(core.Link{3, 2}), ShouldBeTrue)
+			So(router.Direct(core.Link{3, 4}), ShouldBeFalse)
+
+			Convey("And only starts it once.", func() {
+				start, stop := router.Update(nodes)
+				So(len(start), ShouldEqual, 0)
+				So(len(stop), ShouldEqual, 0)
+			})
+
+			Convey("And stops it once it is no longer faster.", func() {
+				for i := 0; i < 20; i++ {
+					matrix.Add(core.Link{3, 2}, 100*time.Millisecond)
+				}
+				start, stop := router.Update(nodes)
+				So(len(start), ShouldEqual, 0)
+				So(stop, ShouldResemble, []core.Link{{2, 3}})
+				So(router.Direct(core.Link{2, 3}), ShouldBeFalse)
+			})
+
+			Convey("And stops it once Dings between them go unanswered.", func() {
+				for i := 0; i < 13; i++ {
+					prober.Ding(map[core.NodeId]string{2: "addr2", 3: "addr3"})
+				}
+				So(prober.Missed(core.Link{2, 3}), ShouldBeGreaterThanOrEqualTo, 2)
+				_, stop := router.Update(nodes)
+				So(stop, ShouldResemble, []core.Link{{2, 3}})
+			})
+
+			Convey("And forgets it when either client leaves.", func() {
+				router.Remove(3)
+				So(router.Direct(core.Link{2, 3}), ShouldBeFalse)
+			})
+		})
+	})
+}
@@ -0,0 +1,74 @@
+package core
+
+import (
+	"sync"
+	"time"
+)
+
+// RTT is an estimate of the round trip time between the host and a client.
+type RTT struct {
+	// Smoothed is a moving average of the round trip time.
+	Smoothed time.Duration
+
+	// Variance is a moving average of how far each sample was from Smoothed.
+	Variance time.Duration
+
+	// Samples is the number of samples the estimate is based on.
+	Samples int
+}
+
+// Add updates the estimate with a new sample, weighting it the same way TCP does (RFC 6298).
+func (r *RTT) Add(sample time.Duration) {
+	if r.Samples == 0 {
+		r.Smoothed = sample
+		r.Variance = sample / 2
+	} else {
+		diff := r.Smoothed - sample
+		if diff < 0 {
+			diff = -diff
+		}
+		r.Variance = (3*r.Variance + diff) / 4
+		r.Smoothed = (7*r.Smoothed + sample) / 8
+	}
+	r.Samples++
+}
+
+// Timeout returns how long to wait for a response before assuming that something was lost.
+func (r RTT) Timeout() time.Duration {
+	return r.Smoothed + 4*r.Variance
+}
+
+// RTTTable holds an RTT for every client.  It is safe to use from multiple goroutines.
+type RTTTable struct {
+	mu   sync.RWMutex
+	rtts map[NodeId]RTT
+}
+
+// MakeRTTTable returns an empty RTTTable.
+func MakeRTTTable() *RTTTable {
+	return &RTTTable{rtts: make(map[NodeId]RTT)}
+}
+
+// Add updates the RTT for node with a new sample.
+func (t *RTTTable) Add(node NodeId, sample time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	rtt := t.rtts[node]
+	rtt.Add(sample)
+	t.rtts[node] = rtt
+}
+
+// Get returns the RTT for node, and false if there haven't been any samples for it yet.
+func (t *RTTTable) Get(node NodeId) (RTT, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	rtt, ok := t.rtts[node]
+	return rtt, ok
+}
+
+// Remove forgets the RTT for node.
+func (t *RTTTable) Remove(node NodeId) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.rtts, node)
+}
@@ -0,0 +1,56 @@
+package core_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/runningwild/sluice/core"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestRTT(t *testing.T) {
+	Convey("RTT", t, func() {
+		var rtt core.RTT
+
+		Convey("Starts at the first sample, with half of it as the variance.", func() {
+			rtt.Add(100 * time.Millisecond)
+			So(rtt.Smoothed, ShouldEqual, 100*time.Millisecond)
+			So(rtt.Variance, ShouldEqual, 50*time.Millisecond)
+			So(rtt.Timeout(), ShouldEqual, 300*time.Millisecond)
+
+			Convey("Then moves slowly towards new samples.", func() {
+				rtt.Add(180 * time.Millisecond)
+				So(rtt.Smoothed, ShouldEqual, 110*time.Millisecond)
+				So(rtt.Variance, ShouldEqual, 57500*time.Microsecond)
+				So(rtt.Samples, ShouldEqual, 2)
+			})
+
+			Convey("Then settles on a steady round trip time.", func() {
+				for i := 0; i < 100; i++ {
+					rtt.Add(20 * time.Millisecond)
+				}
+				So(rtt.Smoothed, ShouldBeLessThan, 21*time.Millisecond)
+				So(rtt.Variance, ShouldBeLessThan, time.Millisecond)
+			})
+		})
+	})
+
+	Convey("RTTTable", t, func() {
+		table := core.MakeRTTTable()
+		_, ok := table.Get(5)
+		So(ok, ShouldBeFalse)
+
+		table.Add(5, 10*time.Millisecond)
+		table.Add(6, 20*time.Millisecond)
+		rtt, ok := table.Get(5)
+		So(ok, ShouldBeTrue)
+		So(rtt.Smoothed, ShouldEqual, 10*time.Millisecond)
+		rtt, ok = table.Get(6)
+		So(ok, ShouldBeTrue)
+		So(rtt.Smoothed, ShouldEqual, 20*time.Millisecond)
+
+		table.Remove(5)
+		_, ok = table.Get(5)
+		So(ok, ShouldBeFalse)
+	})
+}
@@ -0,0 +1,85 @@
+package core
+
+// StartTracker keeps track of the chunks the host has sent to every client on reliable broadcast
+// streams, so that a client that joins later knows which SequenceId to start at on each of those
+// streamlets.  Every such chunk must be passed to Add in the order it is sent, which is always in
+// order of SequenceId.
+type StartTracker struct {
+	config *Config
+
+	// starts is the SequenceId of the first chunk of the next packet on each streamlet that has not
+	// had any of its chunks sent yet.
+	starts map[Streamlet]SequenceId
+
+	// partial holds the chunks that have been sent from a packet that hasn't been completely sent.
+	partial map[Streamlet][]Chunk
+}
+
+// MakeStartTracker returns an empty StartTracker.
+func MakeStartTracker(config *Config) *StartTracker {
+	return &StartTracker{
+		config:  config,
+		starts:  make(map[Streamlet]SequenceId),
+		partial: make(map[Streamlet][]Chunk),
+	}
+}
+
+// Add records that chunk was sent to every client.  Chunks on streams that aren't reliable
+// broadcast streams are ignored.
+func (st *StartTracker) Add(chunk Chunk) {
+	stream := st.config.GetStreamConfigById(chunk.Stream)
+	if stream == nil || !stream.Broadcast || !stream.Mode.Reliable() {
+		return
+	}
+	sl := Streamlet{chunk.Stream, chunk.Source}
+
+	// A chunk is the last one in its packet if it wasn't split up, or if it isn't full.  WriterRoutine
+	// always adds an empty chunk to the end of a packet whose length is a multiple of the maximum
+	// chunk size to guarantee this.
+	if chunk.Subsequence == 0 || len(chunk.Data) < st.config.MaxChunkDataSize {
+		st.starts[sl] = chunk.Sequence + 1
+		delete(st.partial, sl)
+	} else {
+		st.partial[sl] = append(st.partial[sl], chunk)
+	}
+}
+
+// Starts returns the SequenceId that a newly joined client should start at on every reliable
+// broadcast streamlet that has been sent on.
+func (st *StartTracker) Starts() map[Streamlet]SequenceId {
+	starts := make(map[Streamlet]SequenceId)
+	for sl, sequence := range st.starts {
+		starts[sl] = sequence
+	}
+	for sl, chunks := range st.partial {
+		if _, ok := starts[sl]; !ok {
+			starts[sl] = chunks[0].SequenceStart()
+		}
+	}
+	return starts
+}
+
+// Partial returns all chunks that have been sent from packets that haven't been completely sent.
+// A newly joined client needs to be sent these chunks before any others so that it can receive
+// those packets.
+func (st *StartTracker) Partial() []Chunk {
+	var chunks []Chunk
+	for _, partial := range st.partial {
+		chunks = append(chunks, partial...)
+	}
+	return chunks
+}
+
+// Remove forgets everything about streamlets belonging to node.
+func (st *StartTracker) Remove(node NodeId) {
+	for sl := range st.starts {
+		if sl.Node == node {
+			delete(st.starts, sl)
+		}
+	}
+	for sl := range st.partial {
+		if sl.Node == node {
+			delete(st.partial, sl)
+		}
+	}
+}
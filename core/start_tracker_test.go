@@ -0,0 +1,93 @@
+package core_test
+
+import (
+	"testing"
+
+	"github.com/runningwild/sluice/core"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestStartTracker(t *testing.T) {
+	Convey("StartTracker", t, func() {
+		config := &core.Config{
+			GlobalConfig: core.GlobalConfig{
+				Streams: map[core.StreamId]core.StreamConfig{
+					7: core.StreamConfig{
+						Name:      "UB",
+						Id:        7,
+						Mode:      core.ModeUnreliableOrdered,
+						Broadcast: true,
+					},
+					9: core.StreamConfig{
+						Name: "RO",
+						Id:   9,
+						Mode: core.ModeReliableOrdered,
+					},
+					10: core.StreamConfig{
+						Name:      "RB",
+						Id:        10,
+						Mode:      core.ModeReliableOrdered,
+						Broadcast: true,
+					},
+				},
+				MaxChunkDataSize: 50,
+			},
+		}
+		st := core.MakeStartTracker(config)
+		stream := config.GetIdFromName("RB")
+
+		Convey("Starts empty.", func() {
+			So(len(st.Starts()), ShouldEqual, 0)
+			So(len(st.Partial()), ShouldEqual, 0)
+		})
+
+		Convey("Ignores chunks that aren't on reliable broadcast streams.", func() {
+			st.Add(makeSimpleChunk(config.GetIdFromName("UB"), 5, 1))
+			st.Add(makeSimpleChunk(config.GetIdFromName("RO"), 5, 1))
+			So(len(st.Starts()), ShouldEqual, 0)
+		})
+
+		Convey("Starts each streamlet after the last complete packet.", func() {
+			st.Add(makeSimpleChunk(stream, 5, 1))
+			st.Add(makeSimpleChunk(stream, 5, 2))
+			for _, chunk := range makeChunks(config, stream, 6, 1, 3) {
+				st.Add(chunk)
+			}
+			So(st.Starts(), ShouldResemble, map[core.Streamlet]core.SequenceId{
+				core.Streamlet{stream, 5}: 3,
+				core.Streamlet{stream, 6}: 4,
+			})
+			So(len(st.Partial()), ShouldEqual, 0)
+
+			Convey("And remembers partially sent packets.", func() {
+				chunks := makeChunks(config, stream, 5, 3, 4)
+				st.Add(chunks[0])
+				st.Add(chunks[1])
+				So(st.Starts()[core.Streamlet{stream, 5}], ShouldEqual, 3)
+				partial := st.Partial()
+				So(len(partial), ShouldEqual, 2)
+				So(partial[0].Sequence, ShouldEqual, 3)
+				So(partial[1].Sequence, ShouldEqual, 4)
+
+				st.Add(chunks[2])
+				st.Add(chunks[3])
+				So(st.Starts()[core.Streamlet{stream, 5}], ShouldEqual, 7)
+				So(len(st.Partial()), ShouldEqual, 0)
+			})
+
+			Convey("And forgets nodes that are removed.", func() {
+				st.Add(makeChunks(config, stream, 5, 3, 4)[0])
+				st.Remove(5)
+				So(st.Starts(), ShouldResemble, map[core.Streamlet]core.SequenceId{
+					core.Streamlet{stream, 6}: 4,
+				})
+				So(len(st.Partial()), ShouldEqual, 0)
+			})
+		})
+
+		Convey("Starts a streamlet at its first partially sent packet.", func() {
+			st.Add(makeChunks(config, stream, 5, 1, 4)[0])
+			So(st.Starts()[core.Streamlet{stream, 5}], ShouldEqual, 1)
+		})
+	})
+}
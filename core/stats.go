@@ -0,0 +1,220 @@
+package core
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// StatsCollector keeps track of what a client sees of the other nodes, so that it can report it to
+// the host in Stats chunks.  Round trip times come from pings the client sends itself, and loss comes
+// from gaps in the SequenceIds of the chunks that arrive from each node.  It is safe to use from
+// multiple goroutines.
+type StatsCollector struct {
+	config *Config
+	rtts   *RTTTable
+
+	mu sync.Mutex
+
+	// pings holds the time each recent ping to each node was sent, lastPing is the SequenceId of the
+	// most recent ping to each node.
+	pings    map[NodeId]map[SequenceId]time.Time
+	lastPing map[NodeId]SequenceId
+
+	// seen holds the SequenceIds of every chunk that has arrived on each streamlet since the last
+	// report.
+	seen map[Streamlet]map[SequenceId]bool
+}
+
+// MakeStatsCollector returns an empty StatsCollector.
+func MakeStatsCollector(config *Config) *StatsCollector {
+	return &StatsCollector{
+		config:   config,
+		rtts:     MakeRTTTable(),
+		pings:    make(map[NodeId]map[SequenceId]time.Time),
+		lastPing: make(map[NodeId]SequenceId),
+		seen:     make(map[Streamlet]map[SequenceId]bool),
+	}
+}
+
+// Ping returns a ping chunk that should be sent to node, and remembers when it was sent.
+func (s *StatsCollector) Ping(node NodeId) Chunk {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.pings[node] == nil {
+		s.pings[node] = make(map[SequenceId]time.Time)
+	}
+	s.lastPing[node]++
+	sequence := s.lastPing[node]
+	s.pings[node][sequence] = s.config.Clock.Now()
+	delete(s.pings[node], sequence-maxOutstandingPings)
+	return Chunk{
+		Stream:   StreamPing,
+		Source:   s.config.Node,
+		Target:   node,
+		Sequence: sequence,
+	}
+}
+
+// HandlePong records the time it took node to respond to one of our pings.
+func (s *StatsCollector) HandlePong(node NodeId, chunk Chunk) {
+	s.mu.Lock()
+	sent, ok := s.pings[node][chunk.Sequence]
+	delete(s.pings[node], chunk.Sequence)
+	s.mu.Unlock()
+	if ok {
+		s.rtts.Add(node, s.config.Clock.Now().Sub(sent))
+	}
+}
+
+// RTT returns the round trip time to node, and false if node hasn't answered any pings yet.
+func (s *StatsCollector) RTT(node NodeId) (RTT, bool) {
+	return s.rtts.Get(node)
+}
+
+// Received notes that chunk arrived.  Only chunks on user-defined streams count towards loss.
+func (s *StatsCollector) Received(chunk Chunk) {
+	if chunk.Stream.IsReserved() {
+		return
+	}
+	sl := Streamlet{chunk.Stream, chunk.Source}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.seen[sl] == nil {
+		s.seen[sl] = make(map[SequenceId]bool)
+	}
+	s.seen[sl][chunk.Sequence] = true
+}
+
+// Report returns the stats for every node that has been pinged or sent us anything, sorted by
+// NodeId.  Loss is worked out from the chunks that arrived since the previous report, assuming that
+// everything between the first and last chunk on each streamlet should have arrived.
+func (s *StatsCollector) Report() []PeerStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	expected := make(map[NodeId]int)
+	received := make(map[NodeId]int)
+	for sl, seen := range s.seen {
+		first, last := SequenceId(0), SequenceId(0)
+		for sequence := range seen {
+			if first == 0 || sequence < first {
+				first = sequence
+			}
+			if sequence > last {
+				last = sequence
+			}
+		}
+		expected[sl.Node] += int(last-first) + 1
+		received[sl.Node] += len(seen)
+	}
+	s.seen = make(map[Streamlet]map[SequenceId]bool)
+
+	nodes := make(map[NodeId]bool)
+	for node := range s.pings {
+		nodes[node] = true
+	}
+	for node := range expected {
+		nodes[node] = true
+	}
+	var stats []PeerStats
+	for node := range nodes {
+		peer := PeerStats{Node: node}
+		if rtt, ok := s.rtts.Get(node); ok {
+			peer.RTT = rtt.Smoothed
+			peer.Jitter = rtt.Variance
+		}
+		if expected[node] > 0 {
+			peer.Loss = 1 - float64(received[node])/float64(expected[node])
+		}
+		stats = append(stats, peer)
+	}
+	sort.Sort(peerStatsByNode(stats))
+	return stats
+}
+
+// Remove forgets everything about node.
+func (s *StatsCollector) Remove(node NodeId) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.pings, node)
+	delete(s.lastPing, node)
+	for sl := range s.seen {
+		if sl.Node == node {
+			delete(s.seen, sl)
+		}
+	}
+	s.rtts.Remove(node)
+}
+
+type peerStatsByNode []PeerStats
+
+func (p peerStatsByNode) Len() int           { return len(p) }
+func (p peerStatsByNode) Less(i, j int) bool { return p[i].Node < p[j].Node }
+func (p peerStatsByNode) Swap(i, j int)      { p[i], p[j] = p[j], p[i] }
+
+// StatsTable holds the most recent stats each client has reported about every other node.  It is
+// safe to use from multiple goroutines.
+type StatsTable struct {
+	mu    sync.RWMutex
+	stats map[NodeId]map[NodeId]PeerStats
+}
+
+// MakeStatsTable returns an empty StatsTable.
+func MakeStatsTable() *StatsTable {
+	return &StatsTable{stats: make(map[NodeId]map[NodeId]PeerStats)}
+}
+
+// Add records the stats in a Stats chunk that reporter sent.  A report may be split across several
+// chunks, so stats about nodes that aren't in the chunk are kept.
+func (t *StatsTable) Add(reporter NodeId, chunk Chunk) error {
+	stats, err := ParseStatsChunkData(chunk.Data)
+	if err != nil {
+		return err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.stats[reporter] == nil {
+		t.stats[reporter] = make(map[NodeId]PeerStats)
+	}
+	for _, peer := range stats {
+		t.stats[reporter][peer.Node] = peer
+	}
+	return nil
+}
+
+// Get returns the stats that reporter most recently reported, sorted by NodeId.
+func (t *StatsTable) Get(reporter NodeId) []PeerStats {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	return sortedPeerStats(t.stats[reporter])
+}
+
+// All returns a copy of the stats every client has reported, keyed by reporter.
+func (t *StatsTable) All() map[NodeId][]PeerStats {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	all := make(map[NodeId][]PeerStats)
+	for reporter, stats := range t.stats {
+		all[reporter] = sortedPeerStats(stats)
+	}
+	return all
+}
+
+func sortedPeerStats(stats map[NodeId]PeerStats) []PeerStats {
+	var sorted []PeerStats
+	for _, peer := range stats {
+		sorted = append(sorted, peer)
+	}
+	sort.Sort(peerStatsByNode(sorted))
+	return sorted
+}
+
+// Remove forgets the stats node reported, and everything other clients reported about it.
+func (t *StatsTable) Remove(node NodeId) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.stats, node)
+	for _, stats := range t.stats {
+		delete(stats, node)
+	}
+}
@@ -0,0 +1,117 @@
+package core_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/runningwild/clock"
+	"github.com/runningwild/sluice/core"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestStatsCollector(t *testing.T) {
+	Convey("StatsCollector", t, func() {
+		fc := &clock.FakeClock{}
+		config := &core.Config{
+			Node: 5,
+			GlobalConfig: core.GlobalConfig{
+				MaxChunkDataSize: 50,
+				Clock:            fc,
+			},
+		}
+		stats := core.MakeStatsCollector(config)
+
+		Convey("Starts empty.", func() {
+			So(len(stats.Report()), ShouldEqual, 0)
+			_, ok := stats.RTT(core.HostNodeId)
+			So(ok, ShouldBeFalse)
+		})
+
+		Convey("Measures round trip times with pings.", func() {
+			ping := stats.Ping(core.HostNodeId)
+			So(ping.Stream, ShouldEqual, core.StreamPing)
+			So(ping.Source, ShouldEqual, 5)
+			So(ping.Target, ShouldEqual, core.HostNodeId)
+			fc.Inc(20 * time.Millisecond)
+			stats.HandlePong(core.HostNodeId, core.Chunk{Stream: core.StreamPong, Sequence: ping.Sequence})
+
+			// Duplicate pongs, and pongs from the wrong node, are ignored.
+			stats.HandlePong(core.HostNodeId, core.Chunk{Stream: core.StreamPong, Sequence: ping.Sequence})
+			stats.HandlePong(7, core.Chunk{Stream: core.StreamPong, Sequence: ping.Sequence})
+
+			rtt, ok := stats.RTT(core.HostNodeId)
+			So(ok, ShouldBeTrue)
+			So(rtt.Samples, ShouldEqual, 1)
+			So(rtt.Smoothed, ShouldEqual, 20*time.Millisecond)
+			So(stats.Report(), ShouldResemble, []core.PeerStats{
+				{Node: core.HostNodeId, RTT: 20 * time.Millisecond, Jitter: 10 * time.Millisecond},
+			})
+		})
+
+		Convey("Measures loss from the chunks that arrive on each streamlet.", func() {
+			for _, sequence := range []core.SequenceId{1, 2, 4, 5} {
+				stats.Received(makeSimpleChunk(7, 3, sequence))
+			}
+			for _, sequence := range []core.SequenceId{10, 11, 11, 13} {
+				stats.Received(makeSimpleChunk(8, 3, sequence))
+			}
+			stats.Received(makeSimpleChunk(7, 4, 1))
+			stats.Received(core.Chunk{Stream: core.StreamPunch, Source: 6, Sequence: 1})
+			report := stats.Report()
+			So(len(report), ShouldEqual, 2)
+			So(report[0].Node, ShouldEqual, 3)
+			So(report[0].Loss, ShouldAlmostEqual, 2.0/9.0)
+			So(report[1].Node, ShouldEqual, 4)
+			So(report[1].Loss, ShouldEqual, 0)
+
+			Convey("And starts over after each report.", func() {
+				stats.Received(makeSimpleChunk(7, 3, 6))
+				So(stats.Report(), ShouldResemble, []core.PeerStats{{Node: 3}})
+			})
+
+			Convey("And forgets nodes that are removed.", func() {
+				stats.Received(makeSimpleChunk(7, 3, 6))
+				stats.Ping(3)
+				stats.Remove(3)
+				So(len(stats.Report()), ShouldEqual, 0)
+			})
+		})
+	})
+}
+
+func TestStatsTable(t *testing.T) {
+	Convey("StatsTable", t, func() {
+		config := &core.Config{GlobalConfig: core.GlobalConfig{MaxChunkDataSize: 50}}
+		table := core.MakeStatsTable()
+		report := func(reporter core.NodeId, stats ...core.PeerStats) {
+			for _, data := range core.MakeStatsChunkDatas(config, stats) {
+				So(table.Add(reporter, core.Chunk{Stream: core.StreamStats, Source: reporter, Data: data}), ShouldBeNil)
+			}
+		}
+		So(len(table.Get(2)), ShouldEqual, 0)
+
+		report(2, core.PeerStats{Node: core.HostNodeId, RTT: time.Millisecond}, core.PeerStats{Node: 3})
+		report(3, core.PeerStats{Node: core.HostNodeId, RTT: 2 * time.Millisecond})
+		So(table.Get(2), ShouldResemble, []core.PeerStats{{Node: core.HostNodeId, RTT: time.Millisecond}, {Node: 3}})
+		So(table.All(), ShouldResemble, map[core.NodeId][]core.PeerStats{
+			2: []core.PeerStats{{Node: core.HostNodeId, RTT: time.Millisecond}, {Node: 3}},
+			3: []core.PeerStats{{Node: core.HostNodeId, RTT: 2 * time.Millisecond}},
+		})
+
+		Convey("Newer reports replace older ones.", func() {
+			report(2, core.PeerStats{Node: core.HostNodeId, RTT: 3 * time.Millisecond})
+			So(table.Get(2), ShouldResemble, []core.PeerStats{{Node: core.HostNodeId, RTT: 3 * time.Millisecond}, {Node: 3}})
+		})
+
+		Convey("Malformed reports are errors.", func() {
+			So(table.Add(2, core.Chunk{Stream: core.StreamStats, Data: []byte{1}}), ShouldNotBeNil)
+		})
+
+		Convey("Removing a node forgets its reports and reports about it.", func() {
+			table.Remove(3)
+			So(table.All(), ShouldResemble, map[core.NodeId][]core.PeerStats{
+				2: []core.PeerStats{{Node: core.HostNodeId, RTT: time.Millisecond}},
+			})
+		})
+	})
+}
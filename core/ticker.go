@@ -0,0 +1,54 @@
+package core
+
+import (
+	"github.com/runningwild/clock"
+	"time"
+)
+
+// MakeTicker creates and returns a Ticker that ticks every period according to c.  Ticker.Stop()
+// should be called when it is no longer needed.
+func MakeTicker(period time.Duration, c clock.Clock) *Ticker {
+	ticks := make(chan time.Time, 1)
+	t := &Ticker{
+		C:    ticks,
+		stop: make(chan struct{}),
+	}
+	next := c.Now().Add(period)
+	go t.run(c, period, next, c.At(next), ticks)
+	return t
+}
+
+// Ticker is like a time.Ticker, but it ticks according to a clock.Clock, whose Tick can't be
+// stopped.  Like a time.Ticker, ticks are dropped if nobody is receiving them.
+type Ticker struct {
+	// C is sent the time of every tick.
+	C <-chan time.Time
+
+	stop chan struct{}
+}
+
+func (t *Ticker) run(c clock.Clock, period time.Duration, next time.Time, trigger <-chan time.Time, ticks chan<- time.Time) {
+	for {
+		select {
+		case now := <-trigger:
+			for !next.After(now) {
+				next = next.Add(period)
+			}
+			// The next tick is set up before this one is sent so that nobody can see this one
+			// without the next one already being on its way.
+			trigger = c.At(next)
+			select {
+			case ticks <- now:
+			default:
+			}
+
+		case <-t.stop:
+			return
+		}
+	}
+}
+
+// Stop shuts down the Ticker and cleans up the associated goroutine.  C is not closed.
+func (t *Ticker) Stop() {
+	close(t.stop)
+}
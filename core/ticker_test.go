@@ -0,0 +1,42 @@
+package core_test
+
+import (
+	"time"
+
+	"github.com/runningwild/clock"
+	"github.com/runningwild/sluice/core"
+	. "github.com/smartystreets/goconvey/convey"
+	"testing"
+)
+
+func TestTicker(t *testing.T) {
+	Convey("Ticker", t, func() {
+		fc := &clock.FakeClock{}
+		fc.Inc(time.Millisecond)
+		ticker := core.MakeTicker(10*time.Millisecond, fc)
+
+		Convey("Ticks every period.", func() {
+			defer ticker.Stop()
+			select {
+			case <-ticker.C:
+				So("ticked early", ShouldBeNil)
+			default:
+			}
+			for i := 0; i < 3; i++ {
+				fc.Inc(10 * time.Millisecond)
+				So(<-ticker.C, ShouldEqual, fc.Now())
+			}
+		})
+
+		Convey("Doesn't tick after it is stopped.", func() {
+			ticker.Stop()
+			time.Sleep(time.Millisecond)
+			fc.Inc(10 * time.Millisecond)
+			select {
+			case <-ticker.C:
+				So("ticked after Stop", ShouldBeNil)
+			case <-time.After(10 * time.Millisecond):
+			}
+		})
+	})
+}
@@ -10,6 +10,15 @@ func ConsumeBool(data []byte, payload *bool) []byte {
 	return data[1:]
 }
 
+// ConsumeUint64 consumes a uint64 payload from the front of data and returns data.
+func ConsumeUint64(data []byte, payload *uint64) []byte {
+	var low, high uint32
+	data = ConsumeUint32(data, &low)
+	data = ConsumeUint32(data, &high)
+	*payload = uint64(high)<<32 | uint64(low)
+	return data
+}
+
 // ConsumeUint32 consumes a uint32 payload from the front of data and returns data.
 func ConsumeUint32(data []byte, payload *uint32) []byte {
 	*payload = (uint32(data[3]) << 24) | (uint32(data[2]) << 16) | (uint32(data[1]) << 8) | uint32(data[0])
@@ -93,6 +102,11 @@ func AppendBool(data []byte, payload bool) []byte {
 	return append(data, 0)
 }
 
+// AppendUint64 appends a uint64 payload to data and returns data.
+func AppendUint64(data []byte, payload uint64) []byte {
+	return AppendUint32(AppendUint32(data, uint32(payload)), uint32(payload>>32))
+}
+
 // AppendUint32 appends a uint32 payload to data and returns data.
 func AppendUint32(data []byte, payload uint32) []byte {
 	data = append(data, byte(payload&0xff))
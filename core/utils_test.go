@@ -63,6 +63,24 @@ func TestSerialization(t *testing.T) {
 		})
 	})
 
+	Convey("Encoding uint64s", t, func() {
+		var data []byte
+		input := []uint64{0, 1, 2, 65535, 1 << 31, 1 << 32, 1<<32 + 1, 1 << 63, (1<<7 | 1<<23 | 1<<39 | 1<<63)}
+		for _, payload := range input {
+			data = core.AppendUint64(data, payload)
+		}
+
+		var payload uint64
+		for _, expected := range input {
+			data = core.ConsumeUint64(data, &payload)
+			So(payload, ShouldEqual, expected)
+		}
+
+		Convey("All of the data should have been consumed", func() {
+			So(len(data), ShouldEqual, 0)
+		})
+	})
+
 	Convey("Encoding strings", t, func() {
 		var data []byte
 		input := []string{"", "thunder", "foo bar wing ding monkey ball"}
@@ -0,0 +1,114 @@
+package core
+
+import (
+	"fmt"
+)
+
+// ProtocolMagic is the first thing in every sluice datagram.
+const ProtocolMagic uint16 = 0x51ce
+
+// ProtocolVersion identifies a version of the wire format.  Everything in a datagram after its
+// preamble can change from one version to the next, but the preamble, which is ProtocolMagic
+// followed by the ProtocolVersion the datagram was framed with, and version rejections never will.
+type ProtocolVersion uint8
+
+// preambleSize is the number of bytes in the preamble at the start of every datagram.
+const preambleSize = 3
+
+// VersionRange is a range of ProtocolVersions, including both Min and Max.
+type VersionRange struct {
+	Min ProtocolVersion
+	Max ProtocolVersion
+}
+
+// SupportedVersions are the ProtocolVersions that this code speaks.
+var SupportedVersions = VersionRange{Min: 1, Max: 1}
+
+// Contains returns true if v is in r.
+func (r VersionRange) Contains(v ProtocolVersion) bool {
+	return r.Min <= v && v <= r.Max
+}
+
+// Negotiate returns the highest ProtocolVersion in both r and other, or false if there isn't one.
+func (r VersionRange) Negotiate(other VersionRange) (ProtocolVersion, bool) {
+	v := r.Max
+	if other.Max < v {
+		v = other.Max
+	}
+	if !r.Contains(v) || !other.Contains(v) {
+		return 0, false
+	}
+	return v, true
+}
+
+func (r VersionRange) String() string {
+	if r.Min == r.Max {
+		return fmt.Sprintf("version %d", r.Min)
+	}
+	return fmt.Sprintf("versions %d to %d", r.Min, r.Max)
+}
+
+// VersionError is returned for a datagram from a peer that doesn't speak any of the same
+// ProtocolVersions as we do.
+type VersionError struct {
+	// Ours is what we speak, and Theirs is what the peer speaks, as far as we can tell.
+	Ours   VersionRange
+	Theirs VersionRange
+}
+
+func (e *VersionError) Error() string {
+	return fmt.Sprintf("incompatible sluice protocol: we speak %v, the peer speaks %v", e.Ours, e.Theirs)
+}
+
+// CheckPreamble returns an error if datagram doesn't start with a preamble, and a *VersionError if
+// it does but is framed with a ProtocolVersion that isn't in SupportedVersions.
+func CheckPreamble(datagram []byte) error {
+	if len(datagram) < preambleSize {
+		return fmt.Errorf("datagram is only %d bytes", len(datagram))
+	}
+	var magic uint16
+	ConsumeUint16(datagram, &magic)
+	if magic != ProtocolMagic {
+		return fmt.Errorf("datagram doesn't start with the sluice magic")
+	}
+	if v := ProtocolVersion(datagram[2]); !SupportedVersions.Contains(v) {
+		return &VersionError{Ours: SupportedVersions, Theirs: VersionRange{Min: v, Max: v}}
+	}
+	return nil
+}
+
+// appendPreamble appends the preamble of a datagram framed with version to buf.
+func appendPreamble(buf []byte, version ProtocolVersion) []byte {
+	buf = AppendUint16(buf, ProtocolMagic)
+	return append(buf, byte(version))
+}
+
+// versionRejectionSize is the number of bytes in a version rejection.
+const versionRejectionSize = preambleSize + 2
+
+// MakeVersionRejection returns the datagram sent to a peer that framed a datagram with a
+// ProtocolVersion we don't speak.  It is a preamble with version 0, which no datagram is ever framed
+// with, followed by SupportedVersions.  It isn't protected in any way, since the peer can't be
+// expected to know how we would protect it.  It is small enough that it is never bigger than the
+// datagram it answers.
+func MakeVersionRejection() []byte {
+	buf := appendPreamble(nil, 0)
+	return append(buf, byte(SupportedVersions.Min), byte(SupportedVersions.Max))
+}
+
+// ParseVersionRejection returns the VersionRange in datagram if it is a version rejection.
+func ParseVersionRejection(datagram []byte) (VersionRange, bool) {
+	if len(datagram) != versionRejectionSize {
+		return VersionRange{}, false
+	}
+	var magic uint16
+	ConsumeUint16(datagram, &magic)
+	if magic != ProtocolMagic || datagram[2] != 0 {
+		return VersionRange{}, false
+	}
+	r := VersionRange{Min: ProtocolVersion(datagram[3]), Max: ProtocolVersion(datagram[4])}
+	if r.Min == 0 || r.Max < r.Min {
+		return VersionRange{}, false
+	}
+	return r, true
+}
@@ -0,0 +1,97 @@
+package core_test
+
+import (
+	"testing"
+
+	"github.com/runningwild/sluice/core"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestVersions(t *testing.T) {
+	Convey("Negotiate picks the highest version in both ranges.", t, func() {
+		v, ok := core.VersionRange{Min: 1, Max: 4}.Negotiate(core.VersionRange{Min: 2, Max: 3})
+		So(ok, ShouldBeTrue)
+		So(v, ShouldEqual, core.ProtocolVersion(3))
+		v, ok = core.VersionRange{Min: 3, Max: 5}.Negotiate(core.VersionRange{Min: 1, Max: 7})
+		So(ok, ShouldBeTrue)
+		So(v, ShouldEqual, core.ProtocolVersion(5))
+		_, ok = core.VersionRange{Min: 1, Max: 2}.Negotiate(core.VersionRange{Min: 3, Max: 4})
+		So(ok, ShouldBeFalse)
+		_, ok = core.VersionRange{Min: 3, Max: 4}.Negotiate(core.VersionRange{Min: 1, Max: 2})
+		So(ok, ShouldBeFalse)
+	})
+
+	Convey("Every datagram starts with a preamble.", t, func() {
+		var recorder datagramRecorder
+		core.WriteChunks([]core.Chunk{{Stream: 5, Data: []byte("thundercats")}}, 7, &recorder)
+		datagram := recorder.datagrams[0]
+		So(core.CheckPreamble(datagram), ShouldBeNil)
+
+		Convey("and datagrams without one are rejected.", func() {
+			datagram[0]++
+			err := core.CheckPreamble(datagram)
+			So(err, ShouldNotBeNil)
+			_, isVersionErr := err.(*core.VersionError)
+			So(isVersionErr, ShouldBeFalse)
+			_, err = core.ParseChunks(datagram)
+			So(err, ShouldNotBeNil)
+			So(core.CheckPreamble(nil), ShouldNotBeNil)
+		})
+
+		Convey("and datagrams in versions we don't speak are rejected with a VersionError.", func() {
+			datagram[2] = byte(core.SupportedVersions.Max + 1)
+			err := core.CheckPreamble(datagram)
+			So(err, ShouldResemble, &core.VersionError{
+				Ours:   core.SupportedVersions,
+				Theirs: core.VersionRange{Min: core.SupportedVersions.Max + 1, Max: core.SupportedVersions.Max + 1},
+			})
+			_, err = core.ParseChunks(datagram)
+			So(err, ShouldResemble, core.CheckPreamble(datagram))
+		})
+	})
+
+	Convey("Version rejections say which versions we speak.", t, func() {
+		rejection := core.MakeVersionRejection()
+		r, ok := core.ParseVersionRejection(rejection)
+		So(ok, ShouldBeTrue)
+		So(r, ShouldResemble, core.SupportedVersions)
+		So(core.CheckPreamble(rejection), ShouldNotBeNil)
+
+		var recorder datagramRecorder
+		core.WriteChunks([]core.Chunk{{Stream: 5}}, 7, &recorder)
+		_, ok = core.ParseVersionRejection(recorder.datagrams[0])
+		So(ok, ShouldBeFalse)
+		_, ok = core.ParseVersionRejection(rejection[0 : len(rejection)-1])
+		So(ok, ShouldBeFalse)
+	})
+
+	Convey("Framers frame each connection with the version set for it.", t, func() {
+		framer, err := core.MakeFramer(nil)
+		So(err, ShouldBeNil)
+		framer.SetVersion(7, core.SupportedVersions.Max+1)
+		var recorder datagramRecorder
+		chunk := core.Chunk{Stream: 5, Data: []byte("thundercats")}
+		framer.WriteChunks([]core.Chunk{chunk}, 7, &recorder)
+		framer.WriteChunks([]core.Chunk{chunk}, 8, &recorder)
+		So(recorder.datagrams[0][2], ShouldEqual, byte(core.SupportedVersions.Max+1))
+		So(recorder.datagrams[1][2], ShouldEqual, byte(core.SupportedVersions.Min))
+		_, err = framer.ParseChunks(recorder.datagrams[0])
+		_, isVersionErr := err.(*core.VersionError)
+		So(isVersionErr, ShouldBeTrue)
+		_, err = framer.ParseChunks(recorder.datagrams[1])
+		So(err, ShouldBeNil)
+
+		framer.RemoveSession(7)
+		framer.WriteChunks([]core.Chunk{chunk}, 7, &recorder)
+		So(recorder.datagrams[2][2], ShouldEqual, byte(core.SupportedVersions.Min))
+
+		Convey("unless they are told to use another one, and chunks remember the version they came in.", func() {
+			framer.SetVersion(8, core.SupportedVersions.Max+1)
+			framer.WriteChunksIn(core.SupportedVersions.Min, []core.Chunk{chunk}, 8, &recorder)
+			So(recorder.datagrams[3][2], ShouldEqual, byte(core.SupportedVersions.Min))
+			chunks, err := framer.ParseChunks(recorder.datagrams[3])
+			So(err, ShouldBeNil)
+			So(chunks[0].Version, ShouldEqual, core.SupportedVersions.Min)
+		})
+	})
+}
@@ -0,0 +1,55 @@
+package sluice
+
+import (
+	"github.com/runningwild/sluice/core"
+)
+
+// EventType is the kind of change to the sluice that an Event describes.
+type EventType int
+
+const (
+	// EventJoin means a node has joined the sluice.
+	EventJoin EventType = iota
+
+	// EventLeave means a node has left the sluice.
+	EventLeave
+)
+
+// Event tells the application that something happened to another node in the sluice.
+type Event struct {
+	Type EventType
+	Node core.NodeId
+
+	// Reason is why the node left, and is only set for EventLeave.
+	Reason core.LeaveReason
+
+	// Message is what the host said when it kicked this client, and is only set on the client's
+	// EventLeave for core.HostNodeId.
+	Message string
+}
+
+// eventQueue forwards everything from in to out the same way that chunkQueue does, so that events
+// are never held up by an application that isn't reading them.
+func eventQueue(in <-chan Event, out chan<- Event) {
+	defer close(out)
+	var queue []Event
+	for in != nil || len(queue) > 0 {
+		var send chan<- Event
+		var next Event
+		if len(queue) > 0 {
+			send = out
+			next = queue[0]
+		}
+		select {
+		case event, ok := <-in:
+			if !ok {
+				in = nil
+				break
+			}
+			queue = append(queue, event)
+
+		case send <- next:
+			queue = queue[1:]
+		}
+	}
+}
@@ -0,0 +1,1023 @@
+package sluice
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/runningwild/clock"
+	"github.com/runningwild/network"
+	"github.com/runningwild/sluice/core"
+)
+
+const (
+	// RefusedFull is the reason a client is given when the host already has as many clients as it
+	// will take.
+	RefusedFull = "server full"
+
+	// RefusedTooManyFromIP is the reason a client is given when the host already has as many clients
+	// as it will take from the client's IP address.
+	RefusedTooManyFromIP = "too many clients from this address"
+
+	// RefusedBanned is the reason a client is given when its address or identity is banned.
+	RefusedBanned = "banned"
+
+	// RefusedConfigMismatch is the reason a client is given when it expects the host to have a
+	// GlobalConfig with a different Fingerprint.  The client is sent the host's GlobalConfig with the
+	// refusal, so it can tell what's different.
+	RefusedConfigMismatch = "config doesn't match the host's"
+
+	// RefusedVersion is the reason a client is given when it doesn't speak any of the same protocol
+	// versions as the host.
+	RefusedVersion = "no protocol version in common"
+
+	// RefusedKeyExchange is the reason a client is given when the host has an Identity and the client
+	// didn't send a valid ephemeral key to do a key exchange with.
+	RefusedKeyExchange = "key exchange failed"
+)
+
+// maxSpoofedChunks is how many chunks claiming to be from another node a client can send before the
+// host kicks it.  Honest clients never send them, but a single one isn't worth disconnecting over.
+const maxSpoofedChunks = 8
+
+// maxQueuedChunks is how many chunks from a client can be waiting for the client's
+// HostCommunicateWithClient routine.  Any more than that are dropped, so that a client can't make
+// the host hold on to everything it sends.
+const maxQueuedChunks = 1024
+
+// Host is the central node of a sluice network.  All clients connect to the host, and all data
+// between clients is relayed through it.
+type Host struct {
+	config *core.Config
+	conn   *net.UDPConn
+
+	// incoming is all chunks received from any client.
+	incoming chan core.Chunk
+
+	// outgoing is all chunks produced by the host's WriterRoutines.
+	outgoing chan core.Chunk
+
+	// relay is all chunks on broadcast streams that need to be sent from one client to the others.
+	relay chan core.Chunk
+
+	// recv is every packet that clients send to the host.  It is closed once every goroutine in
+	// delivering has returned, which they do once the host is closed.
+	recv       chan core.Packet
+	delivering sync.WaitGroup
+
+	rtts      *core.RTTTable
+	latencies *core.LatencyMatrix
+	stats     *core.StatsTable
+
+	// cookies makes sure a client can hear us before we do anything for it.
+	cookies *core.CookieJar
+
+	// framer frames every datagram the host sends and receives.
+	framer *core.Framer
+
+	// addrBans holds the banned IP addresses, and identityBans the banned identities.
+	addrBans     *core.BanList
+	identityBans *core.BanList
+
+	// kicks is how Kick and Ban get the run goroutine to remove a client.
+	kicks chan kick
+
+	// globalConfig is the config.GlobalConfig that every client is sent with its welcome, and
+	// fingerprint is its Fingerprint.
+	globalConfig [][]byte
+	fingerprint  []byte
+
+	// events is written to by the run goroutine, and read from by the application through Events.
+	events    chan Event
+	eventsOut chan Event
+
+	// clients, connections, nodes, nodeIds, startTracker, prober, and router are only accessed by
+	// the run goroutine.
+	clients      map[string]*hostClient
+	connections  map[core.ConnectionId]*hostClient
+	nodes        map[core.NodeId]*hostClient
+	nodeIds      *core.NodeIdAllocator
+	startTracker *core.StartTracker
+	prober       *core.LatencyProber
+	router       *core.Router
+
+	// writers holds the WriterRoutine for each stream and target that has been sent to.  mu is held
+	// while one is created and while anything is sent to one, so a writer can't be closed by
+	// closeWriters between being looked up and being used.
+	mu      sync.Mutex
+	writers map[writerKey]chan<- []byte
+
+	// connected holds every client that has joined and hasn't left, so that SendTo can check for a
+	// client without waiting on the run goroutine.  run updates it, and never holds mu.
+	connectedMu sync.Mutex
+	connected   map[core.NodeId]bool
+
+	countersMu sync.Mutex
+	counters   Counters
+
+	done chan struct{}
+
+	// stopped is closed once run has returned.
+	stopped   chan struct{}
+	closeOnce sync.Once
+}
+
+// Counters holds counts of what a node has dropped because someone sent it something they
+// shouldn't have.
+type Counters struct {
+	// Spoofed is the number of chunks that claimed to be from a node other than the client that
+	// sent them.  Only the host counts these.
+	Spoofed uint64
+
+	// Replayed is the number of datagrams that were dropped because they had already been received.
+	// Only datagrams sealed with a key can be told apart from replays.
+	Replayed uint64
+
+	// Overflowed is the number of chunks that were dropped because the client that sent them had
+	// already sent maxQueuedChunks that the host hadn't gotten to yet.  Only the host counts these.
+	Overflowed uint64
+}
+
+// kick asks the run goroutine to kick node, and to ban it for ban if ban isn't negative.  Whether
+// there was such a node is sent on found.
+type kick struct {
+	node    core.NodeId
+	message string
+	ban     time.Duration
+	found   chan bool
+}
+
+// writerKey identifies a WriterRoutine on the host.  Broadcast streams have a single writer with
+// target 0, non-broadcast streams have one writer per target.
+type writerKey struct {
+	stream core.StreamId
+	target core.NodeId
+}
+
+// hostClient contains the channels the host uses to talk to a single client's
+// HostCommunicateWithClient routine.  fromCore is buffered by a chunkQueue, and fromClient holds up
+// to maxQueuedChunks, so the run goroutine never waits on a client's routine.
+type hostClient struct {
+	node       core.NodeId
+	addr       network.Addr
+	connection core.ConnectionId
+	fromClient chan core.Chunk
+	fromCore   chan core.Chunk
+
+	// session is the token the client can use to resume its session from a new address, and writer
+	// sends to whatever address it is at.
+	session core.SessionToken
+	writer  *clientWriter
+
+	// handshake and welcome are what we told the client when it joined, in case we need to tell it
+	// again.  handshake is nil unless the host has an Identity.
+	handshake []byte
+	welcome   [][]byte
+
+	// lastHeard is the last time anything arrived from the client.
+	lastHeard time.Time
+
+	// spoofed is the number of chunks the client has sent that claimed to be from another node.
+	spoofed int
+
+	// identity is what config.Authenticate said the client is.
+	identity string
+
+	// version is the ProtocolVersion negotiated with the client.  Its connection is framed with it,
+	// and so is anything sent to it outside of its connection.
+	version core.ProtocolVersion
+}
+
+// MakeHost starts a host listening on addr and returns it.
+func MakeHost(addr string, config *core.Config) (*Host, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	copied := *config
+	config = &copied
+	config.Node = core.HostNodeId
+	if config.Clock == nil {
+		config.Clock = &clock.RealClock{}
+	}
+
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	cookies, err := core.MakeCookieJar(config.Clock)
+	if err != nil {
+		return nil, err
+	}
+	framer, err := core.MakeFramer(config.Key)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	h := &Host{
+		config:    config,
+		conn:      conn,
+		incoming:  make(chan core.Chunk),
+		outgoing:  make(chan core.Chunk),
+		relay:     make(chan core.Chunk),
+		recv:      make(chan core.Packet),
+		rtts:      core.MakeRTTTable(),
+		events:    make(chan Event),
+		clients:   make(map[string]*hostClient),
+		nodes:     make(map[core.NodeId]*hostClient),
+		nodeIds:   core.MakeNodeIdAllocator(),
+		writers:   make(map[writerKey]chan<- []byte),
+		connected: make(map[core.NodeId]bool),
+		done:      make(chan struct{}),
+		stopped:   make(chan struct{}),
+
+		eventsOut:    make(chan Event),
+		connections:  make(map[core.ConnectionId]*hostClient),
+		latencies:    core.MakeLatencyMatrix(),
+		stats:        core.MakeStatsTable(),
+		cookies:      cookies,
+		framer:       framer,
+		addrBans:     core.MakeBanList(config.Clock),
+		identityBans: core.MakeBanList(config.Clock),
+		kicks:        make(chan kick),
+		globalConfig: core.MakeGlobalConfigChunkDatas(config, &config.GlobalConfig),
+		fingerprint:  config.GlobalConfig.Fingerprint(),
+		startTracker: core.MakeStartTracker(config),
+	}
+	h.prober = core.MakeLatencyProber(config, h.rtts, h.latencies)
+	h.router = core.MakeRouter(h.rtts, h.latencies, h.prober)
+	go eventQueue(h.events, h.eventsOut)
+	go h.framer.ReceiveAndSplit(versionChecker{conn, config}, h.incoming, maxDatagramSize)
+	go h.run()
+	return h, nil
+}
+
+// Addr returns the address the host is listening on.
+func (h *Host) Addr() net.Addr {
+	return h.conn.LocalAddr()
+}
+
+// PublicKey returns the public key of the host's Identity, which clients can expect with their
+// HostKey, or nil if the host doesn't have one.
+func (h *Host) PublicKey() []byte {
+	if h.config.Identity == nil {
+		return nil
+	}
+	return h.config.Identity.PublicKey().Bytes()
+}
+
+// Recv returns the channel that all packets sent to the host are delivered on.  It is closed once
+// the host is closed, and packets that haven't been received by then might be dropped.
+func (h *Host) Recv() <-chan core.Packet {
+	return h.recv
+}
+
+// RTT returns the current estimate of the round trip time to the client node, and false if there
+// isn't one yet.  The host pings every client every config.Ping to keep this estimate up to date.
+func (h *Host) RTT(node core.NodeId) (core.RTT, bool) {
+	return h.rtts.Get(node)
+}
+
+// Latency returns the current estimate of how long it takes for data to get directly from the
+// client from to the client to, and false if there isn't one yet.  The host measures the latency
+// between a pair of clients every config.Ding.
+func (h *Host) Latency(from, to core.NodeId) (core.RTT, bool) {
+	return h.latencies.Get(core.Link{From: from, To: to})
+}
+
+// Latencies returns the current estimate of the latency between every pair of clients that has
+// been measured.
+func (h *Host) Latencies() map[core.Link]core.RTT {
+	return h.latencies.All()
+}
+
+// Stats returns the stats the client node most recently reported about every node it hears from,
+// sorted by NodeId.  Clients report their stats every config.Stats.
+func (h *Host) Stats(node core.NodeId) []core.PeerStats {
+	return h.stats.Get(node)
+}
+
+// AllStats returns the stats every client has reported, keyed by the client that reported them.
+func (h *Host) AllStats() map[core.NodeId][]core.PeerStats {
+	return h.stats.All()
+}
+
+// Counters returns how much the host has dropped because of something a client, or someone
+// pretending to be one, did wrong.
+func (h *Host) Counters() Counters {
+	h.countersMu.Lock()
+	defer h.countersMu.Unlock()
+	counters := h.counters
+	counters.Replayed = h.framer.Replayed()
+	return counters
+}
+
+// Kick removes the client node, and tells it that it was kicked with message.  Everyone else sees
+// it leave with core.LeaveKicked.  It returns an error if there is no such client.
+func (h *Host) Kick(node core.NodeId, message string) error {
+	return h.kick(kick{node: node, message: message, ban: -1})
+}
+
+// Ban kicks the client node like Kick, and bans its IP address and its identity, if it has one, for
+// d, or forever if d is zero.
+func (h *Host) Ban(node core.NodeId, message string, d time.Duration) error {
+	if d < 0 {
+		return fmt.Errorf("can't ban for a negative duration")
+	}
+	return h.kick(kick{node: node, message: message, ban: d})
+}
+
+func (h *Host) kick(k kick) error {
+	k.found = make(chan bool, 1)
+	select {
+	case h.kicks <- k:
+	case <-h.stopped:
+		return fmt.Errorf("host is closed")
+	}
+	if !<-k.found {
+		return fmt.Errorf("no client has NodeId %d", k.node)
+	}
+	return nil
+}
+
+// BanAddr refuses to let anyone at the IP address ip join for d, or forever if d is zero.  Clients
+// that are already at ip aren't affected.
+func (h *Host) BanAddr(ip string, d time.Duration) {
+	h.addrBans.Add(ip, d)
+}
+
+// BanIdentity refuses to let anyone that config.Authenticate says is identity join for d, or
+// forever if d is zero.  Clients that already joined as identity aren't affected.
+func (h *Host) BanIdentity(identity string, d time.Duration) {
+	h.identityBans.Add(identity, d)
+}
+
+// Unban lifts any ban on the IP address or identity addrOrIdentity.
+func (h *Host) Unban(addrOrIdentity string) {
+	h.addrBans.Remove(addrOrIdentity)
+	h.identityBans.Remove(addrOrIdentity)
+}
+
+// Events returns the channel that the host reports clients joining and leaving on.  The channel is
+// closed after the host is closed.
+func (h *Host) Events() <-chan Event {
+	return h.eventsOut
+}
+
+// Send sends data to every client on the broadcast stream named stream.
+func (h *Host) Send(stream string, data []byte) error {
+	config := h.config.GetStreamConfigByName(stream)
+	if config == nil {
+		return fmt.Errorf("unknown stream %q", stream)
+	}
+	if !config.Broadcast {
+		return fmt.Errorf("stream %q is not a broadcast stream, use SendTo", stream)
+	}
+	return h.send(writerKey{config.Id, 0}, data)
+}
+
+// SendTo sends data to the client node on the non-broadcast stream named stream.  It is an error
+// if there is no such client.
+func (h *Host) SendTo(node core.NodeId, stream string, data []byte) error {
+	config := h.config.GetStreamConfigByName(stream)
+	if config == nil {
+		return fmt.Errorf("unknown stream %q", stream)
+	}
+	if config.Broadcast {
+		return fmt.Errorf("stream %q is a broadcast stream, use Send", stream)
+	}
+	return h.send(writerKey{config.Id, node}, data)
+}
+
+// send sends data to the writer for key, starting it if it hasn't been started yet.  Writers to a
+// client are only started while it is connected, and closeWriters closes them once it leaves.
+func (h *Host) send(key writerKey, data []byte) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	select {
+	case <-h.done:
+		return fmt.Errorf("host is closed")
+	default:
+	}
+	packets, ok := h.writers[key]
+	if !ok {
+		if key.target != 0 {
+			h.connectedMu.Lock()
+			connected := h.connected[key.target]
+			h.connectedMu.Unlock()
+			if !connected {
+				return fmt.Errorf("node %d is not connected", key.target)
+			}
+		}
+		c := make(chan []byte)
+		go core.WriterRoutine(h.config.Streams[key.stream], key.target, h.config.MaxChunkDataSize, c, h.outgoing)
+		h.writers[key] = c
+		packets = c
+	}
+	select {
+	case packets <- data:
+		return nil
+	case <-h.done:
+		return fmt.Errorf("host is closed")
+	}
+}
+
+// Close shuts down the host.  Every client is told that the host is shutting down, so that they
+// can tell it apart from the host timing out.
+func (h *Host) Close() error {
+	var err error
+	h.closeOnce.Do(func() {
+		close(h.done)
+		h.mu.Lock()
+		for _, packets := range h.writers {
+			close(packets)
+		}
+		h.mu.Unlock()
+		<-h.stopped
+		err = h.conn.Close()
+	})
+	return err
+}
+
+// run routes chunks between the network, the host's writers, and each client's
+// HostCommunicateWithClient routine.  It also handles clients joining and leaving, and removes
+// clients that haven't been heard from for config.Timeout.  When the host is closed every client is
+// sent a Leave chunk about the host.  There's no way to know if they got it, but any that didn't
+// will time out soon enough.
+func (h *Host) run() {
+	defer func() {
+		for _, client := range h.clients {
+			close(client.fromClient)
+			close(client.fromCore)
+			h.sendHostLeave(client, core.LeaveShutdown, "")
+		}
+		// recv can't be closed until no client's HostCommunicateWithClient routine can send on it, and
+		// they might be waiting to relay something first.
+		delivered := make(chan struct{})
+		go func() {
+			h.delivering.Wait()
+			close(delivered)
+		}()
+		for waiting := true; waiting; {
+			select {
+			case <-h.relay:
+			case <-delivered:
+				waiting = false
+			}
+		}
+		close(h.recv)
+		close(h.events)
+		close(h.stopped)
+	}()
+	var dings, timeouts <-chan time.Time
+	if h.config.Ding > 0 {
+		ticker := core.MakeTicker(h.config.Ding, h.config.Clock)
+		defer ticker.Stop()
+		dings = ticker.C
+	}
+	if h.config.Timeout > 0 {
+		// Checking a few times per timeout means clients are removed not long after they time out.
+		ticker := core.MakeTicker(h.config.Timeout/4, h.config.Clock)
+		defer ticker.Stop()
+		timeouts = ticker.C
+	}
+	for {
+		select {
+		case chunk, ok := <-h.incoming:
+			if !ok {
+				return
+			}
+			// Clients are known by the connection their datagrams are on, rather than by their
+			// address.  The only thing a client can send before it has a connection is a request to
+			// join.
+			client, known := h.connections[chunk.Connection]
+			if known && chunk.Source != client.node {
+				h.dropSpoofed(client, chunk)
+				break
+			}
+			if known {
+				client.lastHeard = h.config.Clock.Now()
+			}
+			switch {
+			case chunk.Stream == core.StreamJoin && chunk.Connection == core.NoConnection:
+				h.join(chunk)
+			case !known:
+				h.config.Printf("Dropping a chunk on stream %d from %v on connection %d, which has not joined.\n", chunk.Stream, chunk.SourceAddr, chunk.Connection)
+			case chunk.Stream == core.StreamJoin:
+				h.resume(client, chunk)
+			case chunk.Stream == core.StreamLeave:
+				_, reason, err := core.ParseLeaveChunkData(chunk.Data)
+				if err != nil {
+					h.config.Printf("Error parsing leave chunk from node %d: %v\n", client.node, err)
+					break
+				}
+				h.removeClient(client, reason)
+			case chunk.Stream == core.StreamDong:
+				h.prober.HandleDong(client.node, chunk)
+			case chunk.Stream == core.StreamStats:
+				if err := h.stats.Add(client.node, chunk); err != nil {
+					h.config.Printf("Error parsing stats from node %d: %v\n", client.node, err)
+				}
+			default:
+				h.queue(client, chunk)
+			}
+
+		case chunk := <-h.outgoing:
+			chunk.Source = core.HostNodeId
+			if chunk.Target == 0 {
+				h.startTracker.Add(chunk)
+				for _, client := range h.nodes {
+					client.fromCore <- chunk
+				}
+			} else if client, ok := h.nodes[chunk.Target]; ok {
+				client.fromCore <- chunk
+			}
+
+		case chunk := <-h.relay:
+			if _, ok := h.nodes[chunk.Source]; !ok {
+				// Whoever sent this has already left.
+				break
+			}
+			h.startTracker.Add(chunk)
+			reliable := h.config.Streams[chunk.Stream].Mode.Reliable()
+			for node, client := range h.nodes {
+				if node == chunk.Source {
+					continue
+				}
+				// Clients on a direct route already got any unreliable chunks from each other.  Reliable
+				// chunks are still relayed in case the direct route isn't actually working.
+				if !reliable && h.router.Direct(core.Link{From: chunk.Source, To: node}) {
+					continue
+				}
+				client.fromCore <- chunk
+			}
+
+		case <-dings:
+			addrs := make(map[core.NodeId]string)
+			for node, client := range h.nodes {
+				addrs[node] = client.addr.String()
+			}
+			if chunk, expect, ok := h.prober.Ding(addrs); ok {
+				// The expectation goes out first, since the Dang it is for has further to go.
+				h.nodes[expect.Target].fromCore <- expect
+				h.nodes[chunk.Target].fromCore <- chunk
+			}
+			h.route()
+
+		case k := <-h.kicks:
+			client, ok := h.nodes[k.node]
+			k.found <- ok
+			if !ok {
+				break
+			}
+			if k.ban >= 0 {
+				h.addrBans.Add(ipOf(client.addr), k.ban)
+				if client.identity != "" {
+					h.identityBans.Add(client.identity, k.ban)
+				}
+			}
+			h.config.Printf("Kicking node %d: %s\n", client.node, k.message)
+			h.sendHostLeave(client, core.LeaveKicked, k.message)
+			h.removeClient(client, core.LeaveKicked)
+
+		case <-timeouts:
+			now := h.config.Clock.Now()
+			for _, client := range h.nodes {
+				if now.Sub(client.lastHeard) > h.config.Timeout {
+					h.config.Printf("Node %d timed out.\n", client.node)
+					h.removeClient(client, core.LeaveTimeout)
+				}
+			}
+
+		case <-h.done:
+			return
+		}
+	}
+}
+
+// join handles a request to join from a client that doesn't have a connection yet.  Nothing is done
+// for a client until it has shown that it can hear us at the address it claims to be at, by asking
+// again with a cookie we sent there.  Until then all it gets is a cookie, which is never bigger
+// than its request, so spoofing requests from someone else's address gets nobody anything.
+// Clients that config.Authenticate rejects are refused.  Until the client has a connection it is
+// answered in the version its request was framed with, since that is the only one we know it speaks.
+func (h *Host) join(chunk core.Chunk) {
+	r, err := core.ParseJoinChunkData(chunk.Data)
+	if err != nil {
+		h.config.Printf("Error parsing join chunk from %v: %v\n", chunk.SourceAddr, err)
+		return
+	}
+	addr := chunk.SourceAddr
+	if !h.cookies.Check(addr.String(), r.Cookie) {
+		reply := core.Chunk{Stream: core.StreamCookie, Source: core.HostNodeId, Data: h.cookies.Make(addr.String())}
+		if len(reply.Data) > len(chunk.Data) {
+			h.config.Printf("Not answering a join chunk from %v that is smaller than a cookie.\n", addr)
+			return
+		}
+		h.framer.WriteChunksIn(chunk.Version, []core.Chunk{reply}, core.NoConnection, addrWriter{h.conn, addr})
+		return
+	}
+	if client, ok := h.clients[addr.String()]; ok {
+		// The client must not have gotten its welcome, so we send the same one again.
+		h.sendHandshake(client)
+		h.sendWelcome(client)
+		return
+	}
+	if h.addrBans.Banned(ipOf(addr)) {
+		h.refuse(addr, chunk.Version, RefusedBanned)
+		return
+	}
+	version, ok := core.SupportedVersions.Negotiate(r.Versions)
+	if !ok {
+		h.refuse(addr, chunk.Version, RefusedVersion)
+		return
+	}
+	if h.config.CheckAppVersion != nil {
+		if err := h.config.CheckAppVersion(r.AppVersion); err != nil {
+			h.refuse(addr, chunk.Version, err.Error())
+			return
+		}
+	}
+	if len(r.Fingerprint) > 0 && !bytes.Equal(r.Fingerprint, h.fingerprint) {
+		h.refuse(addr, chunk.Version, RefusedConfigMismatch)
+		return
+	}
+	if h.config.MaxClients > 0 && len(h.nodes) >= h.config.MaxClients {
+		h.refuse(addr, chunk.Version, RefusedFull)
+		return
+	}
+	if h.config.MaxClientsPerIP > 0 && h.clientsAt(addr) >= h.config.MaxClientsPerIP {
+		h.refuse(addr, chunk.Version, RefusedTooManyFromIP)
+		return
+	}
+	var identity string
+	if h.config.Authenticate != nil {
+		var err error
+		if identity, err = h.config.Authenticate(addr, r.Data); err != nil {
+			h.refuse(addr, chunk.Version, err.Error())
+			return
+		}
+		if identity != "" && h.identityBans.Banned(identity) {
+			h.refuse(addr, chunk.Version, RefusedBanned)
+			return
+		}
+	}
+	h.admit(addr, r.Ephemeral, identity, version)
+}
+
+// clientsAt returns the number of clients at the same IP address as addr.
+func (h *Host) clientsAt(addr network.Addr) int {
+	ip := ipOf(addr)
+	count := 0
+	for _, client := range h.nodes {
+		if ipOf(client.addr) == ip {
+			count++
+		}
+	}
+	return count
+}
+
+// ipOf returns the IP address part of addr.
+func ipOf(addr network.Addr) string {
+	if ip, _, err := net.SplitHostPort(addr.String()); err == nil {
+		return ip
+	}
+	return addr.String()
+}
+
+// refuse tells the client at addr that it can't join, and why, in a datagram framed with version.  A
+// client refused because its config doesn't match is also sent the host's GlobalConfig.
+func (h *Host) refuse(addr network.Addr, version core.ProtocolVersion, reason string) {
+	h.config.Printf("Refusing to let %v join: %s\n", addr, reason)
+	var chunks []core.Chunk
+	if reason == RefusedConfigMismatch {
+		for _, data := range h.globalConfig {
+			chunks = append(chunks, core.Chunk{Stream: core.StreamGlobalConfig, Source: core.HostNodeId, Data: data})
+		}
+	}
+	refusal := core.Chunk{Stream: core.StreamRefuse, Source: core.HostNodeId, Data: core.MakeRefuseChunkData(reason)}
+	h.framer.WriteChunksIn(version, append(chunks, refusal), core.NoConnection, addrWriter{h.conn, addr})
+}
+
+// admit adds a client at addr, welcomes it, and lets it and everyone else know about each other.
+// NodeIds aren't reused until every one of them has been used, so that a node that has left can't
+// be confused with a new one, and the client is refused if they are all in use.  If the host has an
+// Identity the client gets its own session keys from a key exchange with ephemeral, and is refused
+// if it didn't send a valid one.  Everything on the client's connection is framed with version.
+func (h *Host) admit(addr network.Addr, ephemeral []byte, identity string, version core.ProtocolVersion) {
+	if h.nodeIds.InUse() >= core.MaxClientNodeIds {
+		h.refuse(addr, version, RefusedFull)
+		return
+	}
+	session, connection, err := h.newSession()
+	if err != nil {
+		h.config.Printf("Unable to add a client from %v: %v\n", addr, err)
+		return
+	}
+	var handshake []byte
+	if h.config.Identity != nil {
+		hs, framer, err := core.AcceptKeyExchange(h.config.Identity, ephemeral, h.config.Key)
+		if err != nil {
+			h.config.Printf("Unable to do a key exchange with a client from %v: %v\n", addr, err)
+			h.refuse(addr, version, RefusedKeyExchange)
+			return
+		}
+		handshake = core.MakeHandshakeChunkData(hs)
+		h.framer.AddSession(connection, framer)
+	}
+	h.framer.SetVersion(connection, version)
+	node, _ := h.nodeIds.Allocate()
+	client := h.addClient(node, addr, connection)
+	client.session = session
+	client.handshake = handshake
+	client.identity = identity
+	client.version = version
+	client.welcome = core.MakeWelcomeChunkDatas(h.config, &core.Welcome{
+		Node:    node,
+		Session: client.session,
+		Version: version,
+		Starts:  h.startTracker.Starts(),
+	})
+	h.sendHandshake(client)
+	h.sendWelcome(client)
+
+	// The client starts partway through any reliable broadcast packets that have only been partially
+	// sent, so it needs the chunks that everyone else already has.
+	for _, chunk := range h.startTracker.Partial() {
+		client.fromCore <- chunk
+	}
+
+	for other, c := range h.nodes {
+		if other == node {
+			continue
+		}
+		client.fromCore <- core.Chunk{Stream: core.StreamJoin, Data: core.MakeAnnouncementChunkData(other)}
+		c.fromCore <- core.Chunk{Stream: core.StreamJoin, Data: core.MakeAnnouncementChunkData(node)}
+	}
+	h.events <- Event{Type: EventJoin, Node: node}
+}
+
+// newSession returns a random SessionToken and an unused random ConnectionId for a new client, so
+// that neither is easy to guess.
+func (h *Host) newSession() (core.SessionToken, core.ConnectionId, error) {
+	var session core.SessionToken
+	if _, err := rand.Read(session[:]); err != nil {
+		return session, core.NoConnection, err
+	}
+	for {
+		var buf [4]byte
+		if _, err := rand.Read(buf[:]); err != nil {
+			return session, core.NoConnection, err
+		}
+		var id uint32
+		core.ConsumeUint32(buf[:], &id)
+		connection := core.ConnectionId(id)
+		if _, used := h.connections[connection]; !used && connection != core.NoConnection {
+			return session, connection, nil
+		}
+	}
+}
+
+// resume moves client's session to the address chunk came from, if chunk has the client's session
+// token.  Datagrams on the client's connection are accepted from any address, but nothing is sent
+// to a new address until the client proves it has the session.  Only sessions that haven't timed
+// out can be resumed.  Everything the host knows about the client is kept, so nothing it was sent
+// reliably is lost.  The client is welcomed again to let it know that it worked.
+func (h *Host) resume(client *hostClient, chunk core.Chunk) {
+	r, err := core.ParseResumeChunkData(chunk.Data)
+	if err != nil {
+		h.config.Printf("Error parsing resume chunk from %v: %v\n", chunk.SourceAddr, err)
+		return
+	}
+	if r.Node != client.node || r.Session != client.session {
+		h.config.Printf("Node %d at %v asked to resume a session that isn't its own.\n", client.node, chunk.SourceAddr)
+		return
+	}
+	if chunk.SourceAddr.String() == client.addr.String() {
+		h.sendWelcome(client)
+		return
+	}
+	h.config.Printf("Node %d moved from %v to %v.\n", client.node, client.addr, chunk.SourceAddr)
+	delete(h.clients, client.addr.String())
+	client.addr = chunk.SourceAddr
+	client.writer.SetAddr(chunk.SourceAddr)
+	client.lastHeard = h.config.Clock.Now()
+	h.clients[client.addr.String()] = client
+
+	// Other clients sending directly to this one are sending to the wrong address.
+	for other := range h.nodes {
+		link := core.Link{From: client.node, To: other}
+		if other != client.node && h.router.Direct(link) {
+			h.punch(link, false)
+		}
+	}
+	h.router.Remove(client.node)
+	h.sendWelcome(client)
+}
+
+// queue passes chunk on to client's HostCommunicateWithClient routine, unless the routine hasn't
+// gotten to maxQueuedChunks of what client already sent, in which case chunk is dropped and counted.
+// Honest clients will resend anything reliable that is dropped.
+func (h *Host) queue(client *hostClient, chunk core.Chunk) {
+	select {
+	case client.fromClient <- chunk:
+	default:
+		h.countersMu.Lock()
+		h.counters.Overflowed++
+		h.countersMu.Unlock()
+	}
+}
+
+// dropSpoofed counts chunk, which client sent but which claims to be from another node, and kicks
+// client once it has sent maxSpoofedChunks of them.  The only chunks a client may send without its
+// own NodeId are its requests to join, which are sent before it knows what its NodeId is.
+func (h *Host) dropSpoofed(client *hostClient, chunk core.Chunk) {
+	h.countersMu.Lock()
+	h.counters.Spoofed++
+	h.countersMu.Unlock()
+	client.spoofed++
+	h.config.Printf("Dropping a chunk on stream %d from node %d that claims to be from node %d.\n", chunk.Stream, client.node, chunk.Source)
+	if client.spoofed >= maxSpoofedChunks {
+		h.config.Printf("Kicking node %d for sending %d spoofed chunks.\n", client.node, client.spoofed)
+		h.sendHostLeave(client, core.LeaveKicked, "sent chunks from another node")
+		h.removeClient(client, core.LeaveKicked)
+	}
+}
+
+// sendHostLeave tells client that the host is gone as far as it's concerned, and why.  It's sent
+// right away, since client won't be hearing anything else from the host.
+func (h *Host) sendHostLeave(client *hostClient, reason core.LeaveReason, message string) {
+	leave := core.Chunk{
+		Stream: core.StreamLeave,
+		Source: core.HostNodeId,
+		Data:   core.MakeHostLeaveChunkData(reason, message),
+	}
+	h.framer.WriteChunks([]core.Chunk{leave}, client.connection, client.writer)
+}
+
+// sendHandshake sends client the host's half of the key exchange, if it did one.  It is sent outside
+// of client's connection, since the client can't open anything on it until it has this.
+func (h *Host) sendHandshake(client *hostClient) {
+	if client.handshake == nil {
+		return
+	}
+	handshake := core.Chunk{Stream: core.StreamHandshake, Source: core.HostNodeId, Target: client.node, Data: client.handshake}
+	h.framer.WriteChunksIn(client.version, []core.Chunk{handshake}, core.NoConnection, client.writer)
+}
+
+// sendWelcome sends client the GlobalConfig and the welcome it was given when it joined.
+func (h *Host) sendWelcome(client *hostClient) {
+	for _, data := range h.globalConfig {
+		client.fromCore <- core.Chunk{
+			Stream: core.StreamGlobalConfig,
+			Source: core.HostNodeId,
+			Target: client.node,
+			Data:   data,
+		}
+	}
+	for _, data := range client.welcome {
+		client.fromCore <- core.Chunk{
+			Stream: core.StreamWelcome,
+			Source: core.HostNodeId,
+			Target: client.node,
+			Data:   data,
+		}
+	}
+}
+
+// route starts and stops direct routes between clients based on the latest latencies.
+func (h *Host) route() {
+	var nodes []core.NodeId
+	for node := range h.nodes {
+		nodes = append(nodes, node)
+	}
+	start, stop := h.router.Update(nodes)
+	for _, link := range start {
+		h.punch(link, true)
+	}
+	for _, link := range stop {
+		h.punch(link, false)
+	}
+}
+
+// punch tells both clients on link to start or stop sending to each other directly.
+func (h *Host) punch(link core.Link, start bool) {
+	a, b := h.nodes[link.From], h.nodes[link.To]
+	a.fromCore <- core.Chunk{
+		Stream: core.StreamPunch,
+		Data:   core.MakePunchChunkData(&core.Punch{Start: start, Node: b.node, Addr: b.addr.String()}),
+	}
+	b.fromCore <- core.Chunk{
+		Stream: core.StreamPunch,
+		Data:   core.MakePunchChunkData(&core.Punch{Start: start, Node: a.node, Addr: a.addr.String()}),
+	}
+}
+
+// addClient starts the routines needed to communicate with a new client.  Everything sent to it is
+// batched, except for pings, pongs, dings, and dangs.
+func (h *Host) addClient(node core.NodeId, addr network.Addr, connection core.ConnectionId) *hostClient {
+	client := &hostClient{
+		node:       node,
+		addr:       addr,
+		connection: connection,
+		fromClient: make(chan core.Chunk, maxQueuedChunks),
+		fromCore:   make(chan core.Chunk),
+		writer:     &clientWriter{conn: h.conn, addr: addr},
+		lastHeard:  h.config.Clock.Now(),
+	}
+	h.clients[addr.String()] = client
+	h.connections[connection] = client
+	h.nodes[node] = client
+	h.connectedMu.Lock()
+	h.connected[node] = true
+	h.connectedMu.Unlock()
+	fromCore := make(chan core.Chunk)
+	toClient := make(chan core.Chunk)
+	go chunkQueue(client.fromCore, fromCore)
+	packets := make(chan core.Packet)
+	go func() {
+		core.HostCommunicateWithClient(h.config, node, h.rtts, client.fromClient, fromCore, toClient, h.relay, packets)
+		close(toClient)
+		close(packets)
+		for range fromCore {
+		}
+	}()
+	h.delivering.Add(1)
+	go func() {
+		defer h.delivering.Done()
+		for packet := range packets {
+			// Once the host is closed nobody has to be reading recv, and what's left is dropped.
+			select {
+			case h.recv <- packet:
+			case <-h.done:
+			}
+		}
+	}()
+	batched := make(chan core.Chunk)
+	go func() {
+		defer close(batched)
+		for chunk := range toClient {
+			// Pings, pongs, dings, and dangs are used to measure RTTs and latencies, so they can't
+			// wait to be batched.
+			switch chunk.Stream {
+			case core.StreamPing, core.StreamPong, core.StreamDing, core.StreamDang:
+				h.framer.WriteChunks([]core.Chunk{chunk}, connection, client.writer)
+			default:
+				batched <- chunk
+			}
+		}
+	}()
+	go h.framer.BatchAndSend(batched, connection, client.writer, h.config.Clock, batchCutoffBytes, batchCutoffMs)
+	return client
+}
+
+// removeClient stops communicating with client and lets everyone else know that it left, and why.
+func (h *Host) removeClient(client *hostClient, reason core.LeaveReason) {
+	delete(h.clients, client.addr.String())
+	delete(h.connections, client.connection)
+	delete(h.nodes, client.node)
+	h.connectedMu.Lock()
+	delete(h.connected, client.node)
+	h.connectedMu.Unlock()
+	h.framer.RemoveSession(client.connection)
+	h.nodeIds.Free(client.node)
+	close(client.fromClient)
+	close(client.fromCore)
+	h.startTracker.Remove(client.node)
+	h.rtts.Remove(client.node)
+	h.latencies.Remove(client.node)
+	h.prober.Remove(client.node)
+	h.router.Remove(client.node)
+	h.stats.Remove(client.node)
+	for _, c := range h.nodes {
+		c.fromCore <- core.Chunk{Stream: core.StreamLeave, Data: core.MakeLeaveChunkData(client.node, reason)}
+	}
+	h.events <- Event{Type: EventLeave, Node: client.node, Reason: reason}
+
+	// Someone might be waiting on run while holding h.mu, so this can't be done here.
+	go h.closeWriters(client.node)
+}
+
+// closeWriters closes the writers for all non-broadcast streams to node.
+func (h *Host) closeWriters(node core.NodeId) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	select {
+	case <-h.done:
+		// Close has already closed every writer.
+		return
+	default:
+	}
+	for key, packets := range h.writers {
+		if key.target == node {
+			close(packets)
+			delete(h.writers, key)
+		}
+	}
+}
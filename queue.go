@@ -0,0 +1,32 @@
+package sluice
+
+import (
+	"github.com/runningwild/sluice/core"
+)
+
+// chunkQueue forwards everything from in to out, buffering as many chunks as necessary so that
+// sending on in never waits on whoever is reading from out.  out is closed once in is closed and
+// everything has been forwarded.
+func chunkQueue(in <-chan core.Chunk, out chan<- core.Chunk) {
+	defer close(out)
+	var queue []core.Chunk
+	for in != nil || len(queue) > 0 {
+		var send chan<- core.Chunk
+		var next core.Chunk
+		if len(queue) > 0 {
+			send = out
+			next = queue[0]
+		}
+		select {
+		case chunk, ok := <-in:
+			if !ok {
+				in = nil
+				break
+			}
+			queue = append(queue, chunk)
+
+		case send <- next:
+			queue = queue[1:]
+		}
+	}
+}
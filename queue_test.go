@@ -0,0 +1,34 @@
+package sluice
+
+import (
+	"testing"
+
+	"github.com/runningwild/sluice/core"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func TestChunkQueue(t *testing.T) {
+	Convey("chunkQueue", t, func() {
+		in := make(chan core.Chunk)
+		out := make(chan core.Chunk)
+		go chunkQueue(in, out)
+
+		Convey("Never blocks the sender, even if nothing is reading.", func() {
+			for i := 0; i < 100; i++ {
+				in <- core.Chunk{Sequence: core.SequenceId(i)}
+			}
+			close(in)
+
+			Convey("And delivers everything in order before closing out.", func() {
+				var sequences []core.SequenceId
+				for chunk := range out {
+					sequences = append(sequences, chunk.Sequence)
+				}
+				So(len(sequences), ShouldEqual, 100)
+				for i := range sequences {
+					So(sequences[i], ShouldEqual, i)
+				}
+			})
+		})
+	})
+}
@@ -0,0 +1,1513 @@
+package sluice_test
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/rand"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/runningwild/network"
+	"github.com/runningwild/sluice"
+	"github.com/runningwild/sluice/core"
+	. "github.com/smartystreets/goconvey/convey"
+)
+
+func makeTestConfig() *core.Config {
+	return &core.Config{
+		GlobalConfig: core.GlobalConfig{
+			Streams: map[core.StreamId]core.StreamConfig{
+				7: core.StreamConfig{
+					Name: "UU",
+					Id:   7,
+					Mode: core.ModeUnreliableUnordered,
+				},
+				10: core.StreamConfig{
+					Name: "RO",
+					Id:   10,
+					Mode: core.ModeReliableOrdered,
+				},
+				12: core.StreamConfig{
+					Name:      "RB",
+					Id:        12,
+					Mode:      core.ModeReliableOrdered,
+					Broadcast: true,
+				},
+				13: core.StreamConfig{
+					Name:      "UB",
+					Id:        13,
+					Mode:      core.ModeUnreliableUnordered,
+					Broadcast: true,
+				},
+			},
+			MaxChunkDataSize: 50,
+			PositionChunkMin: 20 * time.Millisecond,
+			PositionChunkMax: 50 * time.Millisecond,
+			MaxUnreliableAge: 25,
+			Confirmation:     10 * time.Millisecond,
+			Ping:             10 * time.Millisecond,
+			Ding:             10 * time.Millisecond,
+			Stats:            20 * time.Millisecond,
+			Keepalive:        20 * time.Millisecond,
+			Timeout:          250 * time.Millisecond,
+		},
+	}
+}
+
+func TestHostAndClient(t *testing.T) {
+	Convey("Host and Client", t, func() {
+		host, err := sluice.MakeHost("127.0.0.1:0", makeTestConfig())
+		So(err, ShouldBeNil)
+		defer host.Close()
+		client, err := sluice.MakeClient(host.Addr().String(), makeTestConfig())
+		So(err, ShouldBeNil)
+		defer client.Close()
+		So(client.NodeId(), ShouldEqual, core.HostNodeId+1)
+		So(<-host.Events(), ShouldResemble, sluice.Event{Type: sluice.EventJoin, Node: client.NodeId()})
+
+		Convey("Closing the host closes Recv, even if some packets were never received.", func() {
+			So(client.Send("RO", []byte("unread")), ShouldBeNil)
+			time.Sleep(50 * time.Millisecond)
+			So(host.Close(), ShouldBeNil)
+			closed := make(chan struct{})
+			go func() {
+				for range host.Recv() {
+				}
+				close(closed)
+			}()
+			select {
+			case <-closed:
+			case <-time.After(time.Second):
+				So("Recv was never closed", ShouldBeNil)
+			}
+		})
+
+		Convey("Sending on an unknown stream is an error.", func() {
+			So(client.Send("Unknown", []byte("data")), ShouldNotBeNil)
+			So(host.SendTo(client.NodeId(), "Unknown", []byte("data")), ShouldNotBeNil)
+		})
+
+		Convey("Sending to a node that isn't connected is an error.", func() {
+			So(host.SendTo(client.NodeId()+1, "RO", []byte("data")), ShouldNotBeNil)
+		})
+
+		Convey("Sending on a non-broadcast stream with Send is an error.", func() {
+			So(host.Send("UU", []byte("data")), ShouldNotBeNil)
+		})
+
+		Convey("The host receives packets sent by a client.", func() {
+			So(client.Send("UU", []byte("A long packet that will need to be split into multiple chunks.")), ShouldBeNil)
+			packet := <-host.Recv()
+			So(packet.Source, ShouldEqual, client.NodeId())
+			So(packet.Stream, ShouldEqual, 7)
+			So(string(packet.Data), ShouldEqual, "A long packet that will need to be split into multiple chunks.")
+		})
+
+		Convey("Reliable packets sent by a client all arrive at the host in order.", func() {
+			go func() {
+				for i := 0; i < 20; i++ {
+					client.Send("RO", []byte(fmt.Sprintf("packet %d", i)))
+				}
+			}()
+			for i := 0; i < 20; i++ {
+				packet := <-host.Recv()
+				So(string(packet.Data), ShouldEqual, fmt.Sprintf("packet %d", i))
+			}
+		})
+
+		Convey("The host can send to a client once it has joined.", func() {
+			So(host.SendTo(client.NodeId(), "RO", []byte("A long packet that will need to be split into multiple chunks.")), ShouldBeNil)
+			packet := <-client.Recv()
+			So(packet.Source, ShouldEqual, core.HostNodeId)
+			So(string(packet.Data), ShouldEqual, "A long packet that will need to be split into multiple chunks.")
+		})
+
+		Convey("Broadcast packets from one client are relayed to the others.", func() {
+			other, err := sluice.MakeClient(host.Addr().String(), makeTestConfig())
+			So(err, ShouldBeNil)
+			defer other.Close()
+			So(<-host.Events(), ShouldResemble, sluice.Event{Type: sluice.EventJoin, Node: other.NodeId()})
+
+			go func() {
+				for i := 0; i < 20; i++ {
+					client.Send("RB", []byte(fmt.Sprintf("A longer broadcast packet, number %d", i)))
+				}
+			}()
+			for i := 0; i < 20; i++ {
+				packet := <-other.Recv()
+				So(packet.Source, ShouldEqual, client.NodeId())
+				So(string(packet.Data), ShouldEqual, fmt.Sprintf("A longer broadcast packet, number %d", i))
+				packet = <-host.Recv()
+				So(packet.Source, ShouldEqual, client.NodeId())
+				So(string(packet.Data), ShouldEqual, fmt.Sprintf("A longer broadcast packet, number %d", i))
+			}
+		})
+
+		Convey("Clients are told about each other joining and leaving.", func() {
+			other, err := sluice.MakeClient(host.Addr().String(), makeTestConfig())
+			So(err, ShouldBeNil)
+			So(other.NodeId(), ShouldEqual, client.NodeId()+1)
+			So(<-client.Events(), ShouldResemble, sluice.Event{Type: sluice.EventJoin, Node: other.NodeId()})
+			So(<-other.Events(), ShouldResemble, sluice.Event{Type: sluice.EventJoin, Node: client.NodeId()})
+			So(<-host.Events(), ShouldResemble, sluice.Event{Type: sluice.EventJoin, Node: other.NodeId()})
+
+			So(host.SendTo(other.NodeId(), "RO", []byte("data")), ShouldBeNil)
+			So(other.Close(), ShouldBeNil)
+			So(<-host.Events(), ShouldResemble, sluice.Event{Type: sluice.EventLeave, Node: other.NodeId()})
+			So(<-client.Events(), ShouldResemble, sluice.Event{Type: sluice.EventLeave, Node: other.NodeId()})
+			So(host.SendTo(other.NodeId(), "RO", []byte("data")), ShouldNotBeNil)
+
+			Convey("And NodeIds are never reused.", func() {
+				another, err := sluice.MakeClient(host.Addr().String(), makeTestConfig())
+				So(err, ShouldBeNil)
+				defer another.Close()
+				So(another.NodeId(), ShouldEqual, other.NodeId()+1)
+			})
+		})
+
+		Convey("Clients that join late get reliable broadcast packets starting at the next one.", func() {
+			for i := 0; i < 10; i++ {
+				So(host.Send("RB", []byte(fmt.Sprintf("A longer broadcast packet from the host, number %d", i))), ShouldBeNil)
+				So(client.Send("RB", []byte(fmt.Sprintf("A longer broadcast packet from a client, number %d", i))), ShouldBeNil)
+			}
+			// Once the client has everything the host sent, and the host has everything the client sent,
+			// all of it has been relayed.
+			for i := 0; i < 10; i++ {
+				<-client.Recv()
+				<-host.Recv()
+			}
+			go func() {
+				for range host.Recv() {
+				}
+			}()
+
+			late, err := sluice.MakeClient(host.Addr().String(), makeTestConfig())
+			So(err, ShouldBeNil)
+			defer late.Close()
+			for i := 10; i < 20; i++ {
+				So(host.Send("RB", []byte(fmt.Sprintf("A longer broadcast packet from the host, number %d", i))), ShouldBeNil)
+				So(client.Send("RB", []byte(fmt.Sprintf("A longer broadcast packet from a client, number %d", i))), ShouldBeNil)
+			}
+			next := map[core.NodeId]int{core.HostNodeId: 10, client.NodeId(): 10}
+			for i := 0; i < 20; i++ {
+				packet := <-late.Recv()
+				var from string
+				switch packet.Source {
+				case core.HostNodeId:
+					from = "the host"
+				case client.NodeId():
+					from = "a client"
+				}
+				So(string(packet.Data), ShouldEqual, fmt.Sprintf("A longer broadcast packet from %s, number %d", from, next[packet.Source]))
+				next[packet.Source]++
+			}
+		})
+
+		Convey("The host measures the round trip time to each client.", func() {
+			var rtt core.RTT
+			for i := 0; i < 100 && rtt.Samples < 5; i++ {
+				time.Sleep(10 * time.Millisecond)
+				rtt, _ = host.RTT(client.NodeId())
+			}
+			So(rtt.Samples, ShouldBeGreaterThanOrEqualTo, 5)
+
+			// Pings and pongs aren't batched with anything else, which would add up to 5ms each way.
+			So(rtt.Smoothed, ShouldBeLessThan, 5*time.Millisecond)
+		})
+
+		Convey("Clients measure the round trip time to the host, and report it to the host.", func() {
+			var rtt core.RTT
+			ok := false
+			for i := 0; i < 100 && !ok; i++ {
+				time.Sleep(10 * time.Millisecond)
+				rtt, ok = client.RTT()
+			}
+			So(ok, ShouldBeTrue)
+			So(rtt.Smoothed, ShouldBeLessThan, time.Second)
+
+			var stats []core.PeerStats
+			for i := 0; i < 100 && (len(stats) == 0 || stats[0].RTT == 0); i++ {
+				time.Sleep(10 * time.Millisecond)
+				stats = host.Stats(client.NodeId())
+			}
+			So(len(stats), ShouldEqual, 1)
+			So(stats[0].Node, ShouldEqual, core.HostNodeId)
+			So(stats[0].RTT, ShouldBeGreaterThan, 0)
+			So(stats[0].RTT, ShouldBeLessThan, time.Second)
+			So(len(host.AllStats()[client.NodeId()]), ShouldEqual, 1)
+		})
+
+		Convey("The host measures the latency between every pair of clients.", func() {
+			other, err := sluice.MakeClient(host.Addr().String(), makeTestConfig())
+			So(err, ShouldBeNil)
+			defer other.Close()
+			links := []core.Link{
+				{From: client.NodeId(), To: other.NodeId()},
+				{From: other.NodeId(), To: client.NodeId()},
+			}
+			for i := 0; i < 100 && len(host.Latencies()) < len(links); i++ {
+				time.Sleep(10 * time.Millisecond)
+			}
+			for _, link := range links {
+				latency, ok := host.Latency(link.From, link.To)
+				So(ok, ShouldBeTrue)
+				So(latency.Smoothed, ShouldBeLessThan, time.Second)
+			}
+		})
+
+		Convey("Clients that are close to each other send broadcast packets directly.", func() {
+			go func() {
+				for range host.Recv() {
+				}
+			}()
+			other, err := sluice.MakeClient(host.Addr().String(), makeTestConfig())
+			So(err, ShouldBeNil)
+			defer other.Close()
+
+			// On loopback the clients are always closer to each other than going through the host,
+			// since going through the host takes twice as many hops.
+			direct := false
+			for i := 0; i < 200 && !direct; i++ {
+				time.Sleep(10 * time.Millisecond)
+				direct = len(client.Peers()) == 1 && len(other.Peers()) == 1
+			}
+			So(direct, ShouldBeTrue)
+			So(client.Peers(), ShouldResemble, []core.NodeId{other.NodeId()})
+			So(other.Peers(), ShouldResemble, []core.NodeId{client.NodeId()})
+
+			Convey("And reliable packets are only received once, even though the host relays them too.", func() {
+				for i := 0; i < 20; i++ {
+					So(client.Send("RB", []byte(fmt.Sprintf("A longer broadcast packet, number %d", i))), ShouldBeNil)
+				}
+				for i := 0; i < 20; i++ {
+					packet := <-other.Recv()
+					So(packet.Source, ShouldEqual, client.NodeId())
+					So(string(packet.Data), ShouldEqual, fmt.Sprintf("A longer broadcast packet, number %d", i))
+				}
+				select {
+				case packet := <-other.Recv():
+					So(string(packet.Data), ShouldBeEmpty)
+				case <-time.After(50 * time.Millisecond):
+				}
+			})
+
+			Convey("And unreliable packets get through without the host relaying them.", func() {
+				var packet core.Packet
+				received := false
+				for i := 0; i < 100 && !received; i++ {
+					So(client.Send("UB", []byte("direct")), ShouldBeNil)
+					select {
+					case packet = <-other.Recv():
+						received = true
+					case <-time.After(10 * time.Millisecond):
+					}
+				}
+				So(received, ShouldBeTrue)
+				So(packet.Source, ShouldEqual, client.NodeId())
+				So(string(packet.Data), ShouldEqual, "direct")
+			})
+
+			Convey("And stop once one of them leaves.", func() {
+				So(other.Close(), ShouldBeNil)
+				for event := range client.Events() {
+					if event.Type == sluice.EventLeave {
+						break
+					}
+				}
+				So(len(client.Peers()), ShouldEqual, 0)
+			})
+		})
+
+		Convey("Clients that go silent are removed, and the other clients are told they left.", func() {
+			conn, silent, _ := joinRaw(host)
+			defer conn.Close()
+			So(<-host.Events(), ShouldResemble, sluice.Event{Type: sluice.EventJoin, Node: silent})
+			So(<-client.Events(), ShouldResemble, sluice.Event{Type: sluice.EventJoin, Node: silent})
+
+			start := time.Now()
+			So(<-host.Events(), ShouldResemble, sluice.Event{Type: sluice.EventLeave, Node: silent, Reason: core.LeaveTimeout})
+			So(time.Since(start), ShouldBeGreaterThan, 200*time.Millisecond)
+			So(<-client.Events(), ShouldResemble, sluice.Event{Type: sluice.EventLeave, Node: silent, Reason: core.LeaveTimeout})
+		})
+
+		Convey("Requests to join are answered with a cookie that is no bigger than the request.", func() {
+			conn, err := net.DialUDP("udp", nil, host.Addr().(*net.UDPAddr))
+			So(err, ShouldBeNil)
+			defer conn.Close()
+			request := &lengthWriter{w: conn}
+			core.WriteChunks([]core.Chunk{{Stream: core.StreamJoin, Data: core.MakeJoinChunkData(&core.JoinRequest{Versions: core.SupportedVersions})}}, core.NoConnection, request)
+			So(request.n, ShouldBeGreaterThan, 0)
+			buf := make([]byte, 65536)
+			n, err := conn.Read(buf)
+			So(err, ShouldBeNil)
+			So(n, ShouldBeLessThanOrEqualTo, request.n)
+			chunks, err := core.ParseChunks(buf[0:n])
+			So(err, ShouldBeNil)
+			So(len(chunks), ShouldEqual, 1)
+			So(chunks[0].Stream, ShouldEqual, core.StreamCookie)
+
+			Convey("Requests that are too small, or have bad cookies, aren't welcomed.", func() {
+				core.WriteChunks([]core.Chunk{{Stream: core.StreamJoin}}, core.NoConnection, conn)
+				cookie := chunks[0].Data
+				cookie[len(cookie)-1]++
+				core.WriteChunks([]core.Chunk{{Stream: core.StreamJoin, Data: core.MakeJoinChunkData(&core.JoinRequest{Versions: core.SupportedVersions, Cookie: cookie})}}, core.NoConnection, conn)
+				conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+				for {
+					n, err := conn.Read(buf)
+					if err != nil {
+						break
+					}
+					chunks, err := core.ParseChunks(buf[0:n])
+					So(err, ShouldBeNil)
+					So(len(chunks), ShouldEqual, 1)
+					So(chunks[0].Stream, ShouldEqual, core.StreamCookie)
+				}
+				select {
+				case event := <-host.Events():
+					So(event, ShouldBeNil)
+				default:
+				}
+			})
+		})
+
+		Convey("Chunks are only accepted on the connection the host gave the client.", func() {
+			conn, node, connection := joinRaw(host)
+			defer conn.Close()
+			So(<-host.Events(), ShouldResemble, sluice.Event{Type: sluice.EventJoin, Node: node})
+
+			chunk := core.Chunk{
+				Source:   node,
+				Target:   core.HostNodeId,
+				Stream:   makeTestConfig().GetIdFromName("RO"),
+				Sequence: core.FirstSequenceId,
+				Data:     []byte("wrong connection"),
+			}
+			core.WriteChunks([]core.Chunk{chunk}, connection+1, conn)
+			core.WriteChunks([]core.Chunk{chunk}, core.NoConnection, conn)
+			chunk.Data = []byte("right connection")
+			core.WriteChunks([]core.Chunk{chunk}, connection, conn)
+			packet := <-host.Recv()
+			So(packet.Source, ShouldEqual, node)
+			So(string(packet.Data), ShouldEqual, "right connection")
+		})
+
+		Convey("Chunks from a client that sends faster than the host can keep up are dropped and counted.", func() {
+			conn, node, connection := joinRaw(host)
+			defer conn.Close()
+			So(<-host.Events(), ShouldResemble, sluice.Event{Type: sluice.EventJoin, Node: node})
+
+			// Nothing is reading host.Recv, so the host can't get through any of these.
+			sequence := core.FirstSequenceId
+			for i := 0; i < 100; i++ {
+				var chunks []core.Chunk
+				for j := 0; j < 40; j++ {
+					chunks = append(chunks, core.Chunk{
+						Source:   node,
+						Target:   core.HostNodeId,
+						Stream:   makeTestConfig().GetIdFromName("UU"),
+						Sequence: sequence,
+						Data:     []byte("flood"),
+					})
+					sequence++
+				}
+				core.WriteChunks(chunks, connection, conn)
+			}
+			for i := 0; i < 100 && host.Counters().Overflowed == 0; i++ {
+				time.Sleep(10 * time.Millisecond)
+			}
+			So(host.Counters().Overflowed, ShouldBeGreaterThan, 0)
+			So(host.Counters().Overflowed, ShouldBeLessThan, 4000)
+		})
+
+		Convey("Chunks that claim to be from another node are dropped, and clients that keep sending them are kicked.", func() {
+			conn, node, connection := joinRaw(host)
+			defer conn.Close()
+			So(<-host.Events(), ShouldResemble, sluice.Event{Type: sluice.EventJoin, Node: node})
+			So(<-client.Events(), ShouldResemble, sluice.Event{Type: sluice.EventJoin, Node: node})
+
+			chunk := core.Chunk{
+				Source:   node,
+				Target:   core.HostNodeId,
+				Stream:   makeTestConfig().GetIdFromName("RO"),
+				Sequence: core.FirstSequenceId,
+				Data:     []byte("honest"),
+			}
+			spoofed := chunk
+			spoofed.Source = client.NodeId()
+			spoofed.Data = []byte("spoofed")
+			core.WriteChunks([]core.Chunk{spoofed, chunk}, connection, conn)
+			packet := <-host.Recv()
+			So(packet.Source, ShouldEqual, node)
+			So(string(packet.Data), ShouldEqual, "honest")
+			So(host.Counters().Spoofed, ShouldEqual, 1)
+
+			chunk.Source = core.HostNodeId
+			var chunks []core.Chunk
+			for i := 0; i < 100; i++ {
+				chunks = append(chunks, chunk)
+			}
+			core.WriteChunks(chunks, connection, conn)
+			So(<-host.Events(), ShouldResemble, sluice.Event{Type: sluice.EventLeave, Node: node, Reason: core.LeaveKicked})
+			So(<-client.Events(), ShouldResemble, sluice.Event{Type: sluice.EventLeave, Node: node, Reason: core.LeaveKicked})
+
+			// The kicked client is told that it was kicked.
+			buf := make([]byte, 65536)
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+			kicked := false
+			for !kicked {
+				n, err := conn.Read(buf)
+				So(err, ShouldBeNil)
+				chunks, err := core.ParseChunks(buf[0:n])
+				So(err, ShouldBeNil)
+				for _, chunk := range chunks {
+					if chunk.Stream != core.StreamLeave {
+						continue
+					}
+					if leaving, reason, err := core.ParseLeaveChunkData(chunk.Data); err == nil && leaving == core.HostNodeId {
+						So(reason, ShouldEqual, core.LeaveKicked)
+						kicked = true
+					}
+				}
+			}
+		})
+
+		Convey("Clients are told when the host shuts down, and are closed.", func() {
+			start := time.Now()
+			host.Close()
+			event, ok := <-client.Events()
+			So(ok, ShouldBeTrue)
+			So(event, ShouldResemble, sluice.Event{Type: sluice.EventLeave, Node: core.HostNodeId, Reason: core.LeaveShutdown})
+			So(time.Since(start), ShouldBeLessThan, 200*time.Millisecond)
+			_, ok = <-client.Events()
+			So(ok, ShouldBeFalse)
+			So(client.Send("UU", []byte("data")), ShouldNotBeNil)
+		})
+
+		Convey("Clients that close get everything they sent reliably to the host before they leave.", func() {
+			for i := 0; i < 20; i++ {
+				So(client.Send("RO", []byte(fmt.Sprintf("packet %d", i))), ShouldBeNil)
+			}
+			closed := make(chan error)
+			go func() {
+				closed <- client.Close()
+			}()
+			for i := 0; i < 20; i++ {
+				packet := <-host.Recv()
+				So(string(packet.Data), ShouldEqual, fmt.Sprintf("packet %d", i))
+			}
+			So(<-closed, ShouldBeNil)
+			So(<-host.Events(), ShouldResemble, sluice.Event{Type: sluice.EventLeave, Node: client.NodeId(), Reason: core.LeaveClosed})
+		})
+
+		Convey("Idle clients are not removed.", func() {
+			time.Sleep(400 * time.Millisecond)
+			So(host.SendTo(client.NodeId(), "RO", []byte("still here")), ShouldBeNil)
+			packet := <-client.Recv()
+			So(string(packet.Data), ShouldEqual, "still here")
+		})
+	})
+}
+
+// joinRaw joins host over a plain UDP connection, and returns the connection along with the NodeId
+// and ConnectionId the host gave it.
+func joinRaw(host *sluice.Host) (*net.UDPConn, core.NodeId, core.ConnectionId) {
+	conn, err := net.DialUDP("udp", nil, host.Addr().(*net.UDPAddr))
+	So(err, ShouldBeNil)
+	core.WriteChunks([]core.Chunk{{Stream: core.StreamJoin, Data: core.MakeJoinChunkData(&core.JoinRequest{Versions: core.SupportedVersions})}}, core.NoConnection, conn)
+	buf := make([]byte, 65536)
+	for {
+		n, err := conn.Read(buf)
+		So(err, ShouldBeNil)
+		chunks, err := core.ParseChunks(buf[0:n])
+		So(err, ShouldBeNil)
+		for _, chunk := range chunks {
+			switch chunk.Stream {
+			case core.StreamCookie:
+				core.WriteChunks([]core.Chunk{{Stream: core.StreamJoin, Data: core.MakeJoinChunkData(&core.JoinRequest{Versions: core.SupportedVersions, Cookie: chunk.Data})}}, core.NoConnection, conn)
+			case core.StreamWelcome:
+				welcome, _, err := core.ParseWelcomeChunkData(chunk.Data)
+				So(err, ShouldBeNil)
+				return conn, welcome.Node, chunk.Connection
+			}
+		}
+	}
+}
+
+// welcomeChunks returns the chunks a host with config sends to welcome a client as node.
+func welcomeChunks(config *core.Config, node core.NodeId) []core.Chunk {
+	var chunks []core.Chunk
+	for _, data := range core.MakeGlobalConfigChunkDatas(config, &config.GlobalConfig) {
+		chunks = append(chunks, core.Chunk{Stream: core.StreamGlobalConfig, Data: data})
+	}
+	w := &core.Welcome{Node: node, Version: core.SupportedVersions.Min, Starts: make(map[core.Streamlet]core.SequenceId)}
+	for _, data := range core.MakeWelcomeChunkDatas(config, w) {
+		chunks = append(chunks, core.Chunk{Stream: core.StreamWelcome, Data: data})
+	}
+	return chunks
+}
+
+// udpWriter is an io.Writer that sends everything written to it to addr on conn.
+type udpWriter struct {
+	conn *net.UDPConn
+	addr *net.UDPAddr
+}
+
+func (w udpWriter) Write(buf []byte) (int, error) {
+	return w.conn.WriteToUDP(buf, w.addr)
+}
+
+// lengthWriter is an io.Writer that passes everything written to it on to w, and remembers how
+// many bytes were in the last write.
+type lengthWriter struct {
+	w io.Writer
+	n int
+}
+
+func (w *lengthWriter) Write(buf []byte) (int, error) {
+	w.n = len(buf)
+	return w.w.Write(buf)
+}
+
+func TestDangs(t *testing.T) {
+	Convey("Clients only answer the Dangs that the host told them to expect.", t, func() {
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+		So(err, ShouldBeNil)
+		defer conn.Close()
+
+		// This host welcomes the first client to ask, and then only does what the test tells it to.
+		config := makeTestConfig()
+		config.Timeout = 0
+		joined := make(chan *net.UDPAddr, 1)
+		go func() {
+			_, addr, err := conn.ReadFromUDP(make([]byte, 65536))
+			if err != nil {
+				return
+			}
+			for _, chunk := range welcomeChunks(config, core.HostNodeId+1) {
+				core.WriteChunks([]core.Chunk{chunk}, 6, udpWriter{conn, addr})
+			}
+			joined <- addr
+		}()
+		client, err := sluice.MakeClient(conn.LocalAddr().String(), makeTestConfig())
+		So(err, ShouldBeNil)
+		defer client.Close()
+		addr := <-joined
+
+		// dongs returns the SequenceIds of the Dongs the client sends the host in the next 100ms.
+		dongs := func() []core.SequenceId {
+			var sequences []core.SequenceId
+			buf := make([]byte, 65536)
+			conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+			for {
+				n, err := conn.Read(buf)
+				if err != nil {
+					return sequences
+				}
+				chunks, err := core.ParseChunks(buf[0:n])
+				So(err, ShouldBeNil)
+				for _, chunk := range chunks {
+					if chunk.Stream == core.StreamDong {
+						sequences = append(sequences, chunk.Sequence)
+					}
+				}
+			}
+		}
+
+		peer, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+		So(err, ShouldBeNil)
+		defer peer.Close()
+		spoofer, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+		So(err, ShouldBeNil)
+		defer spoofer.Close()
+		dang := []core.Chunk{{Stream: core.StreamDang, Source: 5, Target: client.NodeId(), Sequence: 7}}
+		core.WriteChunks(dang, core.NoConnection, udpWriter{peer, addr})
+		So(dongs(), ShouldBeEmpty)
+
+		expect := core.Chunk{
+			Stream:   core.StreamDang,
+			Source:   core.HostNodeId,
+			Target:   client.NodeId(),
+			Sequence: 7,
+			Data:     core.MakeDingChunkData(5, peer.LocalAddr().String()),
+		}
+		core.WriteChunks([]core.Chunk{expect}, 6, udpWriter{conn, addr})
+		time.Sleep(10 * time.Millisecond)
+		core.WriteChunks(dang, core.NoConnection, udpWriter{spoofer, addr})
+		So(dongs(), ShouldBeEmpty)
+		core.WriteChunks(dang, core.NoConnection, udpWriter{peer, addr})
+		So(dongs(), ShouldResemble, []core.SequenceId{7})
+	})
+}
+
+func TestClientTimeout(t *testing.T) {
+	Convey("Clients that stop hearing from the host are closed.", t, func() {
+		// This host welcomes the first client that asks to join, and then never says anything again.
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		So(err, ShouldBeNil)
+		defer conn.Close()
+		config := makeTestConfig()
+		go func() {
+			buf := make([]byte, 1024)
+			_, addr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			var chunks []core.Chunk
+			for _, data := range core.MakeGlobalConfigChunkDatas(config, &config.GlobalConfig) {
+				chunks = append(chunks, core.Chunk{Stream: core.StreamGlobalConfig, Source: core.HostNodeId, Target: 5, Data: data})
+			}
+			for _, data := range core.MakeWelcomeChunkDatas(config, &core.Welcome{Node: 5, Version: core.SupportedVersions.Max}) {
+				chunks = append(chunks, core.Chunk{Stream: core.StreamWelcome, Source: core.HostNodeId, Target: 5, Data: data})
+			}
+			core.WriteChunks(chunks, 7, udpWriter{conn, addr})
+		}()
+
+		client, err := sluice.MakeClient(conn.LocalAddr().String(), config)
+		So(err, ShouldBeNil)
+		defer client.Close()
+		So(client.NodeId(), ShouldEqual, 5)
+		start := time.Now()
+		event, ok := <-client.Events()
+		So(ok, ShouldBeTrue)
+		So(event, ShouldResemble, sluice.Event{Type: sluice.EventLeave, Node: core.HostNodeId, Reason: core.LeaveTimeout})
+		So(time.Since(start), ShouldBeGreaterThan, 200*time.Millisecond)
+		_, ok = <-client.Events()
+		So(ok, ShouldBeFalse)
+	})
+}
+
+// rebindingProxy forwards datagrams between a client and a host.  Rebind makes everything from the
+// client come from a new address, the way a NAT might, and anything the host still sends to the old
+// address is lost.
+type rebindingProxy struct {
+	conn *net.UDPConn
+	host *net.UDPAddr
+
+	mu       sync.Mutex
+	client   *net.UDPAddr
+	upstream *net.UDPConn
+
+	// replay makes the proxy send everything from the client to the host twice.
+	replay bool
+
+	// drop makes the proxy lose everything from the host to the client.
+	drop bool
+}
+
+func makeRebindingProxy(host *net.UDPAddr) (*rebindingProxy, error) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		return nil, err
+	}
+	p := &rebindingProxy{conn: conn, host: host}
+	if err := p.Rebind(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	go func() {
+		buf := make([]byte, 65536)
+		for {
+			n, addr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			p.mu.Lock()
+			p.client = addr
+			p.upstream.WriteToUDP(buf[0:n], p.host)
+			if p.replay {
+				p.upstream.WriteToUDP(buf[0:n], p.host)
+			}
+			p.mu.Unlock()
+		}
+	}()
+	return p, nil
+}
+
+func (p *rebindingProxy) Addr() net.Addr {
+	return p.conn.LocalAddr()
+}
+
+func (p *rebindingProxy) Rebind() error {
+	upstream, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	if p.upstream != nil {
+		p.upstream.Close()
+	}
+	p.upstream = upstream
+	p.mu.Unlock()
+	go func() {
+		buf := make([]byte, 65536)
+		for {
+			n, err := upstream.Read(buf)
+			if err != nil {
+				return
+			}
+			p.mu.Lock()
+			if !p.drop {
+				p.conn.WriteToUDP(buf[0:n], p.client)
+			}
+			p.mu.Unlock()
+		}
+	}()
+	return nil
+}
+
+func (p *rebindingProxy) SetReplay(replay bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.replay = replay
+}
+
+func (p *rebindingProxy) SetDrop(drop bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.drop = drop
+}
+
+func (p *rebindingProxy) Close() error {
+	p.mu.Lock()
+	p.upstream.Close()
+	p.mu.Unlock()
+	return p.conn.Close()
+}
+
+func TestSessionResumption(t *testing.T) {
+	Convey("Clients whose address changes keep their session.", t, func() {
+		host, err := sluice.MakeHost("127.0.0.1:0", makeTestConfig())
+		So(err, ShouldBeNil)
+		defer host.Close()
+		proxy, err := makeRebindingProxy(host.Addr().(*net.UDPAddr))
+		So(err, ShouldBeNil)
+		defer proxy.Close()
+		client, err := sluice.MakeClient(proxy.Addr().String(), makeTestConfig())
+		So(err, ShouldBeNil)
+		defer client.Close()
+		So(<-host.Events(), ShouldResemble, sluice.Event{Type: sluice.EventJoin, Node: client.NodeId()})
+
+		for i := 0; i < 10; i++ {
+			So(host.SendTo(client.NodeId(), "RO", []byte(fmt.Sprintf("packet %d", i))), ShouldBeNil)
+		}
+		for i := 0; i < 10; i++ {
+			So(string((<-client.Recv()).Data), ShouldEqual, fmt.Sprintf("packet %d", i))
+		}
+
+		So(proxy.Rebind(), ShouldBeNil)
+		go func() {
+			for i := 10; i < 30; i++ {
+				host.SendTo(client.NodeId(), "RO", []byte(fmt.Sprintf("packet %d", i)))
+			}
+		}()
+		go func() {
+			for i := 0; i < 20; i++ {
+				client.Send("RO", []byte(fmt.Sprintf("packet %d", i)))
+			}
+		}()
+		fromClient := make(chan core.Packet, 20)
+		go func() {
+			for i := 0; i < 20; i++ {
+				fromClient <- <-host.Recv()
+			}
+		}()
+		for i := 10; i < 30; i++ {
+			packet := <-client.Recv()
+			So(packet.Source, ShouldEqual, core.HostNodeId)
+			So(string(packet.Data), ShouldEqual, fmt.Sprintf("packet %d", i))
+		}
+		for i := 0; i < 20; i++ {
+			packet := <-fromClient
+			So(packet.Source, ShouldEqual, client.NodeId())
+			So(string(packet.Data), ShouldEqual, fmt.Sprintf("packet %d", i))
+		}
+		time.Sleep(300 * time.Millisecond)
+		select {
+		case event := <-host.Events():
+			So(event, ShouldBeNil)
+		default:
+		}
+	})
+}
+
+func TestLostChunks(t *testing.T) {
+	Convey("Reliable packets arrive even if everything the host sent on their stream was lost.", t, func() {
+		host, err := sluice.MakeHost("127.0.0.1:0", makeTestConfig())
+		So(err, ShouldBeNil)
+		defer host.Close()
+		proxy, err := makeRebindingProxy(host.Addr().(*net.UDPAddr))
+		So(err, ShouldBeNil)
+		defer proxy.Close()
+		client, err := sluice.MakeClient(proxy.Addr().String(), makeTestConfig())
+		So(err, ShouldBeNil)
+		defer client.Close()
+		So(<-host.Events(), ShouldResemble, sluice.Event{Type: sluice.EventJoin, Node: client.NodeId()})
+
+		proxy.SetDrop(true)
+		So(host.SendTo(client.NodeId(), "RO", []byte("lost the first time")), ShouldBeNil)
+		time.Sleep(50 * time.Millisecond)
+		proxy.SetDrop(false)
+		select {
+		case packet := <-client.Recv():
+			So(packet.Source, ShouldEqual, core.HostNodeId)
+			So(string(packet.Data), ShouldEqual, "lost the first time")
+		case <-time.After(time.Second):
+			So("the packet never arrived", ShouldBeNil)
+		}
+	})
+}
+
+func TestEncryption(t *testing.T) {
+	Convey("Hosts and clients with a key", t, func() {
+		config := func() *core.Config {
+			config := makeTestConfig()
+			config.Key = []byte("0123456789abcdef")
+			return config
+		}
+		host, err := sluice.MakeHost("127.0.0.1:0", config())
+		So(err, ShouldBeNil)
+		defer host.Close()
+		client, err := sluice.MakeClient(host.Addr().String(), config())
+		So(err, ShouldBeNil)
+		defer client.Close()
+		So(<-host.Events(), ShouldResemble, sluice.Event{Type: sluice.EventJoin, Node: client.NodeId()})
+
+		Convey("can talk to each other.", func() {
+			So(host.SendTo(client.NodeId(), "RO", []byte("hello")), ShouldBeNil)
+			So(string((<-client.Recv()).Data), ShouldEqual, "hello")
+			So(client.Send("RO", []byte("hi")), ShouldBeNil)
+			So(string((<-host.Recv()).Data), ShouldEqual, "hi")
+		})
+
+		Convey("answer requests to join with a cookie that is no bigger than the request.", func() {
+			conn, err := net.DialUDP("udp", nil, host.Addr().(*net.UDPAddr))
+			So(err, ShouldBeNil)
+			defer conn.Close()
+			framer, err := core.MakeFramer(config().Key)
+			So(err, ShouldBeNil)
+			request := &lengthWriter{w: conn}
+			framer.WriteChunks([]core.Chunk{{Stream: core.StreamJoin, Data: core.MakeJoinChunkData(&core.JoinRequest{Versions: core.SupportedVersions})}}, core.NoConnection, request)
+			So(request.n, ShouldBeGreaterThan, 0)
+			buf := make([]byte, 65536)
+			n, err := conn.Read(buf)
+			So(err, ShouldBeNil)
+			So(n, ShouldBeLessThanOrEqualTo, request.n)
+			chunks, err := framer.ParseChunks(buf[0:n])
+			So(err, ShouldBeNil)
+			So(len(chunks), ShouldEqual, 1)
+			So(chunks[0].Stream, ShouldEqual, core.StreamCookie)
+		})
+
+		Convey("ignore anyone without the key.", func() {
+			conn, err := net.DialUDP("udp", nil, host.Addr().(*net.UDPAddr))
+			So(err, ShouldBeNil)
+			defer conn.Close()
+			core.WriteChunks([]core.Chunk{{Stream: core.StreamJoin, Data: core.MakeJoinChunkData(&core.JoinRequest{Versions: core.SupportedVersions})}}, core.NoConnection, conn)
+			conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+			_, err = conn.Read(make([]byte, 1024))
+			So(err, ShouldNotBeNil)
+
+			other := makeTestConfig()
+			other.Key = []byte("fedcba9876543210")
+			_, err = sluice.MakeClient(host.Addr().String(), other)
+			So(err, ShouldNotBeNil)
+			select {
+			case event := <-host.Events():
+				So(event, ShouldBeNil)
+			default:
+			}
+		})
+	})
+}
+
+func TestSessionKeys(t *testing.T) {
+	Convey("Hosts with an Identity", t, func() {
+		identity, err := ecdh.X25519().GenerateKey(rand.Reader)
+		So(err, ShouldBeNil)
+		config := makeTestConfig()
+		config.Identity = identity
+		host, err := sluice.MakeHost("127.0.0.1:0", config)
+		So(err, ShouldBeNil)
+		defer host.Close()
+		So(host.PublicKey(), ShouldResemble, identity.PublicKey().Bytes())
+
+		Convey("talk to clients that expect their key.", func() {
+			config := makeTestConfig()
+			config.HostKey = host.PublicKey()
+			client, err := sluice.MakeClient(host.Addr().String(), config)
+			So(err, ShouldBeNil)
+			defer client.Close()
+			So(<-host.Events(), ShouldResemble, sluice.Event{Type: sluice.EventJoin, Node: client.NodeId()})
+			So(client.HostKey(), ShouldResemble, host.PublicKey())
+			So(host.SendTo(client.NodeId(), "RO", []byte("hello")), ShouldBeNil)
+			So(string((<-client.Recv()).Data), ShouldEqual, "hello")
+			So(client.Send("RO", []byte("hi")), ShouldBeNil)
+			So(string((<-host.Recv()).Data), ShouldEqual, "hi")
+		})
+
+		Convey("tell clients that don't expect a key what their key is.", func() {
+			client, err := sluice.MakeClient(host.Addr().String(), makeTestConfig())
+			So(err, ShouldBeNil)
+			defer client.Close()
+			So(<-host.Events(), ShouldResemble, sluice.Event{Type: sluice.EventJoin, Node: client.NodeId()})
+			So(client.HostKey(), ShouldResemble, host.PublicKey())
+			So(client.Send("RO", []byte("hi")), ShouldBeNil)
+			So(string((<-host.Recv()).Data), ShouldEqual, "hi")
+		})
+
+		Convey("are refused by clients that expect another key.", func() {
+			other, err := ecdh.X25519().GenerateKey(rand.Reader)
+			So(err, ShouldBeNil)
+			config := makeTestConfig()
+			config.HostKey = other.PublicKey().Bytes()
+			_, err = sluice.MakeClient(host.Addr().String(), config)
+			So(err, ShouldNotBeNil)
+			So(err.Error(), ShouldContainSubstring, "key")
+		})
+
+		Convey("refuse clients that don't do a key exchange.", func() {
+			for _, ephemeral := range [][]byte{nil, []byte("too short")} {
+				conn, err := net.DialUDP("udp", nil, host.Addr().(*net.UDPAddr))
+				So(err, ShouldBeNil)
+				defer conn.Close()
+				request := &core.JoinRequest{Versions: core.SupportedVersions, Ephemeral: ephemeral}
+				core.WriteChunks([]core.Chunk{{Stream: core.StreamJoin, Data: core.MakeJoinChunkData(request)}}, core.NoConnection, conn)
+				buf := make([]byte, 1024)
+				n, err := conn.Read(buf)
+				So(err, ShouldBeNil)
+				chunks, err := core.ParseChunks(buf[0:n])
+				So(err, ShouldBeNil)
+				So(chunks[0].Stream, ShouldEqual, core.StreamCookie)
+				request.Cookie = chunks[0].Data
+				core.WriteChunks([]core.Chunk{{Stream: core.StreamJoin, Data: core.MakeJoinChunkData(request)}}, core.NoConnection, conn)
+				conn.SetReadDeadline(time.Now().Add(time.Second))
+				n, err = conn.Read(buf)
+				So(err, ShouldBeNil)
+				chunks, err = core.ParseChunks(buf[0:n])
+				So(err, ShouldBeNil)
+				So(chunks[0].Stream, ShouldEqual, core.StreamRefuse)
+				reason, err := core.ParseRefuseChunkData(chunks[0].Data)
+				So(err, ShouldBeNil)
+				So(reason, ShouldEqual, sluice.RefusedKeyExchange)
+			}
+		})
+	})
+
+	Convey("Clients that did a key exchange ignore welcomes that aren't sealed for their session.", t, func() {
+		identity, err := ecdh.X25519().GenerateKey(rand.Reader)
+		So(err, ShouldBeNil)
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+		So(err, ShouldBeNil)
+		defer conn.Close()
+
+		// This host answers the first request to join with a handshake, and then a forged welcome that
+		// anyone could have sent, before the real one.
+		go func() {
+			buf := make([]byte, 65536)
+			n, addr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			chunks, err := core.ParseChunks(buf[0:n])
+			if err != nil || len(chunks) != 1 {
+				return
+			}
+			request, err := core.ParseJoinChunkData(chunks[0].Data)
+			if err != nil {
+				return
+			}
+			handshake, session, err := core.AcceptKeyExchange(identity, request.Ephemeral, nil)
+			if err != nil {
+				return
+			}
+			to := udpWriter{conn, addr}
+			core.WriteChunks([]core.Chunk{{Stream: core.StreamHandshake, Data: core.MakeHandshakeChunkData(handshake)}}, core.NoConnection, to)
+			config := makeTestConfig()
+			for _, chunk := range welcomeChunks(config, 99) {
+				core.WriteChunks([]core.Chunk{chunk}, 5, to)
+			}
+			for _, chunk := range welcomeChunks(config, core.HostNodeId+1) {
+				session.WriteChunks([]core.Chunk{chunk}, 6, to)
+			}
+		}()
+
+		client, err := sluice.MakeClient(conn.LocalAddr().String(), makeTestConfig())
+		So(err, ShouldBeNil)
+		defer client.Close()
+		So(client.NodeId(), ShouldEqual, core.HostNodeId+1)
+		So(client.HostKey(), ShouldResemble, identity.PublicKey().Bytes())
+	})
+
+	Convey("Clients that expect a key refuse hosts without an Identity.", t, func() {
+		host, err := sluice.MakeHost("127.0.0.1:0", makeTestConfig())
+		So(err, ShouldBeNil)
+		defer host.Close()
+		identity, err := ecdh.X25519().GenerateKey(rand.Reader)
+		So(err, ShouldBeNil)
+		config := makeTestConfig()
+		config.HostKey = identity.PublicKey().Bytes()
+		_, err = sluice.MakeClient(host.Addr().String(), config)
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestReplays(t *testing.T) {
+	Convey("Replayed datagrams are dropped and counted.", t, func() {
+		config := func() *core.Config {
+			config := makeTestConfig()
+			config.Key = []byte("0123456789abcdef")
+			return config
+		}
+		host, err := sluice.MakeHost("127.0.0.1:0", config())
+		So(err, ShouldBeNil)
+		defer host.Close()
+		proxy, err := makeRebindingProxy(host.Addr().(*net.UDPAddr))
+		So(err, ShouldBeNil)
+		defer proxy.Close()
+		client, err := sluice.MakeClient(proxy.Addr().String(), config())
+		So(err, ShouldBeNil)
+		defer client.Close()
+		So(<-host.Events(), ShouldResemble, sluice.Event{Type: sluice.EventJoin, Node: client.NodeId()})
+		So(host.Counters().Replayed, ShouldEqual, 0)
+
+		proxy.SetReplay(true)
+		for i := 0; i < 10; i++ {
+			So(client.Send("UU", []byte(fmt.Sprintf("packet %d", i))), ShouldBeNil)
+		}
+		received := make(map[string]int)
+		timeout := time.After(300 * time.Millisecond)
+	loop:
+		for {
+			select {
+			case packet := <-host.Recv():
+				received[string(packet.Data)]++
+			case <-timeout:
+				break loop
+			}
+		}
+		So(len(received), ShouldBeGreaterThan, 0)
+		for data, count := range received {
+			So(data, ShouldContainSubstring, "packet ")
+			So(count, ShouldEqual, 1)
+		}
+		So(host.Counters().Replayed, ShouldBeGreaterThanOrEqualTo, 10)
+		So(client.Counters().Replayed, ShouldEqual, 0)
+	})
+}
+
+func TestAuthentication(t *testing.T) {
+	Convey("Hosts that authenticate clients", t, func() {
+		config := makeTestConfig()
+		var addrs []string
+		config.Authenticate = func(addr network.Addr, data []byte) (string, error) {
+			addrs = append(addrs, addr.String())
+			if string(data) != "good ticket" {
+				return "", fmt.Errorf("bad ticket")
+			}
+			return "player", nil
+		}
+		host, err := sluice.MakeHost("127.0.0.1:0", config)
+		So(err, ShouldBeNil)
+		defer host.Close()
+
+		Convey("let in clients they accept.", func() {
+			config := makeTestConfig()
+			config.JoinData = []byte("good ticket")
+			client, err := sluice.MakeClient(host.Addr().String(), config)
+			So(err, ShouldBeNil)
+			defer client.Close()
+			So(<-host.Events(), ShouldResemble, sluice.Event{Type: sluice.EventJoin, Node: client.NodeId()})
+			So(len(addrs), ShouldEqual, 1)
+		})
+
+		Convey("tell clients they reject why.", func() {
+			config := makeTestConfig()
+			config.JoinData = []byte("forged ticket")
+			client, err := sluice.MakeClient(host.Addr().String(), config)
+			So(client, ShouldBeNil)
+			refused, ok := err.(*sluice.RefusedError)
+			So(ok, ShouldBeTrue)
+			So(refused.Reason, ShouldEqual, "bad ticket")
+			select {
+			case event := <-host.Events():
+				So(event, ShouldBeNil)
+			case <-time.After(50 * time.Millisecond):
+			}
+		})
+	})
+}
+
+func TestAdmissionControl(t *testing.T) {
+	Convey("Hosts with a limit on clients", t, func() {
+		config := makeTestConfig()
+		config.MaxClients = 2
+		host, err := sluice.MakeHost("127.0.0.1:0", config)
+		So(err, ShouldBeNil)
+		defer host.Close()
+		first, err := sluice.MakeClient(host.Addr().String(), makeTestConfig())
+		So(err, ShouldBeNil)
+		defer first.Close()
+		So(<-host.Events(), ShouldResemble, sluice.Event{Type: sluice.EventJoin, Node: first.NodeId()})
+		second, err := sluice.MakeClient(host.Addr().String(), makeTestConfig())
+		So(err, ShouldBeNil)
+		defer second.Close()
+		So(<-host.Events(), ShouldResemble, sluice.Event{Type: sluice.EventJoin, Node: second.NodeId()})
+
+		Convey("refuse clients once they are full.", func() {
+			_, err := sluice.MakeClient(host.Addr().String(), makeTestConfig())
+			So(err, ShouldResemble, &sluice.RefusedError{Reason: sluice.RefusedFull})
+		})
+
+		Convey("let clients in again once someone leaves.", func() {
+			So(first.Close(), ShouldBeNil)
+			So(<-host.Events(), ShouldResemble, sluice.Event{Type: sluice.EventLeave, Node: first.NodeId(), Reason: core.LeaveClosed})
+			third, err := sluice.MakeClient(host.Addr().String(), makeTestConfig())
+			So(err, ShouldBeNil)
+			defer third.Close()
+			So(<-host.Events(), ShouldResemble, sluice.Event{Type: sluice.EventJoin, Node: third.NodeId()})
+		})
+	})
+
+	Convey("Hosts with a limit on clients per IP address refuse clients past it.", t, func() {
+		config := makeTestConfig()
+		config.MaxClientsPerIP = 1
+		host, err := sluice.MakeHost("127.0.0.1:0", config)
+		So(err, ShouldBeNil)
+		defer host.Close()
+		client, err := sluice.MakeClient(host.Addr().String(), makeTestConfig())
+		So(err, ShouldBeNil)
+		defer client.Close()
+		So(<-host.Events(), ShouldResemble, sluice.Event{Type: sluice.EventJoin, Node: client.NodeId()})
+		_, err = sluice.MakeClient(host.Addr().String(), makeTestConfig())
+		So(err, ShouldResemble, &sluice.RefusedError{Reason: sluice.RefusedTooManyFromIP})
+	})
+}
+
+func TestKickAndBan(t *testing.T) {
+	Convey("Hosts", t, func() {
+		config := makeTestConfig()
+		config.Authenticate = func(addr network.Addr, data []byte) (string, error) {
+			return string(data), nil
+		}
+		host, err := sluice.MakeHost("127.0.0.1:0", config)
+		So(err, ShouldBeNil)
+		defer host.Close()
+		join := func(identity string) *sluice.Client {
+			config := makeTestConfig()
+			config.JoinData = []byte(identity)
+			client, err := sluice.MakeClient(host.Addr().String(), config)
+			So(err, ShouldBeNil)
+			So(<-host.Events(), ShouldResemble, sluice.Event{Type: sluice.EventJoin, Node: client.NodeId()})
+			return client
+		}
+		client := join("alice")
+		defer client.Close()
+
+		Convey("can kick clients, and tell them why.", func() {
+			So(host.Kick(client.NodeId(), "be nice"), ShouldBeNil)
+			So(<-host.Events(), ShouldResemble, sluice.Event{Type: sluice.EventLeave, Node: client.NodeId(), Reason: core.LeaveKicked})
+			So(<-client.Events(), ShouldResemble, sluice.Event{Type: sluice.EventLeave, Node: core.HostNodeId, Reason: core.LeaveKicked, Message: "be nice"})
+
+			// Kicked clients can come back.
+			again := join("alice")
+			defer again.Close()
+		})
+
+		Convey("can't kick clients they don't have.", func() {
+			So(host.Kick(client.NodeId()+1, "who?"), ShouldNotBeNil)
+			So(host.Ban(client.NodeId()+1, "who?", 0), ShouldNotBeNil)
+		})
+
+		Convey("refuse clients from addresses they banned.", func() {
+			So(host.Ban(client.NodeId(), "cheating", 0), ShouldBeNil)
+			So(<-host.Events(), ShouldResemble, sluice.Event{Type: sluice.EventLeave, Node: client.NodeId(), Reason: core.LeaveKicked})
+			config := makeTestConfig()
+			config.JoinData = []byte("bob")
+			_, err := sluice.MakeClient(host.Addr().String(), config)
+			So(err, ShouldResemble, &sluice.RefusedError{Reason: sluice.RefusedBanned})
+
+			host.Unban("127.0.0.1")
+			bob := join("bob")
+			defer bob.Close()
+
+			// alice is still banned.
+			config.JoinData = []byte("alice")
+			_, err = sluice.MakeClient(host.Addr().String(), config)
+			So(err, ShouldResemble, &sluice.RefusedError{Reason: sluice.RefusedBanned})
+		})
+
+		Convey("refuse identities they banned until the ban runs out.", func() {
+			host.BanIdentity("mallory", 100*time.Millisecond)
+			config := makeTestConfig()
+			config.JoinData = []byte("mallory")
+			_, err := sluice.MakeClient(host.Addr().String(), config)
+			So(err, ShouldResemble, &sluice.RefusedError{Reason: sluice.RefusedBanned})
+			time.Sleep(150 * time.Millisecond)
+			mallory := join("mallory")
+			defer mallory.Close()
+		})
+
+		Convey("don't kick clients that are already in when an address is banned.", func() {
+			host.BanAddr("127.0.0.1", 0)
+			So(client.Send("RO", []byte("still here")), ShouldBeNil)
+			packet := <-host.Recv()
+			So(string(packet.Data), ShouldEqual, "still here")
+		})
+	})
+}
+
+func TestHostConfig(t *testing.T) {
+	Convey("Clients use the streams and settings the host sends them.", t, func() {
+		host, err := sluice.MakeHost("127.0.0.1:0", makeTestConfig())
+		So(err, ShouldBeNil)
+		defer host.Close()
+		client, err := sluice.MakeClient(host.Addr().String(), nil)
+		So(err, ShouldBeNil)
+		defer client.Close()
+		So(<-host.Events(), ShouldResemble, sluice.Event{Type: sluice.EventJoin, Node: client.NodeId()})
+
+		So(client.Send("RO", []byte("thundercats")), ShouldBeNil)
+		packet := <-host.Recv()
+		So(packet.Source, ShouldEqual, client.NodeId())
+		So(string(packet.Data), ShouldEqual, "thundercats")
+
+		// The host's settings are used no matter what the client was configured with.
+		config := makeTestConfig()
+		config.Timeout = 0
+		config.Keepalive = time.Hour
+		other, err := sluice.MakeClient(host.Addr().String(), config)
+		So(err, ShouldBeNil)
+		defer other.Close()
+		So(<-host.Events(), ShouldResemble, sluice.Event{Type: sluice.EventJoin, Node: other.NodeId()})
+		So(other.Send("RB", []byte("everyone")), ShouldBeNil)
+		packet = <-client.Recv()
+		So(packet.Source, ShouldEqual, other.NodeId())
+		So(string(packet.Data), ShouldEqual, "everyone")
+	})
+
+	Convey("Hosts refuse streams in unknown modes.", t, func() {
+		config := makeTestConfig()
+		stream := config.Streams[7]
+		stream.Mode = core.ModeMax
+		config.Streams[7] = stream
+		_, err := sluice.MakeHost("127.0.0.1:0", config)
+		So(err, ShouldNotBeNil)
+	})
+
+	Convey("Clients still check the parts of their config they need to join.", t, func() {
+		config := &core.Config{}
+		config.Key = []byte("short")
+		_, err := sluice.MakeClient("127.0.0.1:1", config)
+		So(err, ShouldNotBeNil)
+	})
+}
+
+func TestConfigMismatch(t *testing.T) {
+	Convey("Hosts refuse clients whose streams don't match, and the clients are told how.", t, func() {
+		host, err := sluice.MakeHost("127.0.0.1:0", makeTestConfig())
+		So(err, ShouldBeNil)
+		defer host.Close()
+
+		config := makeTestConfig()
+		config.MaxChunkDataSize = 100
+		delete(config.Streams, 7)
+		stream := config.Streams[10]
+		stream.Mode = core.ModeUnreliableOrdered
+		config.Streams[10] = stream
+		config.Streams[3] = core.StreamConfig{Name: "mine", Id: 3, Mode: core.ModeReliableOrdered}
+		_, err = sluice.MakeClient(host.Addr().String(), config)
+		So(err, ShouldResemble, &sluice.ConfigMismatchError{Differences: []string{
+			"MaxChunkDataSize is 100, the host's is 50",
+			`stream 3 ("mine") isn't on the host`,
+			`stream 7 ("UU") is only on the host`,
+			`stream 10 ("RO") is ModeUnreliableOrdered, the host's is ModeReliableOrdered`,
+		}})
+		So(err.Error(), ShouldContainSubstring, `stream 3 ("mine") isn't on the host`)
+		select {
+		case event := <-host.Events():
+			So(event, ShouldBeNil)
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		// Clients with matching streams are let in.
+		client, err := sluice.MakeClient(host.Addr().String(), makeTestConfig())
+		So(err, ShouldBeNil)
+		defer client.Close()
+		So(<-host.Events(), ShouldResemble, sluice.Event{Type: sluice.EventJoin, Node: client.NodeId()})
+	})
+}
+
+func TestProtocolVersions(t *testing.T) {
+	Convey("Hosts answer datagrams in versions they don't speak with the versions they do.", t, func() {
+		host, err := sluice.MakeHost("127.0.0.1:0", makeTestConfig())
+		So(err, ShouldBeNil)
+		defer host.Close()
+		conn, err := net.DialUDP("udp", nil, host.Addr().(*net.UDPAddr))
+		So(err, ShouldBeNil)
+		defer conn.Close()
+
+		var written bytes.Buffer
+		request := core.Chunk{Stream: core.StreamJoin, Data: core.MakeJoinChunkData(&core.JoinRequest{Versions: core.SupportedVersions})}
+		core.WriteChunks([]core.Chunk{request}, core.NoConnection, &written)
+		datagram := written.Bytes()
+		datagram[2] = byte(core.SupportedVersions.Max + 1)
+		_, err = conn.Write(datagram)
+		So(err, ShouldBeNil)
+
+		buf := make([]byte, 65536)
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, err := conn.Read(buf)
+		So(err, ShouldBeNil)
+		versions, ok := core.ParseVersionRejection(buf[0:n])
+		So(ok, ShouldBeTrue)
+		So(versions, ShouldResemble, core.SupportedVersions)
+	})
+
+	Convey("Hosts answer joins in the version they were asked in, even if it isn't their oldest.", t, func() {
+		ours := core.SupportedVersions
+		core.SupportedVersions.Max++
+		defer func() { core.SupportedVersions = ours }()
+		newest := core.SupportedVersions.Max
+		host, err := sluice.MakeHost("127.0.0.1:0", makeTestConfig())
+		So(err, ShouldBeNil)
+		defer host.Close()
+
+		// ask sends request in the newest version, and the cookie it gets back, and returns the stream
+		// of the chunk that says how it went.  Everything from the host must be in the newest version.
+		ask := func(request *core.JoinRequest) core.StreamId {
+			conn, err := net.DialUDP("udp", nil, host.Addr().(*net.UDPAddr))
+			So(err, ShouldBeNil)
+			defer conn.Close()
+			framer, err := core.MakeFramer(nil)
+			So(err, ShouldBeNil)
+			framer.SetVersion(core.NoConnection, newest)
+			framer.WriteChunks([]core.Chunk{{Stream: core.StreamJoin, Data: core.MakeJoinChunkData(request)}}, core.NoConnection, conn)
+			buf := make([]byte, 65536)
+			conn.SetReadDeadline(time.Now().Add(time.Second))
+			for {
+				n, err := conn.Read(buf)
+				So(err, ShouldBeNil)
+				So(buf[2], ShouldEqual, byte(newest))
+				chunks, err := framer.ParseChunks(buf[0:n])
+				So(err, ShouldBeNil)
+				for _, chunk := range chunks {
+					switch chunk.Stream {
+					case core.StreamCookie:
+						request.Cookie = chunk.Data
+						framer.WriteChunks([]core.Chunk{{Stream: core.StreamJoin, Data: core.MakeJoinChunkData(request)}}, core.NoConnection, conn)
+					case core.StreamWelcome, core.StreamRefuse:
+						return chunk.Stream
+					}
+				}
+			}
+		}
+		So(ask(&core.JoinRequest{Versions: core.VersionRange{Min: newest, Max: newest + 1}}), ShouldEqual, core.StreamWelcome)
+		So(ask(&core.JoinRequest{Versions: core.VersionRange{Min: newest + 1, Max: newest + 1}}), ShouldEqual, core.StreamRefuse)
+	})
+
+	Convey("Clients keep asking to join after a version rejection, since anyone could have sent it.", t, func() {
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		So(err, ShouldBeNil)
+		defer conn.Close()
+		go func() {
+			buf := make([]byte, 1024)
+			_, addr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			rejection := core.MakeVersionRejection()
+			rejection[len(rejection)-2] = byte(core.SupportedVersions.Max + 1)
+			rejection[len(rejection)-1] = byte(core.SupportedVersions.Max + 1)
+			conn.WriteToUDP(rejection, addr)
+
+			// The host itself welcomes the next request.
+			if _, addr, err = conn.ReadFromUDP(buf); err != nil {
+				return
+			}
+			for _, chunk := range welcomeChunks(makeTestConfig(), core.HostNodeId+1) {
+				core.WriteChunks([]core.Chunk{chunk}, 6, udpWriter{conn, addr})
+			}
+		}()
+
+		client, err := sluice.MakeClient(conn.LocalAddr().String(), nil)
+		So(err, ShouldBeNil)
+		defer client.Close()
+		So(client.NodeId(), ShouldEqual, core.HostNodeId+1)
+	})
+
+	Convey("Clients give up on hosts that don't speak any of the same versions.", t, func() {
+		conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		So(err, ShouldBeNil)
+		defer conn.Close()
+		theirs := core.VersionRange{Min: core.SupportedVersions.Max + 1, Max: core.SupportedVersions.Max + 3}
+		go func() {
+			buf := make([]byte, 1024)
+			_, addr, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			// A rejection is our own with their versions in place of ours.
+			rejection := core.MakeVersionRejection()
+			rejection[len(rejection)-2] = byte(theirs.Min)
+			rejection[len(rejection)-1] = byte(theirs.Max)
+			conn.WriteToUDP(rejection, addr)
+		}()
+
+		_, err = sluice.MakeClient(conn.LocalAddr().String(), nil)
+		So(err, ShouldResemble, &core.VersionError{Ours: core.SupportedVersions, Theirs: theirs})
+		So(err.Error(), ShouldContainSubstring, "incompatible sluice protocol")
+	})
+}
+
+func TestAppVersion(t *testing.T) {
+	Convey("Hosts that check the application's version", t, func() {
+		config := makeTestConfig()
+		var versions []string
+		config.CheckAppVersion = func(version string) error {
+			versions = append(versions, version)
+			if version != "2.0" {
+				return fmt.Errorf("please update to 2.0")
+			}
+			return nil
+		}
+		host, err := sluice.MakeHost("127.0.0.1:0", config)
+		So(err, ShouldBeNil)
+		defer host.Close()
+
+		Convey("let in clients with versions they accept.", func() {
+			config := makeTestConfig()
+			config.AppVersion = "2.0"
+			client, err := sluice.MakeClient(host.Addr().String(), config)
+			So(err, ShouldBeNil)
+			defer client.Close()
+			So(<-host.Events(), ShouldResemble, sluice.Event{Type: sluice.EventJoin, Node: client.NodeId()})
+			So(versions, ShouldResemble, []string{"2.0"})
+		})
+
+		Convey("tell outdated clients to update.", func() {
+			config := makeTestConfig()
+			config.AppVersion = "1.0"
+			_, err := sluice.MakeClient(host.Addr().String(), config)
+			So(err, ShouldResemble, &sluice.RefusedError{Reason: "please update to 2.0"})
+		})
+
+		Convey("tell outdated clients to update before checking their streams.", func() {
+			config := makeTestConfig()
+			config.AppVersion = "1.0"
+			config.Streams[3] = core.StreamConfig{Name: "old", Id: 3, Mode: core.ModeReliableOrdered}
+			_, err := sluice.MakeClient(host.Addr().String(), config)
+			So(err, ShouldResemble, &sluice.RefusedError{Reason: "please update to 2.0"})
+		})
+	})
+
+	Convey("Clients can't send application versions that are too long.", t, func() {
+		config := &core.Config{AppVersion: strings.Repeat("1", core.MaxAppVersionSize+1)}
+		_, err := sluice.MakeClient("127.0.0.1:1", config)
+		So(err, ShouldNotBeNil)
+	})
+}